@@ -0,0 +1,512 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+
+	"github.com/imbbLab/v3c-viz/interact"
+	"github.com/imbbLab/v3c-viz/pairs"
+)
+
+type indexCommand struct {
+	Args struct {
+		Files []string `positional-arg-name:"data" description:"bgzip compressed .pairs file(s) to index" required:"1"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+// Execute builds the .px2 index for each of the supplied files
+func (command *indexCommand) Execute(args []string) error {
+	for _, filename := range command.Args.Files {
+		err := pairs.BuildIndex(filename)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type binCommand struct {
+	Resolutions []uint64 `short:"r" long:"resolution" description:"Bin size to store, must be a multiple of the smallest bin size (can be repeated, defaults to 10 kb to 2 Mb)"`
+
+	Args struct {
+		Files []string `positional-arg-name:"data" description:".pairs file(s) to bin" required:"1"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+// Execute builds the binned matrix for each of the supplied files
+func (command *binCommand) Execute(args []string) error {
+	for _, filename := range command.Args.Files {
+		pairsFile, err := pairs.Parse(filename)
+		if err != nil {
+			return err
+		}
+
+		err = pairs.BuildMatrix(context.Background(), pairsFile, pairs.MatrixFilename(filename), command.Resolutions)
+		pairsFile.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type psCurveCommand struct {
+	Regions       []string `short:"r" long:"region" description:"Chromosome or region (chrom:start-end) to compute a curve for, or genome for all chromosomes (can be repeated, defaults to genome)"`
+	BinsPerDecade int      `long:"binsperdecade" description:"Number of log-spaced distance bins for each factor of 10" default:"10"`
+	ByOrientation bool     `long:"byorientation" description:"Compute a separate curve for each strand orientation"`
+	Format        string   `short:"f" long:"format" description:"Output format" choice:"tsv" choice:"json" default:"tsv"`
+	Output        string   `short:"o" long:"output" description:"File to write the curves to (defaults to stdout)"`
+
+	Args struct {
+		File string `positional-arg-name:"data" description:".pairs file to compute the P(s) curve of"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+// Execute writes the P(s) curve of each region
+func (command *psCurveCommand) Execute(args []string) error {
+	pairsFile, err := pairs.Parse(command.Args.File)
+	if err != nil {
+		return err
+	}
+	defer pairsFile.Close()
+
+	options := pairs.PsOptions{BinsPerDecade: command.BinsPerDecade, ByOrientation: command.ByOrientation}
+
+	curves, err := psCurves(context.Background(), pairsFile, command.Regions, options)
+	if err != nil {
+		return err
+	}
+
+	return writeOutput(command.Output, func(writer io.Writer) error {
+		return writePsCurves(writer, curves, command.Format)
+	})
+}
+
+type compartmentsCommand struct {
+	Resolution  uint64   `short:"r" long:"resolution" description:"Bin size of the eigenvector" required:"true"`
+	Chroms      []string `short:"c" long:"chrom" description:"Chromosome to compute the eigenvector of (can be repeated, defaults to all chromosomes)"`
+	Balance     bool     `long:"balance" description:"Balance the counts of each chromosome before computing observed/expected"`
+	Orientation string   `long:"orientation" description:"bedGraph track (e.g. GC content or gene density) the eigenvector should correlate positively with"`
+	Output      string   `short:"o" long:"output" description:"File to write the bedGraph to (defaults to stdout)"`
+
+	Args struct {
+		File string `positional-arg-name:"data" description:".pairs file to compute the compartments of"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+// Execute writes the compartment eigenvector of each chromosome as bedGraph
+func (command *compartmentsCommand) Execute(args []string) error {
+	pairsFile, err := pairs.Parse(command.Args.File)
+	if err != nil {
+		return err
+	}
+	defer pairsFile.Close()
+
+	ctx := context.Background()
+	options := pairs.DefaultCompartmentOptions
+
+	if command.Orientation != "" {
+		file, err := os.Open(command.Orientation)
+		if err != nil {
+			return err
+		}
+
+		options.Orientation, err = pairs.ReadBedGraph(file)
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	if command.Balance {
+		balanceOptions := pairs.DefaultBalanceOptions
+		balanceOptions.PerChromosome = true
+
+		options.Weights, err = pairs.LoadBalanceWeights(ctx, pairsFile, command.Args.File, command.Resolution, balanceOptions)
+		if err != nil {
+			return err
+		}
+	}
+
+	chroms := command.Chroms
+	if len(chroms) == 0 {
+		chroms = pairsFile.Chromosomes()
+	}
+
+	var eigenvectors []pairs.TrackBin
+	for _, chrom := range chroms {
+		eigenvector, err := pairs.CompartmentEigenvector(ctx, pairsFile, chrom, command.Resolution, options)
+		if err != nil {
+			// Small chromosomes (such as unplaced contigs) don't stop the rest of the genome being computed
+			if len(command.Chroms) == 0 {
+				log.Printf("Skipping %s: %s\n", chrom, err)
+				continue
+			}
+			return err
+		}
+		eigenvectors = append(eigenvectors, eigenvector...)
+	}
+
+	return writeOutput(command.Output, func(writer io.Writer) error {
+		return pairs.WriteBedGraph(writer, eigenvectors)
+	})
+}
+
+type loopsCommand struct {
+	Resolution    uint64   `short:"r" long:"resolution" description:"Bin size of the matrix searched for loops" required:"true"`
+	Chroms        []string `short:"c" long:"chrom" description:"Chromosome to search (can be repeated, defaults to all chromosomes)"`
+	MinDistance   uint64   `long:"mindistance" description:"Minimum distance between the anchors of a loop"`
+	MaxDistance   uint64   `long:"maxdistance" description:"Maximum distance between the anchors of a loop" default:"2000000"`
+	PeakWidth     int      `long:"peakwidth" description:"Half-width (in bins) of the peak excluded from the local backgrounds" default:"2"`
+	WindowWidth   int      `long:"windowwidth" description:"Half-width (in bins) of the local backgrounds" default:"5"`
+	FDR           float64  `long:"fdr" description:"Maximum false discovery rate" default:"0.1"`
+	MinEnrichment float64  `long:"minenrichment" description:"Minimum ratio of observed to expected contacts" default:"1.5"`
+	MinCount      uint64   `long:"mincount" description:"Minimum number of contacts of a loop" default:"5"`
+	Balance       bool     `long:"balance" description:"Balance the counts (per chromosome) when computing the expected contacts"`
+	Format        string   `short:"f" long:"format" description:"Output format" choice:"interact" choice:"bedpe" default:"interact"`
+	Output        string   `short:"o" long:"output" description:"File to write the loops to (defaults to stdout)"`
+
+	Args struct {
+		File string `positional-arg-name:"data" description:".pairs file to call loops in"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+// Execute writes the loops called in each chromosome
+func (command *loopsCommand) Execute(args []string) error {
+	pairsFile, err := pairs.Parse(command.Args.File)
+	if err != nil {
+		return err
+	}
+	defer pairsFile.Close()
+
+	ctx := context.Background()
+	options := pairs.LoopOptions{MinDistance: command.MinDistance, MaxDistance: command.MaxDistance, PeakWidth: command.PeakWidth,
+		WindowWidth: command.WindowWidth, FDR: command.FDR, MinEnrichment: command.MinEnrichment, MinCount: command.MinCount}
+
+	if command.Balance {
+		balanceOptions := pairs.DefaultBalanceOptions
+		balanceOptions.PerChromosome = true
+
+		options.Weights, err = pairs.LoadBalanceWeights(ctx, pairsFile, command.Args.File, command.Resolution, balanceOptions)
+		if err != nil {
+			return err
+		}
+	}
+
+	interactFile, err := callLoops(ctx, pairsFile, command.Chroms, command.Resolution, options)
+	if err != nil {
+		return err
+	}
+
+	return writeOutput(command.Output, func(writer io.Writer) error {
+		if command.Format == "bedpe" {
+			return interactFile.WriteBEDPE(writer)
+		}
+		return interactFile.Write(writer)
+	})
+}
+
+type apaCommand struct {
+	Interact    string  `short:"i" long:"interact" description:"Interact file of the interactions to aggregate" required:"true"`
+	Resolution  uint64  `short:"r" long:"resolution" description:"Bin size of the sub-matrices" default:"10000"`
+	Flank       int     `long:"flank" description:"Number of bins either side of the centre of each sub-matrix" default:"10"`
+	CornerWidth int     `long:"cornerwidth" description:"Width (in bins) of the lower-left corner used for the scores" default:"6"`
+	MinDistance *uint64 `long:"mindistance" description:"Minimum distance between the ends of an interaction (defaults to 30 bins)"`
+	MaxDistance uint64  `long:"maxdistance" description:"Maximum distance between the ends of an interaction (0 for no maximum)"`
+	Balance     bool    `long:"balance" description:"Balance the counts (genome wide) before aggregating"`
+	Output      string  `short:"o" long:"output" description:"File to write the JSON result to (defaults to stdout)"`
+
+	Args struct {
+		File string `positional-arg-name:"data" description:"Data file (.pairs or .hic) to aggregate"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+// Execute writes the aggregate peak analysis of the interactions as JSON
+func (command *apaCommand) Execute(args []string) error {
+	interactFile, err := interact.Parse(command.Interact)
+	if err != nil {
+		return err
+	}
+
+	pairsFile, err := pairs.Parse(command.Args.File)
+	if err != nil {
+		return err
+	}
+	defer pairsFile.Close()
+
+	ctx := context.Background()
+	options := pairs.APAOptions{Resolution: command.Resolution, Flank: command.Flank, CornerWidth: command.CornerWidth,
+		MinDistance: 30 * command.Resolution, MaxDistance: command.MaxDistance}
+	if command.MinDistance != nil {
+		options.MinDistance = *command.MinDistance
+	}
+
+	if command.Balance {
+		options.Weights, err = pairs.LoadBalanceWeights(ctx, pairsFile, command.Args.File, command.Resolution, pairs.DefaultBalanceOptions)
+		if err != nil {
+			return err
+		}
+	}
+
+	apa, err := pairs.AggregatePeakAnalysis(ctx, pairsFile, interactionCentres(interactFile), options)
+	if err != nil {
+		return err
+	}
+
+	return writeOutput(command.Output, func(writer io.Writer) error {
+		return json.NewEncoder(writer).Encode(newAPAResponse(apa))
+	})
+}
+
+type pileupCommand struct {
+	Bed        string  `short:"b" long:"bed" description:"BED file of the features to pile up" required:"true"`
+	Resolution uint64  `short:"r" long:"resolution" description:"Bin size of the windows" default:"10000"`
+	Flank      int     `long:"flank" description:"Number of bins either side of the centre of each feature" default:"10"`
+	Rescale    bool    `long:"rescale" description:"Rescale each padded feature to a common size, rather than centring a window on it"`
+	Size       int     `long:"size" description:"Number of bins of the rescaled windows" default:"99"`
+	Padding    float64 `long:"padding" description:"Padding either side of each rescaled feature, as a multiple of its length" default:"1"`
+	ObsExp     bool    `long:"obsexp" description:"Divide the counts by the expected contacts at their distance"`
+	Balance    bool    `long:"balance" description:"Balance the counts (per chromosome) before piling up"`
+	Output     string  `short:"o" long:"output" description:"File to write the JSON result to (defaults to stdout)"`
+
+	Args struct {
+		File string `positional-arg-name:"data" description:"Data file (.pairs or .hic) to pile up"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+// Execute writes the pile-up of the features as JSON
+func (command *pileupCommand) Execute(args []string) error {
+	bedFile, err := os.Open(command.Bed)
+	if err != nil {
+		return err
+	}
+	features, err := pairs.ReadBed(bedFile)
+	bedFile.Close()
+	if err != nil {
+		return err
+	}
+
+	pairsFile, err := pairs.Parse(command.Args.File)
+	if err != nil {
+		return err
+	}
+	defer pairsFile.Close()
+
+	ctx := context.Background()
+	options := pairs.PileupOptions{Resolution: command.Resolution, Flank: command.Flank, Rescale: command.Rescale,
+		Size: command.Size, Padding: command.Padding, ObsExp: command.ObsExp}
+
+	if command.Balance {
+		balanceOptions := pairs.DefaultBalanceOptions
+		balanceOptions.PerChromosome = true
+
+		options.Weights, err = pairs.LoadBalanceWeights(ctx, pairsFile, command.Args.File, command.Resolution, balanceOptions)
+		if err != nil {
+			return err
+		}
+	}
+
+	pileup, err := pairs.FeaturePileup(ctx, pairsFile, features, options)
+	if err != nil {
+		return err
+	}
+
+	return writeOutput(command.Output, func(writer io.Writer) error {
+		return json.NewEncoder(writer).Encode(pileup)
+	})
+}
+
+type statsCommand struct {
+	Exact   bool     `long:"exact" description:"Count every entry, rather than estimating the counts of each chromosome pair from the index"`
+	Cutoffs []uint64 `short:"c" long:"cutoff" description:"Distance separating short-range from long-range cis entries, only counted with --exact (can be repeated, defaults to 1 kb, 10 kb and 20 kb)"`
+	Format  string   `short:"f" long:"format" description:"Output format" choice:"tsv" choice:"json" default:"tsv"`
+	Output  string   `short:"o" long:"output" description:"File to write the statistics to (defaults to stdout)"`
+
+	Args struct {
+		File string `positional-arg-name:"data" description:"Data file (.pairs or .hic) to summarise"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+// Execute writes the summary statistics of the file
+func (command *statsCommand) Execute(args []string) error {
+	pairsFile, err := pairs.Parse(command.Args.File)
+	if err != nil {
+		return err
+	}
+	defer pairsFile.Close()
+
+	options := pairs.DefaultStatsOptions
+	options.Exact = command.Exact
+	if len(command.Cutoffs) > 0 {
+		options.DistanceCutoffs = command.Cutoffs
+	}
+
+	stats, err := pairs.ComputeStats(context.Background(), pairsFile, options)
+	if err != nil {
+		return err
+	}
+
+	return writeOutput(command.Output, func(writer io.Writer) error {
+		if command.Format == "json" {
+			return json.NewEncoder(writer).Encode(newStatsResponse(stats))
+		}
+		return pairs.WriteStatsTSV(writer, stats)
+	})
+}
+
+// writeOutput calls writeFunction with the file, or stdout when no filename is given
+func writeOutput(filename string, writeFunction func(writer io.Writer) error) error {
+	if filename == "" {
+		return writeFunction(os.Stdout)
+	}
+
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+
+	err = writeFunction(file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// psCurves computes the P(s) curve of each region, where a region is a chromosome, chrom:start-end or genome for
+// all chromosomes. When no regions are given, the curve of the whole genome is computed.
+func psCurves(ctx context.Context, pairsFile pairs.File, regions []string, options pairs.PsOptions) ([]*pairs.PsCurve, error) {
+	if len(regions) == 0 {
+		regions = []string{"genome"}
+	}
+
+	var curves []*pairs.PsCurve
+	for _, name := range regions {
+		var curveRegions []pairs.Region
+
+		if name == "genome" {
+			for _, chrom := range pairsFile.Chromosomes() {
+				curveRegions = append(curveRegions, pairs.Region{Chrom: chrom, Start: 0, End: pairsFile.Chromsizes()[chrom].Length})
+			}
+		} else {
+			region, err := pairs.ParseRegion(name, pairsFile.Chromsizes())
+			if err != nil {
+				return nil, err
+			}
+			curveRegions = append(curveRegions, region)
+		}
+
+		curve, err := pairs.ComputePsCurve(ctx, pairsFile, name, curveRegions, options)
+		if err != nil {
+			return nil, err
+		}
+		curves = append(curves, curve)
+	}
+
+	return curves, nil
+}
+
+func writePsCurves(writer io.Writer, curves []*pairs.PsCurve, format string) error {
+	switch format {
+	case "", "tsv":
+		return pairs.WritePsCurvesTSV(writer, curves)
+	case "json":
+		return json.NewEncoder(writer).Encode(curves)
+	}
+
+	return fmt.Errorf("Unknown format %s, expected tsv or json", format)
+}
+
+// callLoops calls the loops of each chromosome (all chromosomes when none are given) as interactions named loop1,
+// loop2, ... The value of each interaction is the enrichment of the loop, and the score is -100 * log10 of its
+// q-value (up to 1000).
+func callLoops(ctx context.Context, pairsFile pairs.File, chroms []string, resolution uint64, options pairs.LoopOptions) (*interact.InteractFile, error) {
+	if len(chroms) == 0 {
+		chroms = pairsFile.Chromosomes()
+	}
+
+	interactFile := interact.New()
+	numLoops := 0
+	for _, chrom := range chroms {
+		loops, err := pairs.CallLoops(ctx, pairsFile, chrom, resolution, options)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, loop := range loops {
+			numLoops++
+
+			score := 1000.0
+			if loop.QValue > 0 {
+				score = math.Min(score, math.Round(-100*math.Log10(loop.QValue)))
+			}
+
+			interactFile.Add(interact.Interaction{Chrom: loop.Chrom, ChromStart: loop.Start1, ChromEnd: loop.End2,
+				Name: fmt.Sprintf("loop%d", numLoops), Score: uint64(score),
+				Value: loop.Enrichment, Exp: "loops", Colour: "0",
+				SourceChrom: loop.Chrom, SourceStart: loop.Start1, SourceEnd: loop.End1, SourceName: ".", SourceStrand: ".",
+				TargetChrom: loop.Chrom, TargetStart: loop.Start2, TargetEnd: loop.End2, TargetName: ".", TargetStrand: "."})
+		}
+
+		log.Printf("Called %d loops on %s\n", len(loops), chrom)
+	}
+
+	return interactFile, nil
+}
+
+// interactionCentres returns the centres of the source and target of each interaction as the positions of entries
+func interactionCentres(interactFile *interact.InteractFile) []pairs.Entry {
+	var centres []pairs.Entry
+	for _, interactions := range interactFile.Interactions {
+		for _, interaction := range interactions {
+			centres = append(centres, pairs.Entry{
+				SourceChrom: interaction.SourceChrom, SourcePosition: (interaction.SourceStart + interaction.SourceEnd) / 2,
+				TargetChrom: interaction.TargetChrom, TargetPosition: (interaction.TargetStart + interaction.TargetEnd) / 2})
+		}
+	}
+
+	return centres
+}
+
+// apaResponse is the JSON form of an APA, where scores that aren't finite (such as when there are no interactions)
+// are null
+type apaResponse struct {
+	Width        uint32
+	Height       uint32
+	Matrix       []float32
+	Interactions int
+	Skipped      int
+	P2LL         *float64
+	ZScoreLL     *float64
+}
+
+func newAPAResponse(apa *pairs.APA) apaResponse {
+	return apaResponse{Width: apa.Matrix.Width, Height: apa.Matrix.Height, Matrix: apa.Matrix.Data,
+		Interactions: apa.Interactions, Skipped: apa.Skipped, P2LL: finite(apa.P2LL), ZScoreLL: finite(apa.ZScoreLL)}
+}
+
+// statsResponse is the JSON form of the statistics, where the cis/trans ratio is null when there are no trans
+// entries
+type statsResponse struct {
+	*pairs.Stats
+	CisTransRatio *float64
+}
+
+func newStatsResponse(stats *pairs.Stats) statsResponse {
+	return statsResponse{Stats: stats, CisTransRatio: finite(stats.CisTransRatio)}
+}
+
+// finite returns the value, or nil when it isn't finite (and so can't be written as JSON)
+func finite(value float64) *float64 {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return nil
+	}
+	return &value
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/imbbLab/v3c-viz/pairs"
+)
+
+// dataset is a pairs file loaded by the server, addressed by its name
+type dataset struct {
+	Name     string
+	Filename string
+	Genome   string
+
+	file pairs.File
+
+	// Values computed from the file when first needed (the number of cis entries, balancing weights and
+	// expected contacts), by key
+	mu    sync.Mutex
+	cache map[string]*cachedValue
+}
+
+// cachedValue is computed once, by the first request that needs it
+type cachedValue struct {
+	once  sync.Once
+	value interface{}
+	err   error
+}
+
+// cached returns the value stored under the key, calling compute if it hasn't been computed yet. Concurrent
+// requests for the same key wait for a single computation. Failed computations aren't kept, so are tried again
+// by the next request.
+func (dataset *dataset) cached(ctx context.Context, key string, compute func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	for {
+		dataset.mu.Lock()
+		if dataset.cache == nil {
+			dataset.cache = make(map[string]*cachedValue)
+		}
+		cached, ok := dataset.cache[key]
+		if !ok {
+			cached = &cachedValue{}
+			dataset.cache[key] = cached
+		}
+		dataset.mu.Unlock()
+
+		cached.once.Do(func() {
+			cached.value, cached.err = compute(ctx)
+		})
+		if cached.err == nil {
+			return cached.value, nil
+		}
+
+		dataset.mu.Lock()
+		if dataset.cache[key] == cached {
+			delete(dataset.cache, key)
+		}
+		dataset.mu.Unlock()
+
+		// The computation may have been cancelled by another request, in which case try again
+		if ctx.Err() != nil || !(errors.Is(cached.err, context.Canceled) || errors.Is(cached.err, context.DeadlineExceeded)) {
+			return nil, cached.err
+		}
+	}
+}
+
+// CisCount returns the total number of cis entries in the dataset
+func (dataset *dataset) CisCount(ctx context.Context) (uint64, error) {
+	count, err := dataset.cached(ctx, "cisCount", func(ctx context.Context) (interface{}, error) {
+		return pairs.CisCount(ctx, dataset.file)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return count.(uint64), nil
+}
+
+// datasetRegistry holds the loaded datasets in the order they were supplied. The first dataset is the
+// default, used when a request doesn't specify one.
+type datasetRegistry struct {
+	mu       sync.RWMutex
+	order    []string
+	datasets map[string]*dataset
+}
+
+var datasets = &datasetRegistry{datasets: make(map[string]*dataset)}
+
+// parseDatasetArgument splits a -d argument of the form name=path/to/data.gz. When no name is given, the
+// name is the filename without its directory and extensions.
+func parseDatasetArgument(argument string) (name string, filename string) {
+	if index := strings.Index(argument, "="); index > 0 && !strings.ContainsAny(argument[:index], `/\`) {
+		return argument[:index], argument[index+1:]
+	}
+
+	name = filepath.Base(argument)
+	if index := strings.Index(name, "."); index > 0 {
+		name = name[:index]
+	}
+
+	return name, argument
+}
+
+// Add registers the file under the name
+func (registry *datasetRegistry) Add(name string, filename string, file pairs.File) error {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	if _, exists := registry.datasets[name]; exists {
+		return fmt.Errorf("Dataset name %s is used more than once, name each dataset with -d name=path", name)
+	}
+
+	registry.datasets[name] = &dataset{Name: name, Filename: filename, Genome: file.Genome(), file: file}
+	registry.order = append(registry.order, name)
+
+	return nil
+}
+
+// BalanceWeights returns the ICE weights of the dataset at the resolution, which are cached next to the data
+func (dataset *dataset) BalanceWeights(ctx context.Context, resolution uint64, perChromosome bool) (*pairs.BalanceWeights, error) {
+	key := pairs.BalanceFilename(dataset.Filename, resolution, perChromosome)
+	weights, err := dataset.cached(ctx, key, func(ctx context.Context) (interface{}, error) {
+		options := pairs.DefaultBalanceOptions
+		options.PerChromosome = perChromosome
+
+		return pairs.LoadBalanceWeights(ctx, dataset.file, dataset.Filename, resolution, options)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return weights.(*pairs.BalanceWeights), nil
+}
+
+// Expected returns the expected contacts as a function of distance for the chromosome at the resolution
+func (dataset *dataset) Expected(ctx context.Context, chrom string, resolution uint64) (*pairs.Expected, error) {
+	key := fmt.Sprintf("expected:%s:%d", chrom, resolution)
+	expected, err := dataset.cached(ctx, key, func(ctx context.Context) (interface{}, error) {
+		return pairs.ComputeExpected(ctx, dataset.file, chrom, resolution)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return expected.(*pairs.Expected), nil
+}
+
+// Lookup returns the dataset with the name, or the default dataset when the name is empty
+func (registry *datasetRegistry) Lookup(name string) (*dataset, error) {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+
+	if name == "" {
+		if len(registry.order) == 0 {
+			return nil, errors.New("No datasets loaded")
+		}
+		name = registry.order[0]
+	}
+
+	dataset, ok := registry.datasets[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown dataset %s", name)
+	}
+
+	return dataset, nil
+}
+
+// List returns the datasets in the order they were added
+func (registry *datasetRegistry) List() []*dataset {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+
+	list := make([]*dataset, len(registry.order))
+	for index, name := range registry.order {
+		list[index] = registry.datasets[name]
+	}
+
+	return list
+}
+
+// Close closes all of the datasets
+func (registry *datasetRegistry) Close() {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	for _, dataset := range registry.datasets {
+		dataset.file.Close()
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/imbbLab/v3c-viz/pairs"
+)
+
+func TestParseDatasetArgument(t *testing.T) {
+	tests := []struct {
+		argument string
+		name     string
+		filename string
+	}{
+		{"data.pairs.gz", "data", "data.pairs.gz"},
+		{"path/to/data.pairs.gz", "data", "path/to/data.pairs.gz"},
+		{"sample=path/to/data.pairs.gz", "sample", "path/to/data.pairs.gz"},
+		{"sample=data.hic", "sample", "data.hic"},
+		{"path/a=b/data.pairs", "data", "path/a=b/data.pairs"},
+		{`sample=C:\data\data.pairs`, "sample", `C:\data\data.pairs`},
+		{"=data.pairs", "=data", "=data.pairs"},
+		{".pairs", ".pairs", ".pairs"},
+	}
+
+	for _, test := range tests {
+		name, filename := parseDatasetArgument(test.argument)
+		if name != test.name || filename != test.filename {
+			t.Errorf("%s: expected %s and %s, got %s and %s", test.argument, test.name, test.filename, name, filename)
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	registry := &datasetRegistry{datasets: make(map[string]*dataset)}
+
+	if _, err := registry.Lookup(""); err == nil {
+		t.Errorf("Expected error looking up the default dataset of an empty registry")
+	}
+
+	for _, name := range []string{"first", "second"} {
+		pairsFile, err := pairs.ParsePlain(strings.NewReader("## pairs format v1.0\n#genome_assembly: " + name + "\n#chromsize: chr1 1000\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := registry.Add(name, name+".pairs", pairsFile); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer registry.Close()
+
+	if err := registry.Add("first", "other.pairs", nil); err == nil {
+		t.Errorf("Expected error adding a dataset with the same name")
+	}
+
+	tests := []struct {
+		name     string
+		expected string
+		found    bool
+	}{
+		{"", "first", true},
+		{"first", "first", true},
+		{"second", "second", true},
+		{"third", "", false},
+		{"First", "", false},
+	}
+
+	for _, test := range tests {
+		dataset, err := registry.Lookup(test.name)
+		if (err == nil) != test.found {
+			t.Errorf("Dataset %q: expected found to be %v, got %v", test.name, test.found, err)
+			continue
+		}
+		if test.found && (dataset.Name != test.expected || dataset.Genome != test.expected || dataset.file == nil) {
+			t.Errorf("Dataset %q: expected %s, got %+v", test.name, test.expected, dataset)
+		}
+	}
+}
+
+func TestCached(t *testing.T) {
+	dataset := &dataset{}
+
+	var calls int32
+	var wait sync.WaitGroup
+	for index := 0; index < 10; index++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+
+			value, err := dataset.cached(context.Background(), "key", func(ctx context.Context) (interface{}, error) {
+				atomic.AddInt32(&calls, 1)
+				time.Sleep(10 * time.Millisecond)
+				return 1, nil
+			})
+			if err != nil || value.(int) != 1 {
+				t.Errorf("Expected 1, got %v (%v)", value, err)
+			}
+		}()
+	}
+	wait.Wait()
+
+	if calls != 1 {
+		t.Errorf("Expected the value to be computed once, computed %d times", calls)
+	}
+
+	// Errors aren't cached
+	failure := errors.New("failed")
+	if _, err := dataset.cached(context.Background(), "failing", func(ctx context.Context) (interface{}, error) { return nil, failure }); err != failure {
+		t.Errorf("Expected %v, got %v", failure, err)
+	}
+	value, err := dataset.cached(context.Background(), "failing", func(ctx context.Context) (interface{}, error) { return 2, nil })
+	if err != nil || value.(int) != 2 {
+		t.Errorf("Expected the failed value to be computed again, got %v (%v)", value, err)
+	}
+}
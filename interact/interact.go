@@ -5,7 +5,9 @@ import (
 	"encoding/csv"
 	"fmt"
 	"io"
+	"log"
 	"os"
+	"sort"
 	"strconv"
 )
 
@@ -43,7 +45,7 @@ func Parse(filename string) (*InteractFile, error) {
 		return nil, nil
 	}
 
-	fmt.Println("Loading interact file: " + filename)
+	log.Println("Loading interact file: " + filename)
 
 	iFile, err := os.Open(filename)
 	if err != nil {
@@ -126,7 +128,72 @@ func Parse(filename string) (*InteractFile, error) {
 		interactionCount++
 	}
 
-	fmt.Printf("Loaded %d interactions.\n", interactionCount)
+	log.Printf("Loaded %d interactions.\n", interactionCount)
 
 	return &interactFile, nil
 }
+
+// New returns an empty InteractFile
+func New() *InteractFile {
+	return &InteractFile{Interactions: make(map[string][]Interaction)}
+}
+
+// Add adds the interaction to the list of its chromosome pair
+func (interactFile *InteractFile) Add(interaction Interaction) {
+	chromPairName := interaction.ChromPairName()
+	interactFile.Interactions[chromPairName] = append(interactFile.Interactions[chromPairName], interaction)
+}
+
+// sortedInteractions returns all interactions, ordered by chromosome pair and then by position
+func (interactFile *InteractFile) sortedInteractions() []Interaction {
+	var interactions []Interaction
+	for _, chromPairInteractions := range interactFile.Interactions {
+		interactions = append(interactions, chromPairInteractions...)
+	}
+
+	sort.SliceStable(interactions, func(i, j int) bool {
+		if interactions[i].SourceChrom != interactions[j].SourceChrom {
+			return interactions[i].SourceChrom < interactions[j].SourceChrom
+		}
+		if interactions[i].TargetChrom != interactions[j].TargetChrom {
+			return interactions[i].TargetChrom < interactions[j].TargetChrom
+		}
+		if interactions[i].SourceStart != interactions[j].SourceStart {
+			return interactions[i].SourceStart < interactions[j].SourceStart
+		}
+		return interactions[i].TargetStart < interactions[j].TargetStart
+	})
+
+	return interactions
+}
+
+// Write writes the interactions in interact format, preceded by a header line so that it can be read by Parse
+func (interactFile *InteractFile) Write(writer io.Writer) error {
+	bufWriter := bufio.NewWriter(writer)
+
+	fmt.Fprintln(bufWriter, "#chrom\tchromStart\tchromEnd\tname\tscore\tvalue\texp\tcolor\tsourceChrom\tsourceStart\tsourceEnd\tsourceName\tsourceStrand\ttargetChrom\ttargetStart\ttargetEnd\ttargetName\ttargetStrand")
+	for _, interaction := range interactFile.sortedInteractions() {
+		fmt.Fprintf(bufWriter, "%s\t%d\t%d\t%s\t%d\t%g\t%s\t%s\t%s\t%d\t%d\t%s\t%s\t%s\t%d\t%d\t%s\t%s\n",
+			interaction.Chrom, interaction.ChromStart, interaction.ChromEnd, interaction.Name, interaction.Score,
+			interaction.Value, interaction.Exp, interaction.Colour,
+			interaction.SourceChrom, interaction.SourceStart, interaction.SourceEnd, interaction.SourceName, interaction.SourceStrand,
+			interaction.TargetChrom, interaction.TargetStart, interaction.TargetEnd, interaction.TargetName, interaction.TargetStrand)
+	}
+
+	return bufWriter.Flush()
+}
+
+// WriteBEDPE writes the interactions as BEDPE (chrom1, start1, end1, chrom2, start2, end2, name, score, strand1,
+// strand2)
+func (interactFile *InteractFile) WriteBEDPE(writer io.Writer) error {
+	bufWriter := bufio.NewWriter(writer)
+
+	for _, interaction := range interactFile.sortedInteractions() {
+		fmt.Fprintf(bufWriter, "%s\t%d\t%d\t%s\t%d\t%d\t%s\t%d\t%s\t%s\n",
+			interaction.SourceChrom, interaction.SourceStart, interaction.SourceEnd,
+			interaction.TargetChrom, interaction.TargetStart, interaction.TargetEnd,
+			interaction.Name, interaction.Score, interaction.SourceStrand, interaction.TargetStrand)
+	}
+
+	return bufWriter.Flush()
+}
@@ -0,0 +1,156 @@
+package pairs
+
+import (
+	"context"
+	"errors"
+	"math"
+)
+
+// APAOptions control the sub-matrices stacked by aggregate peak analysis
+type APAOptions struct {
+	Resolution uint64
+	// Number of bins either side of the centre of each sub-matrix
+	Flank int
+	// Width (in bins) of the lower-left corner the centre is compared to
+	CornerWidth int
+	// Range of distances between the ends of intrachromosomal interactions that are included (0 for no maximum)
+	MinDistance uint64
+	MaxDistance uint64
+	// Balance the counts with the weights, when not nil
+	Weights *BalanceWeights
+}
+
+// DefaultAPAOptions are the options commonly used at a resolution of 10 kb
+var DefaultAPAOptions = APAOptions{Resolution: 10000, Flank: 10, CornerWidth: 6, MinDistance: 300000}
+
+// APA is the mean of the sub-matrices centred on each interaction. The X axis of the matrix is the source end of
+// the interactions and the Y axis the target end.
+type APA struct {
+	Matrix FloatImage
+	// Number of interactions included, and skipped (too close to the diagonal or to the end of the chromosome)
+	Interactions int
+	Skipped      int
+	// Ratio of the centre to the mean of the lower-left corner (closest to the diagonal)
+	P2LL float64
+	// Number of standard deviations of the lower-left corner that the centre is above its mean
+	ZScoreLL float64
+}
+
+// AggregatePeakAnalysis stacks the sub-matrices centred on the ends of each interaction, given as the positions of
+// entries. Intrachromosomal interactions are oriented so that the source is upstream of the target.
+func AggregatePeakAnalysis(ctx context.Context, pairsFile File, interactions []Entry, options APAOptions) (*APA, error) {
+	if options.Resolution == 0 {
+		return nil, errors.New("Resolution must be greater than 0")
+	}
+	if options.Flank < 0 || options.CornerWidth <= 0 || options.CornerWidth > options.Flank {
+		return nil, errors.New("Corner width must be between 1 and the flank")
+	}
+
+	resolution := options.Resolution
+	size := 2*options.Flank + 1
+	flank := uint64(options.Flank) * resolution
+
+	sums := make([]float64, size*size)
+	counts := make([]int, size*size)
+	apa := &APA{}
+
+	chromsizes := pairsFile.Chromsizes()
+	for _, interaction := range interactions {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		source, target := interaction.SourcePosition, interaction.TargetPosition
+		if interaction.SourceChrom == interaction.TargetChrom {
+			if source > target {
+				source, target = target, source
+			}
+
+			if target-source < options.MinDistance || (options.MaxDistance > 0 && target-source > options.MaxDistance) {
+				apa.Skipped++
+				continue
+			}
+		}
+
+		// The sub-matrix must fit within both chromosomes
+		sourceStart, targetStart := (source/resolution)*resolution, (target/resolution)*resolution
+		if sourceStart < flank || targetStart < flank ||
+			sourceStart+flank+resolution > chromsizes[interaction.SourceChrom].Length ||
+			targetStart+flank+resolution > chromsizes[interaction.TargetChrom].Length {
+			apa.Skipped++
+			continue
+		}
+
+		viewQuery := Query{SourceChrom: interaction.SourceChrom, SourceStart: sourceStart - flank, SourceEnd: sourceStart + flank + resolution,
+			TargetChrom: interaction.TargetChrom, TargetStart: targetStart - flank, TargetEnd: targetStart + flank + resolution}
+
+		// Intrachromosomal entries are stored in the upper triangle, so the query needs to cover the full area
+		query := viewQuery
+		if query.SourceChrom == query.TargetChrom {
+			query.SourceStart, query.TargetStart = min(query.SourceStart, query.TargetStart), max(query.SourceStart, query.TargetStart)
+			query.SourceEnd, query.TargetEnd = min(query.SourceEnd, query.TargetEnd), max(query.SourceEnd, query.TargetEnd)
+		}
+
+		var image FloatImage
+		if options.Weights != nil {
+			var err error
+			image, err = BalancedImage(ctx, pairsFile, options.Weights, query, viewQuery, resolution, resolution)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			countImage, err := pairsFile.ImageContext(ctx, query, viewQuery, resolution, resolution)
+			if err != nil {
+				return nil, err
+			}
+
+			image = FloatImage{Width: countImage.Width, Height: countImage.Height, Data: make([]float32, len(countImage.Data))}
+			for index, count := range countImage.Data {
+				image.Data[index] = float32(count)
+			}
+		}
+
+		if int(image.Width) != size || int(image.Height) != size {
+			return nil, errors.New("Unexpected size of sub-matrix")
+		}
+
+		for index, value := range image.Data {
+			if !math.IsNaN(float64(value)) {
+				sums[index] += float64(value)
+				counts[index]++
+			}
+		}
+		apa.Interactions++
+	}
+
+	apa.Matrix = FloatImage{Width: uint32(size), Height: uint32(size), Data: make([]float32, size*size)}
+	for index := range sums {
+		if counts[index] > 0 {
+			apa.Matrix.Data[index] = float32(sums[index] / float64(counts[index]))
+		}
+	}
+
+	// The lower-left corner has the sources furthest downstream and the targets furthest upstream
+	var corner []float64
+	for y := 0; y < options.CornerWidth; y++ {
+		for x := size - options.CornerWidth; x < size; x++ {
+			corner = append(corner, float64(apa.Matrix.Data[y*size+x]))
+		}
+	}
+
+	var mean, sumSquares float64
+	for _, value := range corner {
+		mean += value
+	}
+	mean /= float64(len(corner))
+	for _, value := range corner {
+		sumSquares += (value - mean) * (value - mean)
+	}
+	standardDeviation := math.Sqrt(sumSquares / float64(len(corner)))
+
+	centre := float64(apa.Matrix.Data[options.Flank*size+options.Flank])
+	apa.P2LL = centre / mean
+	apa.ZScoreLL = (centre - mean) / standardDeviation
+
+	return apa, nil
+}
@@ -0,0 +1,67 @@
+package pairs
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestAPA(t *testing.T) {
+	const resolution = 10000
+	entries := generateDecayingEntries(100000, 1)
+	random := rand.New(rand.NewSource(2))
+
+	// Enriched pixels at each interaction, the last of which is too close to the diagonal and the end
+	interactions := []Entry{{SourceChrom: "chr1", SourcePosition: 400000, TargetChrom: "chr1", TargetPosition: 800000},
+		{SourceChrom: "chr1", SourcePosition: 1500005, TargetChrom: "chr1", TargetPosition: 1000005},
+		{SourceChrom: "chr1", SourcePosition: 1950000, TargetChrom: "chr1", TargetPosition: 1990000}}
+	for _, interaction := range interactions {
+		for count := 0; count < 50; count++ {
+			position1 := interaction.SourcePosition/resolution*resolution + uint64(random.Int63n(resolution))
+			position2 := interaction.TargetPosition/resolution*resolution + uint64(random.Int63n(resolution))
+			entries = append(entries, &Entry{SourceChrom: "chr1", SourcePosition: min(position1, position2), TargetChrom: "chr1", TargetPosition: max(position1, position2)})
+		}
+	}
+
+	var plain bytes.Buffer
+	writeEntries(&plain, entries)
+	pairsFile, err := ParsePlain(&plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	options := APAOptions{Resolution: resolution, Flank: 5, CornerWidth: 3, MinDistance: 100000}
+	apa, err := AggregatePeakAnalysis(context.Background(), pairsFile, interactions, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if apa.Interactions != 2 || apa.Skipped != 1 {
+		t.Errorf("Expected 2 interactions and 1 skipped, got %d and %d", apa.Interactions, apa.Skipped)
+	}
+
+	// Sum each sub-matrix directly, with the sources (upstream ends) along X
+	size := 2*options.Flank + 1
+	expected := make([]float64, size*size)
+	for _, interaction := range interactions[:2] {
+		source, target := min(interaction.SourcePosition, interaction.TargetPosition)/resolution, max(interaction.SourcePosition, interaction.TargetPosition)/resolution
+		for _, entry := range entries {
+			x := int(entry.SourcePosition/resolution) - int(source) + options.Flank
+			y := int(entry.TargetPosition/resolution) - int(target) + options.Flank
+			if x >= 0 && x < size && y >= 0 && y < size {
+				expected[y*size+x] += 0.5
+			}
+		}
+	}
+	for index, value := range apa.Matrix.Data {
+		if math.Abs(float64(value)-expected[index]) > 1e-4 {
+			t.Errorf("Pixel %d: expected %f, got %f", index, expected[index], value)
+		}
+	}
+
+	if apa.P2LL < 2 || apa.ZScoreLL < 2 {
+		t.Errorf("Expected enrichment at the centre, got P2LL %f and Z-score %f", apa.P2LL, apa.ZScoreLL)
+	}
+}
@@ -0,0 +1,391 @@
+package pairs
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BalanceOptions control the iterative correction of BalanceWeights
+type BalanceOptions struct {
+	// Balance each chromosome separately using only cis contacts, rather than the whole genome
+	PerChromosome bool
+	// Number of diagonals ignored, as contacts close to the diagonal are dominated by distance rather than bias
+	IgnoreDiagonals uint64
+	// Bins with fewer non-zero pixels or fewer contacts than these are masked
+	MinNonZero int
+	MinCount   uint64
+	// Iteration stops when the variance of the marginals is below the tolerance
+	Tolerance     float64
+	MaxIterations int
+}
+
+// DefaultBalanceOptions are the options commonly used for ICE balancing
+var DefaultBalanceOptions = BalanceOptions{IgnoreDiagonals: 2, MinNonZero: 10, Tolerance: 1e-5, MaxIterations: 200}
+
+// The balancing weights and expected contacts are computed from every entry, so don't apply to filtered images
+var errFilteredNormalisation = errors.New("Normalised images can't be filtered, as the balancing weights and expected contacts include every entry")
+
+// BalanceWeights are the ICE (iterative correction) weights of each bin of each chromosome. Multiplying the count
+// of a pixel by the weights of both of its bins gives the balanced value. Masked bins have a weight of NaN.
+type BalanceWeights struct {
+	Resolution    uint64
+	PerChromosome bool
+	Weights       map[string][]float64
+}
+
+// checkResolution returns an error when the weights are for a different resolution. Missing (nil) weights match
+// any resolution.
+func (weights *BalanceWeights) checkResolution(resolution uint64) error {
+	if weights != nil && weights.Resolution != resolution {
+		return fmt.Errorf("Balancing weights are at %d bp, not %d bp", weights.Resolution, resolution)
+	}
+
+	return nil
+}
+
+// Weight returns the weight of the bin containing the position, or NaN if the bin is masked or unknown
+func (weights *BalanceWeights) Weight(chrom string, position uint64) float64 {
+	chromWeights := weights.Weights[chrom]
+	bin := position / weights.Resolution
+	if bin >= uint64(len(chromWeights)) {
+		return math.NaN()
+	}
+
+	return chromWeights[bin]
+}
+
+// BalanceFilename returns the name of the file the weights of the data file are cached in
+func BalanceFilename(filename string, resolution uint64, perChromosome bool) string {
+	if perChromosome {
+		return fmt.Sprintf("%s.%d.cis.weights", filename, resolution)
+	}
+
+	return fmt.Sprintf("%s.%d.weights", filename, resolution)
+}
+
+// LoadBalanceWeights reads the weights cached next to the data file, or computes them and writes them to the cache.
+// Cached weights older than the data file are computed again.
+func LoadBalanceWeights(ctx context.Context, pairsFile File, filename string, resolution uint64, options BalanceOptions) (*BalanceWeights, error) {
+	weightsFilename := BalanceFilename(filename, resolution, options.PerChromosome)
+
+	weightsInfo, err := os.Stat(weightsFilename)
+	if err == nil {
+		dataInfo, err := os.Stat(filename)
+		if err == nil && !weightsInfo.ModTime().Before(dataInfo.ModTime()) {
+			weights, err := ReadBalanceWeights(weightsFilename)
+			if err == nil {
+				return weights, nil
+			}
+
+			log.Println(err)
+		}
+	}
+
+	weights, err := ComputeBalanceWeights(ctx, pairsFile, resolution, options)
+	if err != nil {
+		return nil, err
+	}
+
+	// Failing to cache the weights only means they are computed again next time
+	if err := weights.Write(weightsFilename, pairsFile.Chromosomes()); err != nil {
+		log.Printf("Unable to cache balancing weights: %s\n", err)
+	}
+
+	return weights, nil
+}
+
+// ComputeBalanceWeights bins the entries of the file at the resolution and iteratively corrects the matrix, so
+// that every bin that isn't masked has the same total number of (balanced) contacts
+func ComputeBalanceWeights(ctx context.Context, pairsFile File, resolution uint64, options BalanceOptions) (*BalanceWeights, error) {
+	if resolution == 0 {
+		return nil, errors.New("Resolution must be greater than 0")
+	}
+
+	chromsizes := pairsFile.Chromsizes()
+	chromosomes := pairsFile.Chromosomes()
+	if len(chromsizes) == 0 {
+		return nil, errors.New("Chromosome sizes are required to balance the matrix")
+	}
+
+	start := time.Now()
+	weights := &BalanceWeights{Resolution: resolution, PerChromosome: options.PerChromosome, Weights: make(map[string][]float64)}
+
+	// For genome-wide balancing, the bins of each chromosome follow on from the bins of the previous chromosome
+	offsets := make([]uint32, len(chromosomes)+1)
+	for index, chrom := range chromosomes {
+		numBins := uint32(chromsizes[chrom].Length/resolution + 1)
+
+		offsets[index+1] = offsets[index] + numBins
+		if options.PerChromosome {
+			offsets[index+1] = numBins
+		}
+	}
+
+	var pixels []matrixPixel
+	for index1, chrom1 := range chromosomes {
+		for index2 := index1; index2 < len(chromosomes); index2++ {
+			if options.PerChromosome && index2 != index1 {
+				break
+			}
+
+			chromPixels, err := chromPairPixels(ctx, pairsFile, chromsizes[chrom1], chromsizes[chromosomes[index2]], resolution)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, pixel := range chromPixels {
+				if index1 == index2 && uint64(pixel.bin2-pixel.bin1) < options.IgnoreDiagonals {
+					continue
+				}
+
+				if !options.PerChromosome {
+					pixel.bin1 += offsets[index1]
+					pixel.bin2 += offsets[index2]
+				}
+				pixels = append(pixels, pixel)
+			}
+		}
+
+		if options.PerChromosome {
+			bias, err := balancePixels(ctx, pixels, int(offsets[index1+1]), options)
+			if err != nil {
+				return nil, err
+			}
+
+			weights.Weights[chrom1] = bias
+			pixels = pixels[:0]
+		}
+	}
+
+	if !options.PerChromosome {
+		bias, err := balancePixels(ctx, pixels, int(offsets[len(chromosomes)]), options)
+		if err != nil {
+			return nil, err
+		}
+
+		for index, chrom := range chromosomes {
+			weights.Weights[chrom] = bias[offsets[index]:offsets[index+1]]
+		}
+	}
+
+	log.Printf("Balancing at %d bp took %s\n", resolution, time.Since(start))
+
+	return weights, nil
+}
+
+// balancePixels iteratively corrects the pixels of a symmetric matrix stored as the upper triangle, returning the
+// weight of each bin (NaN for masked bins)
+func balancePixels(ctx context.Context, pixels []matrixPixel, numBins int, options BalanceOptions) ([]float64, error) {
+	bias := make([]float64, numBins)
+	marginals := make([]float64, numBins)
+
+	// Mask bins with too few contacts
+	nonZero := make([]int, numBins)
+	for _, pixel := range pixels {
+		marginals[pixel.bin1] += float64(pixel.count)
+		marginals[pixel.bin2] += float64(pixel.count)
+		nonZero[pixel.bin1]++
+		nonZero[pixel.bin2]++
+	}
+	for bin := range bias {
+		if nonZero[bin] >= options.MinNonZero && nonZero[bin] > 0 && marginals[bin] >= float64(options.MinCount) {
+			bias[bin] = 1
+		}
+	}
+
+	variance := math.Inf(1)
+	for iteration := 0; iteration < options.MaxIterations && variance >= options.Tolerance; iteration++ {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		// Nothing to balance when all bins are masked
+		mean := balancedMarginals(pixels, bias, marginals)
+		if mean == 0 {
+			variance = 0
+			break
+		}
+
+		var sumSquares float64
+		var count int
+		for bin, marginal := range marginals {
+			if marginal == 0 {
+				continue
+			}
+
+			marginal /= mean
+			bias[bin] /= marginal
+			sumSquares += (marginal - 1) * (marginal - 1)
+			count++
+		}
+		variance = sumSquares / float64(count)
+	}
+
+	if variance >= options.Tolerance {
+		log.Printf("Balancing did not converge after %d iterations (variance %g)\n", options.MaxIterations, variance)
+	}
+
+	// Scale the weights so that the balanced marginals are 1, masking bins that only have contacts with masked bins
+	mean := balancedMarginals(pixels, bias, marginals)
+	for bin := range bias {
+		if bias[bin] == 0 || marginals[bin] == 0 {
+			bias[bin] = math.NaN()
+		} else if mean > 0 {
+			bias[bin] /= math.Sqrt(mean)
+		}
+	}
+
+	return bias, nil
+}
+
+// balancedMarginals fills marginals with the total balanced contacts of each bin, returning the mean of the
+// non-zero marginals
+func balancedMarginals(pixels []matrixPixel, bias []float64, marginals []float64) float64 {
+	for bin := range marginals {
+		marginals[bin] = 0
+	}
+
+	for _, pixel := range pixels {
+		value := float64(pixel.count) * bias[pixel.bin1] * bias[pixel.bin2]
+		marginals[pixel.bin1] += value
+		marginals[pixel.bin2] += value
+	}
+
+	var sum float64
+	var count int
+	for _, marginal := range marginals {
+		if marginal > 0 {
+			sum += marginal
+			count++
+		}
+	}
+	if count == 0 {
+		return 0
+	}
+
+	return sum / float64(count)
+}
+
+// Write saves the weights as a tab separated file of chrom, start, end and weight, preceded by the resolution
+// and type of balancing
+func (weights *BalanceWeights) Write(filename string, chromosomes []string) error {
+	file, err := os.Create(filename + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(filename + ".tmp")
+
+	writer := bufio.NewWriter(file)
+	fmt.Fprintf(writer, "#resolution: %d\n", weights.Resolution)
+	fmt.Fprintf(writer, "#perChromosome: %t\n", weights.PerChromosome)
+
+	for _, chrom := range chromosomes {
+		for bin, weight := range weights.Weights[chrom] {
+			fmt.Fprintf(writer, "%s\t%d\t%d\t%s\n", chrom, uint64(bin)*weights.Resolution, uint64(bin+1)*weights.Resolution,
+				strconv.FormatFloat(weight, 'g', -1, 64))
+		}
+	}
+
+	err = writer.Flush()
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(filename+".tmp", filename)
+}
+
+// ReadBalanceWeights reads weights saved by Write
+func ReadBalanceWeights(filename string) (*BalanceWeights, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	weights := &BalanceWeights{Weights: make(map[string][]float64)}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if strings.HasPrefix(line, "#") {
+			splitLine := strings.SplitN(line[1:], ": ", 2)
+			if len(splitLine) != 2 {
+				continue
+			}
+
+			switch splitLine[0] {
+			case "resolution":
+				weights.Resolution, err = strconv.ParseUint(splitLine[1], 10, 64)
+			case "perChromosome":
+				weights.PerChromosome, err = strconv.ParseBool(splitLine[1])
+			}
+			if err != nil {
+				return nil, fmt.Errorf("Invalid header in %s: %s", filename, line)
+			}
+			continue
+		}
+
+		fields := strings.Split(line, "\t")
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("Invalid line in %s: %s", filename, line)
+		}
+
+		weight, err := strconv.ParseFloat(fields[3], 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid weight in %s: %s", filename, line)
+		}
+		weights.Weights[fields[0]] = append(weights.Weights[fields[0]], weight)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if weights.Resolution == 0 {
+		return nil, fmt.Errorf("No resolution in %s", filename)
+	}
+
+	return weights, nil
+}
+
+// BalancedImage creates the image of the query and balances each bin with the weights of the bins at its centre.
+// The bin sizes should match the resolution of the weights. Bins involving masked bins are NaN. The query can't
+// be filtered.
+func BalancedImage(ctx context.Context, pairsFile File, weights *BalanceWeights, query Query, viewQuery Query, binSizeX uint64, binSizeY uint64) (FloatImage, error) {
+	if query.Filter != nil || query.FilterDistance > 0 {
+		return FloatImage{}, errFilteredNormalisation
+	}
+
+	image, err := pairsFile.ImageContext(ctx, query, viewQuery, binSizeX, binSizeY)
+	if err != nil {
+		return FloatImage{}, err
+	}
+
+	weightsX := make([]float64, image.Width)
+	for x := range weightsX {
+		weightsX[x] = weights.Weight(viewQuery.SourceChrom, viewQuery.SourceStart+uint64(x)*binSizeX+binSizeX/2)
+	}
+
+	balanced := FloatImage{Width: image.Width, Height: image.Height, Data: make([]float32, len(image.Data))}
+	for y := 0; y < int(image.Height); y++ {
+		weightY := weights.Weight(viewQuery.TargetChrom, viewQuery.TargetStart+uint64(y)*binSizeY+binSizeY/2)
+
+		for x := 0; x < int(image.Width); x++ {
+			index := y*int(image.Width) + x
+			balanced.Data[index] = float32(float64(image.Data[index]) * weightsX[x] * weightY)
+		}
+	}
+
+	return balanced, nil
+}
@@ -0,0 +1,117 @@
+package pairs
+
+import (
+	"context"
+	"math"
+	"path/filepath"
+	"testing"
+)
+
+func TestBalance(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "test.pairs")
+	writePairs(t, filename, generateEntries(50000))
+
+	pairsFile, err := Parse(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pairsFile.Close()
+
+	const resolution = 100000
+	options := DefaultBalanceOptions
+	options.MinNonZero = 1
+
+	for _, perChromosome := range []bool{false, true} {
+		options.PerChromosome = perChromosome
+
+		weights, err := LoadBalanceWeights(context.Background(), pairsFile, filename, resolution, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The balanced marginals (excluding the ignored diagonals) of all bins should be 1
+		marginals := make(map[string][]float64)
+		for _, chrom := range testChromsizes {
+			marginals[chrom.Name] = make([]float64, len(weights.Weights[chrom.Name]))
+		}
+		for index1, chrom1 := range testChromsizes {
+			for index2 := index1; index2 < len(testChromsizes); index2++ {
+				chrom2 := testChromsizes[index2]
+				if perChromosome && index1 != index2 {
+					continue
+				}
+
+				pixels, err := chromPairPixels(context.Background(), pairsFile, chrom1, chrom2, resolution)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				for _, pixel := range pixels {
+					if index1 == index2 && pixel.bin2-pixel.bin1 < 2 {
+						continue
+					}
+
+					value := float64(pixel.count) * weights.Weights[chrom1.Name][pixel.bin1] * weights.Weights[chrom2.Name][pixel.bin2]
+					marginals[chrom1.Name][pixel.bin1] += value
+					marginals[chrom2.Name][pixel.bin2] += value
+				}
+			}
+		}
+		for chrom, chromMarginals := range marginals {
+			for bin, marginal := range chromMarginals {
+				if math.IsNaN(weights.Weights[chrom][bin]) {
+					continue
+				}
+				if math.Abs(marginal-1) > 0.01 {
+					t.Errorf("Per chromosome %t: balanced marginal of %s bin %d is %f", perChromosome, chrom, bin, marginal)
+				}
+			}
+		}
+
+		// The weights should be read back from the cache
+		cached, err := ReadBalanceWeights(BalanceFilename(filename, resolution, perChromosome))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cached.Resolution != resolution || cached.PerChromosome != perChromosome {
+			t.Errorf("Cached weights have resolution %d and per chromosome %t", cached.Resolution, cached.PerChromosome)
+		}
+		for chrom, chromWeights := range weights.Weights {
+			for bin, weight := range chromWeights {
+				if cached.Weights[chrom][bin] != weight && !(math.IsNaN(weight) && math.IsNaN(cached.Weights[chrom][bin])) {
+					t.Fatalf("Cached weight of %s bin %d is %f, expected %f", chrom, bin, cached.Weights[chrom][bin], weight)
+				}
+			}
+		}
+
+		query := Query{SourceChrom: "chr1", SourceStart: 0, SourceEnd: 2000000, TargetChrom: "chr2", TargetStart: 0, TargetEnd: 1500000}
+		image, _ := pairsFile.Image(query, query, resolution, resolution)
+		balanced, err := BalancedImage(context.Background(), pairsFile, weights, query, query, resolution, resolution)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for index := range balanced.Data {
+			x, y := index%int(image.Width), index/int(image.Width)
+			expected := float32(float64(image.Data[index]) * weights.Weights["chr1"][x] * weights.Weights["chr2"][y])
+			if balanced.Data[index] != expected && !(math.IsNaN(float64(expected)) && math.IsNaN(float64(balanced.Data[index]))) {
+				t.Fatalf("Balanced pixel %d is %f, expected %f", index, balanced.Data[index], expected)
+			}
+		}
+
+		filtered := query
+		filtered.FilterDistance = 1000
+		if _, err := BalancedImage(context.Background(), pairsFile, weights, filtered, filtered, resolution, resolution); err == nil {
+			t.Error("Expected error for filtered view")
+		}
+	}
+
+	// Bins with too few contacts are masked
+	options.MinCount = 1 << 40
+	weights, err := ComputeBalanceWeights(context.Background(), pairsFile, resolution, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if weight := weights.Weight("chr1", 500000); !math.IsNaN(weight) {
+		t.Errorf("Expected masked bin, got weight %f", weight)
+	}
+}
@@ -0,0 +1,153 @@
+package pairs
+
+import (
+	"fmt"
+)
+
+// Columns assumed when a .pairs file has no #columns: header. The first seven columns are reserved by the
+// .pairs specification, but only the first five are required, so the strands are optional.
+var defaultColumns = []string{"readID", "chrom1", "pos1", "chrom2", "pos2", "strand1", "strand2"}
+
+var defaultColumnLayout, _ = newColumnLayout(defaultColumns)
+
+// columnAliases maps the names used by different tools (e.g. chr1 in the specification, chrom1 in pairtools)
+// to a single name
+var columnAliases = map[string]string{
+	"chr1": "chrom1",
+	"chr2": "chrom2",
+}
+
+// columnLayout describes where each column is found within a line of a .pairs file. Columns which
+// are not present have an index of -1.
+type columnLayout struct {
+	names  []string
+	lookup map[string]int
+
+	readID   int
+	chrom1   int
+	pos1     int
+	chrom2   int
+	pos2     int
+	strand1  int
+	strand2  int
+	pairType int
+	mapq     int
+	mapq1    int
+	mapq2    int
+
+	// Number of columns that need to be present on each line to parse the core fields (readID, chromosomes and
+	// positions). Other columns that are missing from a line are empty.
+	required int
+}
+
+func newColumnLayout(names []string) (*columnLayout, error) {
+	layout := &columnLayout{names: names, lookup: make(map[string]int)}
+
+	for index, name := range names {
+		if alias, ok := columnAliases[name]; ok {
+			name = alias
+		}
+
+		if _, ok := layout.lookup[name]; ok {
+			return nil, fmt.Errorf("Invalid .pairs file: column %s appears more than once", name)
+		}
+		layout.lookup[name] = index
+	}
+
+	column := func(name string) int {
+		if index, ok := layout.lookup[name]; ok {
+			return index
+		}
+
+		return -1
+	}
+
+	layout.readID = column("readID")
+	layout.chrom1 = column("chrom1")
+	layout.pos1 = column("pos1")
+	layout.chrom2 = column("chrom2")
+	layout.pos2 = column("pos2")
+	for _, index := range []int{layout.readID, layout.chrom1, layout.pos1, layout.chrom2, layout.pos2} {
+		if index+1 > layout.required {
+			layout.required = index + 1
+		}
+	}
+	layout.strand1 = column("strand1")
+	layout.strand2 = column("strand2")
+	layout.pairType = column("pair_type")
+	layout.mapq = column("mapq")
+	layout.mapq1 = column("mapq1")
+	layout.mapq2 = column("mapq2")
+
+	if layout.chrom1 < 0 || layout.pos1 < 0 || layout.chrom2 < 0 || layout.pos2 < 0 {
+		return nil, fmt.Errorf("Invalid .pairs file: columns must include chrom1, pos1, chrom2 and pos2, found %v", names)
+	}
+
+	return layout, nil
+}
+
+// index returns the position of the named column, or -1 if it is not present
+func (layout *columnLayout) index(name string) int {
+	if alias, ok := columnAliases[name]; ok {
+		name = alias
+	}
+
+	if index, ok := layout.lookup[name]; ok {
+		return index
+	}
+
+	return -1
+}
+
+// validateConf checks that the columns used to create the index match those in the header
+func (layout *columnLayout) validateConf(conf indexConf) error {
+	check := func(confColumn int32, name string, index int) error {
+		if int(confColumn)-1 != index {
+			return fmt.Errorf("Index does not match .pairs file: index uses column %d for %s, but the header lists it as column %d", confColumn, name, index+1)
+		}
+
+		return nil
+	}
+
+	if err := check(conf.SeqCol, "chrom1", layout.chrom1); err != nil {
+		return err
+	}
+	if err := check(conf.SeqBeg, "pos1", layout.pos1); err != nil {
+		return err
+	}
+
+	// 1D index (only first chromosome used)
+	if conf.SeqCol2 == 0 {
+		return nil
+	}
+
+	if err := check(conf.SeqCol2, "chrom2", layout.chrom2); err != nil {
+		return err
+	}
+
+	return check(conf.BegCol2, "pos2", layout.pos2)
+}
+
+// indexConf returns the pairix column settings for the layout
+func (layout *columnLayout) indexConf() indexConf {
+	conf := pairsIndexConf
+	conf.SeqCol = int32(layout.chrom1 + 1)
+	conf.SeqBeg = int32(layout.pos1 + 1)
+	conf.EndCol = conf.SeqBeg
+	conf.SeqCol2 = int32(layout.chrom2 + 1)
+	conf.BegCol2 = int32(layout.pos2 + 1)
+	conf.EndCol2 = conf.BegCol2
+
+	return conf
+}
+
+// parseEntry parses a single line into a new entry. Use an entryParser when parsing many lines.
+func parseEntry(line string, layout *columnLayout) (*Entry, error) {
+	var entry Entry
+
+	if err := newEntryParser(layout, nil, false).parse([]byte(line), &entry); err != nil {
+		return nil, err
+	}
+
+	return &entry, nil
+}
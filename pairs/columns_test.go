@@ -0,0 +1,87 @@
+package pairs
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestColumns(t *testing.T) {
+	layout, err := newColumnLayout([]string{"readID", "chr1", "pos1", "chr2", "pos2", "strand1", "strand2", "pair_type", "mapq1", "mapq2", "walk_pair_index"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entry, err := parseEntry("read1\tchr2\t500\tchr1\t100\t+\t-\tUR\t30\t0\tR1\n", layout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(entry.ReadID) != "read1" || entry.SourceStrand != "+" || entry.TargetStrand != "-" || entry.PairType != "UR" || entry.SourceMapQ != 30 || entry.TargetMapQ != 0 {
+		t.Errorf("Columns not parsed correctly: %+v", entry)
+	}
+
+	entry.mirror()
+
+	if entry.SourceChrom != "chr1" || entry.SourcePosition != 100 || entry.SourceStrand != "-" || entry.PairType != "RU" || entry.SourceMapQ != 0 {
+		t.Errorf("Entry not mirrored correctly: %+v", entry)
+	}
+
+	for name, expected := range map[string]string{"chrom1": "chr1", "pos2": "500", "strand1": "-", "mapq2": "30", "walk_pair_index": "R1", "readID": "read1"} {
+		if value, ok := entry.Column(name); !ok || value != expected {
+			t.Errorf("Column %s: expected %s, got %s (%v)", name, expected, value, ok)
+		}
+	}
+	if _, ok := entry.Column("missing"); ok {
+		t.Errorf("Column missing should not be present")
+	}
+
+	if err := layout.validateConf(pairsIndexConf); err != nil {
+		t.Error(err)
+	}
+
+	reordered, err := newColumnLayout([]string{"chrom1", "pos1", "chrom2", "pos2", "readID"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reordered.validateConf(pairsIndexConf); err == nil {
+		t.Errorf("Expected index columns not to match header")
+	}
+	if err := reordered.validateConf(reordered.indexConf()); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := newColumnLayout([]string{"readID", "chrom1", "pos1"}); err == nil {
+		t.Errorf("Expected error when required columns are missing")
+	}
+}
+
+func TestCoreColumnsOnly(t *testing.T) {
+	// Without a #columns: header, the strands are optional and lines with only the five core columns are valid
+	plain := "## pairs format v1.0\n" +
+		"#shape: upper triangle\n" +
+		"#chromsize: chr1 2000000\n" +
+		"read1\tchr1\t100\tchr1\t200\n" +
+		"read2\tchr1\t300\tchr1\t400\t+\t-\n"
+
+	pairsFile, err := ParsePlain(strings.NewReader(plain))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := pairsFile.Search(Query{SourceChrom: "chr1", SourceStart: 0, SourceEnd: 2000000, TargetChrom: "chr1", TargetStart: 0, TargetEnd: 2000000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].SourcePosition < found[j].SourcePosition })
+
+	if len(found) != 2 {
+		t.Fatalf("Expected 2 entries, found %d", len(found))
+	}
+	if found[0].SourcePosition != 100 || found[0].TargetPosition != 200 || found[0].SourceStrand != "" || found[0].TargetStrand != "" {
+		t.Errorf("Five column entry parsed as %+v", found[0])
+	}
+	if found[1].SourceStrand != "+" || found[1].TargetStrand != "-" {
+		t.Errorf("Seven column entry parsed as %+v", found[1])
+	}
+}
@@ -0,0 +1,307 @@
+package pairs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+)
+
+// MaxCompartmentBins is the largest number of bins of a chromosome the compartment eigenvector is computed for, as
+// the correlation needs a dense matrix of the bins
+const MaxCompartmentBins = 5000
+
+// CompartmentOptions control the computation of the compartment eigenvector
+type CompartmentOptions struct {
+	// Number of diagonals ignored, as they are dominated by short range contacts
+	IgnoreDiagonals uint64
+	// Balance the counts with the weights before computing observed/expected, when not nil
+	Weights *BalanceWeights
+	// Track (such as GC content or gene density) the eigenvector is oriented to correlate positively with, when
+	// not empty
+	Orientation []TrackBin
+	// Power iteration stops when the eigenvector changes by less than the tolerance
+	Tolerance     float64
+	MaxIterations int
+}
+
+// DefaultCompartmentOptions are the options used when none are given
+var DefaultCompartmentOptions = CompartmentOptions{IgnoreDiagonals: 2, Tolerance: 1e-9, MaxIterations: 1000}
+
+// CompartmentEigenvector computes the first eigenvector of the Pearson correlation of the observed/expected
+// intrachromosomal matrix, scaled by the square root of its eigenvalue. Its sign separates the A and B
+// compartments, but is arbitrary unless an orientation track is given. Bins without contacts are NaN.
+func CompartmentEigenvector(ctx context.Context, pairsFile File, chrom string, resolution uint64, options CompartmentOptions) ([]TrackBin, error) {
+	if resolution == 0 {
+		return nil, errors.New("Resolution must be greater than 0")
+	}
+	if err := options.Weights.checkResolution(resolution); err != nil {
+		return nil, err
+	}
+
+	chromsize, ok := pairsFile.Chromsizes()[chrom]
+	if !ok {
+		return nil, fmt.Errorf("Unknown chromosome %s", chrom)
+	}
+
+	numBins := int(chromsize.Length/resolution + 1)
+	if numBins > MaxCompartmentBins {
+		return nil, fmt.Errorf("%s has %d bins at %d bp, more than the maximum of %d for compartments, use a larger resolution", chrom, numBins, resolution, MaxCompartmentBins)
+	}
+
+	pixels, err := chromPairPixels(ctx, pairsFile, chromsize, chromsize, resolution)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([]float64, numBins*numBins)
+	hasContacts := make([]bool, numBins)
+	for _, pixel := range pixels {
+		a, b := int(pixel.bin1), int(pixel.bin2)
+		if uint64(b-a) < options.IgnoreDiagonals {
+			continue
+		}
+
+		value := float64(pixel.count)
+		if options.Weights != nil {
+			value *= options.Weights.Weight(chrom, uint64(a)*resolution) * options.Weights.Weight(chrom, uint64(b)*resolution)
+			if math.IsNaN(value) {
+				continue
+			}
+		}
+
+		values[a*numBins+b] = value
+		values[b*numBins+a] = value
+		hasContacts[a] = true
+		hasContacts[b] = true
+	}
+
+	// Only bins with contacts are part of the matrix
+	var bins []int
+	for bin, ok := range hasContacts {
+		if ok {
+			bins = append(bins, bin)
+		}
+	}
+	if len(bins) < 2 {
+		return nil, fmt.Errorf("Not enough contacts on %s to compute compartments", chrom)
+	}
+
+	// The expected contacts of each diagonal are the mean over pairs of bins with contacts
+	expected := make([]float64, numBins)
+	pairCounts := make([]float64, numBins)
+	for index, a := range bins {
+		for _, b := range bins[index:] {
+			expected[b-a] += values[a*numBins+b]
+			pairCounts[b-a]++
+		}
+	}
+	for distance := range expected {
+		if pairCounts[distance] > 0 {
+			expected[distance] /= pairCounts[distance]
+		}
+	}
+
+	// Each row of observed/expected is centred and scaled to unit length, so that the dot product of two rows is
+	// their Pearson correlation. Ignored diagonals are set to the expected level.
+	size := len(bins)
+	rows := make([]float64, size*size)
+	for i, a := range bins {
+		row := rows[i*size : (i+1)*size]
+
+		var sum float64
+		for j, b := range bins {
+			distance := b - a
+			if distance < 0 {
+				distance = -distance
+			}
+
+			row[j] = 1
+			if uint64(distance) >= options.IgnoreDiagonals && expected[distance] > 0 {
+				row[j] = values[a*numBins+b] / expected[distance]
+			}
+			sum += row[j]
+		}
+
+		mean := sum / float64(size)
+		var sumSquares float64
+		for j := range row {
+			row[j] -= mean
+			sumSquares += row[j] * row[j]
+		}
+
+		// Rows without variance have no correlation with other rows
+		norm := math.Sqrt(sumSquares)
+		for j := range row {
+			if norm > 0 {
+				row[j] /= norm
+			} else {
+				row[j] = 0
+			}
+		}
+	}
+
+	vector, eigenvalue, err := correlationEigenvector(ctx, rows, size, options)
+	if err != nil {
+		return nil, err
+	}
+
+	eigenvector := make([]TrackBin, numBins)
+	for bin := range eigenvector {
+		eigenvector[bin] = TrackBin{Chrom: chrom, Start: uint64(bin) * resolution, End: min(uint64(bin+1)*resolution, chromsize.Length), Value: math.NaN()}
+	}
+	for index, bin := range bins {
+		eigenvector[bin].Value = vector[index] * math.Sqrt(math.Abs(eigenvalue))
+	}
+
+	if len(options.Orientation) > 0 {
+		orientation := binTrack(options.Orientation, chrom, resolution, numBins)
+
+		var eigenValues, trackValues []float64
+		for bin, value := range orientation {
+			if !math.IsNaN(value) && !math.IsNaN(eigenvector[bin].Value) {
+				eigenValues = append(eigenValues, eigenvector[bin].Value)
+				trackValues = append(trackValues, value)
+			}
+		}
+
+		if pearson(eigenValues, trackValues) < 0 {
+			for bin := range eigenvector {
+				eigenvector[bin].Value = -eigenvector[bin].Value
+			}
+		}
+	}
+
+	return eigenvector, nil
+}
+
+// correlationEigenvector finds the eigenvector with the largest eigenvalue of the correlation matrix of the rows,
+// after subtracting the mean correlation, by power iteration. The matrix is never formed, as multiplying by the
+// rows and then their transpose is the same as multiplying by the correlation matrix.
+//
+// Subtracting the mean can give negative eigenvalues, no smaller than -size * mean, which power iteration would
+// find if their magnitude is larger. The matrix is shifted by this bound so that all its eigenvalues are positive.
+func correlationEigenvector(ctx context.Context, rows []float64, size int, options CompartmentOptions) ([]float64, float64, error) {
+	// The mean correlation is the squared length of the sum of the rows over the number of elements
+	columnSums := make([]float64, size)
+	for i := 0; i < size; i++ {
+		for j, value := range rows[i*size : (i+1)*size] {
+			columnSums[j] += value
+		}
+	}
+	var meanCorrelation float64
+	for _, sum := range columnSums {
+		meanCorrelation += sum * sum
+	}
+	meanCorrelation /= float64(size) * float64(size)
+	shift := float64(size) * meanCorrelation
+
+	multiply := func(vector []float64, result []float64) {
+		projection := make([]float64, size)
+		var vectorSum float64
+		for i, value := range vector {
+			for j, rowValue := range rows[i*size : (i+1)*size] {
+				projection[j] += rowValue * value
+			}
+			vectorSum += value
+		}
+
+		for i := range result {
+			var dot float64
+			for j, rowValue := range rows[i*size : (i+1)*size] {
+				dot += rowValue * projection[j]
+			}
+			result[i] = dot - meanCorrelation*vectorSum + shift*vector[i]
+		}
+	}
+
+	// Start from a random vector, so that it isn't orthogonal to the eigenvector
+	random := rand.New(rand.NewSource(1))
+	vector := make([]float64, size)
+	for index := range vector {
+		vector[index] = random.Float64() - 0.5
+	}
+	normalise(vector)
+
+	next := make([]float64, size)
+	var eigenvalue float64
+	change := math.Inf(1)
+	for iteration := 0; iteration < options.MaxIterations && change >= options.Tolerance; iteration++ {
+		if ctx.Err() != nil {
+			return nil, 0, ctx.Err()
+		}
+
+		multiply(vector, next)
+
+		// The Rayleigh quotient of the unit vector
+		eigenvalue = -shift
+		for index := range vector {
+			eigenvalue += vector[index] * next[index]
+		}
+
+		if normalise(next) == 0 {
+			return nil, 0, errors.New("Correlation matrix has no eigenvector")
+		}
+
+		change = 0
+		for index := range vector {
+			difference := next[index] - vector[index]
+			change += difference * difference
+		}
+		change = math.Sqrt(change)
+
+		vector, next = next, vector
+	}
+
+	if change >= options.Tolerance {
+		log.Printf("Compartment eigenvector did not converge after %d iterations (change %g)\n", options.MaxIterations, change)
+	}
+
+	return vector, eigenvalue, nil
+}
+
+// normalise scales the vector to unit length, returning its original length
+func normalise(vector []float64) float64 {
+	var sumSquares float64
+	for _, value := range vector {
+		sumSquares += value * value
+	}
+
+	norm := math.Sqrt(sumSquares)
+	if norm > 0 {
+		for index := range vector {
+			vector[index] /= norm
+		}
+	}
+
+	return norm
+}
+
+// pearson returns the Pearson correlation of the values, or 0 when either has no variance
+func pearson(x []float64, y []float64) float64 {
+	if len(x) == 0 {
+		return 0
+	}
+
+	var meanX, meanY float64
+	for index := range x {
+		meanX += x[index]
+		meanY += y[index]
+	}
+	meanX /= float64(len(x))
+	meanY /= float64(len(y))
+
+	var covariance, varianceX, varianceY float64
+	for index := range x {
+		covariance += (x[index] - meanX) * (y[index] - meanY)
+		varianceX += (x[index] - meanX) * (x[index] - meanX)
+		varianceY += (y[index] - meanY) * (y[index] - meanY)
+	}
+	if varianceX == 0 || varianceY == 0 {
+		return 0
+	}
+
+	return covariance / math.Sqrt(varianceX*varianceY)
+}
@@ -0,0 +1,87 @@
+package pairs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestCompartments(t *testing.T) {
+	// Alternating compartments of irregular sizes (as with a regular pattern, the expected contacts at some
+	// distances would only be within or only between compartments), which contact the same compartment more often
+	const resolution = 100000
+	boundaries := []uint64{0, 300000, 500000, 1000000, 1200000, 1600000, 2000000}
+	compartment := func(position uint64) int {
+		index := sort.Search(len(boundaries), func(index int) bool { return boundaries[index] > position })
+		return (index - 1) % 2
+	}
+
+	random := rand.New(rand.NewSource(1))
+	var entries []*Entry
+	for len(entries) < 50000 {
+		position1, position2 := uint64(random.Int63n(2000000)), uint64(random.Int63n(2000000))
+		if compartment(position1) != compartment(position2) && random.Float64() > 0.3 {
+			continue
+		}
+		entries = append(entries, &Entry{SourceChrom: "chr1", SourcePosition: min(position1, position2), TargetChrom: "chr1", TargetPosition: max(position1, position2)})
+	}
+
+	var plain bytes.Buffer
+	writeEntries(&plain, entries)
+	pairsFile, err := ParsePlain(&plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Orient by a track that is high in the first compartment
+	var track bytes.Buffer
+	fmt.Fprintln(&track, "track type=bedGraph")
+	for index := 0; index+1 < len(boundaries); index++ {
+		fmt.Fprintf(&track, "chr1\t%d\t%d\t%d\n", boundaries[index], boundaries[index+1], 1-compartment(boundaries[index]))
+	}
+	orientation, err := ReadBedGraph(&track)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	options := DefaultCompartmentOptions
+	options.Orientation = orientation
+	eigenvector, err := CompartmentEigenvector(context.Background(), pairsFile, "chr1", resolution, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(eigenvector) != int(testChromsizes[0].Length/resolution+1) {
+		t.Fatalf("Expected a value for each bin, got %d", len(eigenvector))
+	}
+	for _, bin := range eigenvector {
+		if bin.Start >= 2000000 {
+			if !math.IsNaN(bin.Value) {
+				t.Errorf("Expected NaN for %d-%d without contacts, got %f", bin.Start, bin.End, bin.Value)
+			}
+			continue
+		}
+
+		if (compartment(bin.Start) == 0) != (bin.Value > 0) {
+			t.Errorf("Bin %d-%d has value %f, expected compartment %d", bin.Start, bin.End, bin.Value, compartment(bin.Start))
+		}
+	}
+
+	// Orienting by the opposite track flips the sign
+	for index := range options.Orientation {
+		options.Orientation[index].Value = 1 - options.Orientation[index].Value
+	}
+	flipped, err := CompartmentEigenvector(context.Background(), pairsFile, "chr1", resolution, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for index := range flipped {
+		if !math.IsNaN(flipped[index].Value) && math.Abs(flipped[index].Value+eigenvector[index].Value) > 1e-6 {
+			t.Errorf("Bin %d: expected %f, got %f", index, -eigenvector[index].Value, flipped[index].Value)
+		}
+	}
+}
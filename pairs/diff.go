@@ -0,0 +1,102 @@
+package pairs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// FloatImage is an Image of normalised values, such as ratios between datasets
+type FloatImage struct {
+	Width  uint32
+	Height uint32
+	Data   []float32
+}
+
+// DiffMode selects how two images are compared by DiffImage
+type DiffMode int
+
+const (
+	// Log2Ratio gives log2((B + pseudocount) / (A + pseudocount))
+	Log2Ratio DiffMode = iota
+	// Difference gives B - A
+	Difference
+)
+
+// ParseDiffMode converts log2ratio or difference to a DiffMode
+func ParseDiffMode(mode string) (DiffMode, error) {
+	switch mode {
+	case "", "log2ratio":
+		return Log2Ratio, nil
+	case "difference":
+		return Difference, nil
+	}
+
+	return Log2Ratio, fmt.Errorf("Unknown comparison %s, expected log2ratio or difference", mode)
+}
+
+// DiffOptions control the comparison made by DiffImage
+type DiffOptions struct {
+	Mode DiffMode
+	// Added to the counts of both datasets before taking the log2 ratio, so that empty bins give a finite value
+	Pseudocount float64
+	// The counts of B are multiplied by the factor before comparing, to correct for the difference in depth
+	Factor float64
+}
+
+// CisCount returns the total number of intrachromosomal entries in the file, which is used to normalise
+// datasets sequenced to different depths
+func CisCount(ctx context.Context, file File) (uint64, error) {
+	chromsizes := file.Chromsizes()
+
+	var total uint64
+	for _, chrom := range file.Chromosomes() {
+		length := chromsizes[chrom].Length
+		query := Query{SourceChrom: chrom, SourceStart: 0, SourceEnd: length, TargetChrom: chrom, TargetStart: 0, TargetEnd: length}
+
+		// A single pixel covering the whole chromosome, which counts every entry twice as it is mirrored
+		image, err := file.ImageContext(ctx, query, query, length+1, length+1)
+		if err != nil {
+			return 0, err
+		}
+		if len(image.Data) > 0 {
+			total += uint64(image.Data[0]) / 2
+		}
+	}
+
+	return total, nil
+}
+
+// DiffImage bins both files over the same view and compares B to A for each bin
+func DiffImage(ctx context.Context, fileA File, fileB File, query Query, viewQuery Query, binSizeX uint64, binSizeY uint64, options DiffOptions) (FloatImage, error) {
+	if options.Factor <= 0 {
+		return FloatImage{}, errors.New("Normalisation factor must be greater than 0")
+	}
+	if options.Pseudocount < 0 {
+		return FloatImage{}, errors.New("Pseudocount must not be negative")
+	}
+
+	imageA, err := fileA.ImageContext(ctx, query, viewQuery, binSizeX, binSizeY)
+	if err != nil {
+		return FloatImage{}, err
+	}
+	imageB, err := fileB.ImageContext(ctx, query, viewQuery, binSizeX, binSizeY)
+	if err != nil {
+		return FloatImage{}, err
+	}
+
+	diff := FloatImage{Width: imageA.Width, Height: imageA.Height, Data: make([]float32, len(imageA.Data))}
+	for index := range diff.Data {
+		a := float64(imageA.Data[index])
+		b := float64(imageB.Data[index]) * options.Factor
+
+		if options.Mode == Difference {
+			diff.Data[index] = float32(b - a)
+		} else {
+			diff.Data[index] = float32(math.Log2((b + options.Pseudocount) / (a + options.Pseudocount)))
+		}
+	}
+
+	return diff, nil
+}
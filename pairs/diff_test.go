@@ -0,0 +1,84 @@
+package pairs
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"testing"
+)
+
+func TestDiffImage(t *testing.T) {
+	entries := generateEntries(20000)
+
+	// Dataset B has every third entry of A, so has a third of the depth
+	var subset []*Entry
+	var expectedCisCount [2]uint64
+	for index, entry := range entries {
+		if entry.SourceChrom != entry.TargetChrom {
+			continue
+		}
+
+		expectedCisCount[0]++
+		if index%3 == 0 {
+			expectedCisCount[1]++
+		}
+	}
+	for index := 0; index < len(entries); index += 3 {
+		subset = append(subset, entries[index])
+	}
+
+	var files []File
+	for _, datasetEntries := range [][]*Entry{entries, subset} {
+		var buf bytes.Buffer
+		writeEntries(&buf, datasetEntries)
+		file, err := ParsePlain(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, file)
+	}
+
+	for index, file := range files {
+		cisCount, err := CisCount(context.Background(), file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cisCount != expectedCisCount[index] {
+			t.Errorf("Dataset %d: expected %d cis entries, got %d", index, expectedCisCount[index], cisCount)
+		}
+	}
+
+	factor := float64(expectedCisCount[0]) / float64(expectedCisCount[1])
+	query := Query{SourceChrom: "chr1", SourceStart: 0, SourceEnd: 2000000, TargetChrom: "chr1", TargetStart: 0, TargetEnd: 2000000}
+
+	imageA, _ := files[0].Image(query, query, 100000, 100000)
+	imageB, _ := files[1].Image(query, query, 100000, 100000)
+
+	for _, mode := range []DiffMode{Log2Ratio, Difference} {
+		diff, err := DiffImage(context.Background(), files[0], files[1], query, query, 100000, 100000, DiffOptions{Mode: mode, Pseudocount: 1, Factor: factor})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if diff.Width != imageA.Width || diff.Height != imageA.Height {
+			t.Fatalf("Expected %dx%d image, got %dx%d", imageA.Width, imageA.Height, diff.Width, diff.Height)
+		}
+
+		for index := range diff.Data {
+			a, b := float64(imageA.Data[index]), float64(imageB.Data[index])*factor
+
+			expected := float32(b - a)
+			if mode == Log2Ratio {
+				expected = float32(math.Log2((b + 1) / (a + 1)))
+			}
+
+			if diff.Data[index] != expected {
+				t.Fatalf("Mode %d, pixel %d: expected %f, got %f", mode, index, expected, diff.Data[index])
+			}
+		}
+	}
+
+	if _, err := DiffImage(context.Background(), files[0], files[1], query, query, 100000, 100000, DiffOptions{}); err == nil {
+		t.Error("Expected error with a factor of 0")
+	}
+}
@@ -0,0 +1,139 @@
+package pairs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Expected is the mean number of contacts between bins of a chromosome as a function of the distance between them
+type Expected struct {
+	Chrom      string
+	Resolution uint64
+	// Mean contacts of the pixels on each diagonal, indexed by the distance in bins
+	Values []float64
+}
+
+// ComputeExpected bins the intrachromosomal entries of the chromosome at the resolution and averages each diagonal
+func ComputeExpected(ctx context.Context, pairsFile File, chrom string, resolution uint64) (*Expected, error) {
+	if resolution == 0 {
+		return nil, errors.New("Resolution must be greater than 0")
+	}
+
+	chromsize, ok := pairsFile.Chromsizes()[chrom]
+	if !ok {
+		return nil, fmt.Errorf("Unknown chromosome %s", chrom)
+	}
+
+	pixels, err := chromPairPixels(ctx, pairsFile, chromsize, chromsize, resolution)
+	if err != nil {
+		return nil, err
+	}
+
+	numBins := chromsize.Length/resolution + 1
+	expected := &Expected{Chrom: chrom, Resolution: resolution, Values: make([]float64, numBins)}
+
+	for _, pixel := range pixels {
+		if distance := uint64(pixel.bin2 - pixel.bin1); distance < numBins {
+			expected.Values[distance] += float64(pixel.count)
+		}
+	}
+
+	// There are numBins - distance pixels on each diagonal
+	for distance := range expected.Values {
+		expected.Values[distance] /= float64(numBins - uint64(distance))
+	}
+
+	return expected, nil
+}
+
+// Value returns the expected contacts of a pixel at the distance (in base pairs)
+func (expected *Expected) Value(distance uint64) float64 {
+	bin := (distance + expected.Resolution/2) / expected.Resolution
+	if bin >= uint64(len(expected.Values)) {
+		return 0
+	}
+
+	return expected.Values[bin]
+}
+
+// ObsExpImage creates the image of an intrachromosomal query, dividing each bin by the expected contacts at the
+// distance between the centres of its x and y ranges. Bins with no expected contacts are NaN. The query can't be
+// filtered.
+func ObsExpImage(ctx context.Context, pairsFile File, expected *Expected, query Query, viewQuery Query, binSizeX uint64, binSizeY uint64) (FloatImage, error) {
+	if viewQuery.SourceChrom != viewQuery.TargetChrom || viewQuery.SourceChrom != expected.Chrom {
+		return FloatImage{}, errors.New("Observed/expected is only available for intrachromosomal views")
+	}
+	if query.Filter != nil || query.FilterDistance > 0 {
+		return FloatImage{}, errFilteredNormalisation
+	}
+
+	image, err := pairsFile.ImageContext(ctx, query, viewQuery, binSizeX, binSizeY)
+	if err != nil {
+		return FloatImage{}, err
+	}
+
+	// The expected values are per pixel of the expected resolution
+	scale := float64(binSizeX) * float64(binSizeY) / float64(expected.Resolution*expected.Resolution)
+
+	obsExp := FloatImage{Width: image.Width, Height: image.Height, Data: make([]float32, len(image.Data))}
+	for y := 0; y < int(image.Height); y++ {
+		startY := viewQuery.TargetStart + uint64(y)*binSizeY
+		centreY := startY + binSizeY/2
+
+		for x := 0; x < int(image.Width); x++ {
+			index := y*int(image.Width) + x
+
+			startX := viewQuery.SourceStart + uint64(x)*binSizeX
+			centreX := startX + binSizeX/2
+
+			distance := centreX - centreY
+			if centreY > centreX {
+				distance = centreY - centreX
+			}
+
+			expectedValue := expected.Value(distance) * scale
+			if expectedValue == 0 {
+				obsExp.Data[index] = float32(math.NaN())
+				continue
+			}
+
+			observed := float64(image.Data[index])
+			// Entries with both ends within the x and y ranges of the bin are counted twice, as the image is mirrored
+			if startX == startY && binSizeX == binSizeY {
+				observed /= 2
+			} else if overlapStart, overlapEnd := max(startX, startY), min(startX+binSizeX, startY+binSizeY); overlapStart < overlapEnd {
+				mirrored, err := mirroredCount(ctx, pairsFile, query, overlapStart, overlapEnd-1)
+				if err != nil {
+					return FloatImage{}, err
+				}
+				observed -= float64(mirrored)
+			}
+
+			obsExp.Data[index] = float32(observed / expectedValue)
+		}
+	}
+
+	return obsExp, nil
+}
+
+// mirroredCount returns the number of entries of the intrachromosomal query with both ends between start and end
+// (inclusive), which are counted twice by an image with a pixel covering them
+func mirroredCount(ctx context.Context, pairsFile File, query Query, start, end uint64) (uint64, error) {
+	// Entries are within the query, or the query in reverse, so limit both to the range
+	overlap := Query{SourceChrom: query.SourceChrom, SourceStart: max(query.SourceStart, start), SourceEnd: min(query.SourceEnd, end),
+		TargetChrom: query.TargetChrom, TargetStart: max(query.TargetStart, start), TargetEnd: min(query.TargetEnd, end)}
+	if overlap.SourceStart > overlap.SourceEnd || overlap.TargetStart > overlap.TargetEnd {
+		return 0, nil
+	}
+
+	// A single pixel covering the range, which counts every entry twice
+	view := Query{SourceChrom: query.SourceChrom, SourceStart: start, SourceEnd: end, TargetChrom: query.TargetChrom, TargetStart: start, TargetEnd: end}
+	image, err := pairsFile.ImageContext(ctx, overlap, view, end-start+1, end-start+1)
+	if err != nil || len(image.Data) == 0 {
+		return 0, err
+	}
+
+	return uint64(image.Data[0]) / 2, nil
+}
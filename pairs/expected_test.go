@@ -0,0 +1,125 @@
+package pairs
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"testing"
+)
+
+func TestExpected(t *testing.T) {
+	entries := generateEntries(20000)
+
+	var plain bytes.Buffer
+	writeEntries(&plain, entries)
+	pairsFile, err := ParsePlain(&plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const resolution = 100000
+	numBins := testChromsizes[0].Length/resolution + 1
+
+	sums := make([]float64, numBins)
+	for _, entry := range entries {
+		if entry.SourceChrom == "chr1" && entry.TargetChrom == "chr1" {
+			sums[entry.TargetPosition/resolution-entry.SourcePosition/resolution]++
+		}
+	}
+
+	expected, err := ComputeExpected(context.Background(), pairsFile, "chr1", resolution)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expected.Values) != int(numBins) {
+		t.Fatalf("Expected %d values, got %d", numBins, len(expected.Values))
+	}
+	for distance, value := range expected.Values {
+		if want := sums[distance] / float64(numBins-uint64(distance)); math.Abs(value-want) > 1e-9 {
+			t.Errorf("Distance %d: expected %f, got %f", distance, want, value)
+		}
+	}
+
+	query := Query{SourceChrom: "chr1", SourceStart: 0, SourceEnd: 2000000, TargetChrom: "chr1", TargetStart: 0, TargetEnd: 2000000}
+	image, _ := pairsFile.Image(query, query, resolution, resolution)
+	obsExp, err := ObsExpImage(context.Background(), pairsFile, expected, query, query, resolution, resolution)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for index := range obsExp.Data {
+		x, y := index%int(image.Width), index/int(image.Width)
+		distance := x - y
+		if distance < 0 {
+			distance = -distance
+		}
+
+		observed := float64(image.Data[index])
+		if x == y {
+			observed /= 2
+		}
+
+		want := float32(observed / expected.Values[distance])
+		if obsExp.Data[index] != want && !(math.IsNaN(float64(want)) && math.IsNaN(float64(obsExp.Data[index]))) {
+			t.Fatalf("Pixel (%d, %d): expected %f, got %f", x, y, want, obsExp.Data[index])
+		}
+	}
+
+	// When the x and y ranges of pixels only partly overlap, entries within the overlap are only observed once
+	views := []struct {
+		view               Query
+		binSizeX, binSizeY uint64
+	}{
+		{Query{SourceChrom: "chr1", SourceStart: 150000, SourceEnd: 1330000, TargetChrom: "chr1", TargetStart: 90000, TargetEnd: 1460000}, 70000, 70000},
+		{Query{SourceChrom: "chr1", SourceStart: 200000, SourceEnd: 1800000, TargetChrom: "chr1", TargetStart: 230000, TargetEnd: 1700000}, 60000, 90000},
+	}
+	for _, test := range views {
+		view := test.view
+		query := view
+		query.SourceStart, query.TargetStart = min(view.SourceStart, view.TargetStart), max(view.SourceStart, view.TargetStart)
+		query.SourceEnd, query.TargetEnd = min(view.SourceEnd, view.TargetEnd), max(view.SourceEnd, view.TargetEnd)
+
+		obsExp, err := ObsExpImage(context.Background(), pairsFile, expected, query, view, test.binSizeX, test.binSizeY)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		scale := float64(test.binSizeX) * float64(test.binSizeY) / float64(resolution*resolution)
+		for index := range obsExp.Data {
+			x, y := uint64(index%int(obsExp.Width)), uint64(index/int(obsExp.Width))
+			startX, startY := view.SourceStart+x*test.binSizeX, view.TargetStart+y*test.binSizeY
+			inX := func(position uint64) bool { return position >= startX && position < startX+test.binSizeX }
+			inY := func(position uint64) bool { return position >= startY && position < startY+test.binSizeY }
+
+			var observed float64
+			for _, entry := range entries {
+				if (entry.IsInRange(query) || entry.IsInRange(query.Reverse())) &&
+					((inX(entry.SourcePosition) && inY(entry.TargetPosition)) || (inX(entry.TargetPosition) && inY(entry.SourcePosition))) {
+					observed++
+				}
+			}
+
+			centreX, centreY := startX+test.binSizeX/2, startY+test.binSizeY/2
+			distance := centreX - centreY
+			if centreY > centreX {
+				distance = centreY - centreX
+			}
+
+			want := float32(observed / (expected.Value(distance) * scale))
+			if obsExp.Data[index] != want && !(math.IsNaN(float64(want)) && math.IsNaN(float64(obsExp.Data[index]))) {
+				t.Fatalf("View %v pixel (%d, %d): expected %f, got %f", view, x, y, want, obsExp.Data[index])
+			}
+		}
+	}
+
+	transQuery := Query{SourceChrom: "chr1", SourceStart: 0, SourceEnd: 2000000, TargetChrom: "chr2", TargetStart: 0, TargetEnd: 1500000}
+	if _, err := ObsExpImage(context.Background(), pairsFile, expected, transQuery, transQuery, resolution, resolution); err == nil {
+		t.Error("Expected error for interchromosomal view")
+	}
+
+	filtered := query
+	filtered.Filter = &Filter{Orientations: ParseOrientation("convergent")}
+	if _, err := ObsExpImage(context.Background(), pairsFile, expected, filtered, filtered, resolution, resolution); err == nil {
+		t.Error("Expected error for filtered view")
+	}
+}
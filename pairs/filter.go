@@ -0,0 +1,133 @@
+package pairs
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// Named strand orientations for entries stored as upper triangle (SourcePosition <= TargetPosition)
+var orientations = map[string][]string{
+	"convergent": {"+-"},
+	"inward":     {"+-"},
+	"divergent":  {"-+"},
+	"outward":    {"-+"},
+	"tandem":     {"++", "--"},
+}
+
+// ParseOrientation converts a named orientation (convergent/inward, divergent/outward, tandem)
+// or a strand pair (e.g. "+-") into the list of strand pairs it describes
+func ParseOrientation(orientation string) []string {
+	if strandPairs, ok := orientations[strings.ToLower(orientation)]; ok {
+		return strandPairs
+	}
+
+	return []string{orientation}
+}
+
+// Filter restricts the entries returned by a Query based on the additional columns of each entry.
+// Empty fields do not restrict the entries.
+type Filter struct {
+	// Strand pairs to include, written as strand1 followed by strand2 (e.g. "+-")
+	Orientations []string
+	// Pair types to include (e.g. UU, UR, RU)
+	PairTypes []string
+	// Minimum MAPQ required on both sides of the pair
+	MinMapQ int
+	// Only include entries whose read ID starts with the prefix
+	ReadIDPrefix string
+	// Columns which must have the specified value
+	Columns map[string]string
+}
+
+// Matches returns true when the entry satisfies all conditions of the filter. A nil filter matches all entries.
+func (filter *Filter) Matches(entry *Entry) bool {
+	if filter == nil {
+		return true
+	}
+
+	if len(filter.Orientations) > 0 && !contains(filter.Orientations, entry.SourceStrand+entry.TargetStrand) {
+		return false
+	}
+
+	if len(filter.PairTypes) > 0 && !contains(filter.PairTypes, entry.PairType) {
+		return false
+	}
+
+	if filter.MinMapQ > 0 && (entry.SourceMapQ < filter.MinMapQ || entry.TargetMapQ < filter.MinMapQ) {
+		return false
+	}
+
+	if filter.ReadIDPrefix != "" && !bytes.HasPrefix(entry.ReadID, []byte(filter.ReadIDPrefix)) {
+		return false
+	}
+
+	for name, value := range filter.Columns {
+		if columnValue, ok := entry.Column(name); !ok || columnValue != value {
+			return false
+		}
+	}
+
+	return true
+}
+
+// CheckFile returns an error when the filter can't be applied to the entries of the file
+func (filter *Filter) CheckFile(pairsFile File) error {
+	if filter == nil {
+		return nil
+	}
+	if !hasEntries(pairsFile) {
+		return errHicFilter
+	}
+
+	return filter.CheckColumns(pairsFile.Columns())
+}
+
+// CheckColumns returns an error when the filter uses a column that isn't among the columns of a file, as every
+// entry of the file would be excluded
+func (filter *Filter) CheckColumns(columns []string) error {
+	if filter == nil {
+		return nil
+	}
+
+	present := make(map[string]bool)
+	for _, name := range columns {
+		if alias, ok := columnAliases[name]; ok {
+			name = alias
+		}
+		present[name] = true
+	}
+
+	if len(filter.Orientations) > 0 && (!present["strand1"] || !present["strand2"]) {
+		return fmt.Errorf("Filtering by orientation needs strand1 and strand2 columns, but the file only has %v", columns)
+	}
+	if len(filter.PairTypes) > 0 && !present["pair_type"] {
+		return fmt.Errorf("Filtering by pair type needs a pair_type column, but the file only has %v", columns)
+	}
+	if filter.MinMapQ > 0 && !present["mapq"] && (!present["mapq1"] || !present["mapq2"]) {
+		return fmt.Errorf("Filtering by MAPQ needs a mapq column (or mapq1 and mapq2), but the file only has %v", columns)
+	}
+	if filter.ReadIDPrefix != "" && !present["readID"] {
+		return fmt.Errorf("Filtering by read ID needs a readID column, but the file only has %v", columns)
+	}
+	for name := range filter.Columns {
+		if alias, ok := columnAliases[name]; ok {
+			name = alias
+		}
+		if !present[name] {
+			return fmt.Errorf("Unknown column %s, the file has %v", name, columns)
+		}
+	}
+
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
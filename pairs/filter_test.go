@@ -0,0 +1,68 @@
+package pairs
+
+import "testing"
+
+func TestFilter(t *testing.T) {
+	layout, err := newColumnLayout([]string{"readID", "chrom1", "pos1", "chrom2", "pos2", "strand1", "strand2", "pair_type", "mapq1", "mapq2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entry, err := parseEntry("SRR1.5\tchr1\t100\tchr1\t5000\t+\t-\tUU\t30\t10", layout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		filter  *Filter
+		matches bool
+	}{
+		{nil, true},
+		{&Filter{}, true},
+		{&Filter{Orientations: ParseOrientation("convergent")}, true},
+		{&Filter{Orientations: ParseOrientation("divergent")}, false},
+		{&Filter{Orientations: ParseOrientation("tandem")}, false},
+		{&Filter{PairTypes: []string{"UR", "RU"}}, false},
+		{&Filter{PairTypes: []string{"UU"}}, true},
+		{&Filter{MinMapQ: 10}, true},
+		{&Filter{MinMapQ: 20}, false},
+		{&Filter{ReadIDPrefix: "SRR1."}, true},
+		{&Filter{ReadIDPrefix: "SRR2."}, false},
+		{&Filter{Columns: map[string]string{"strand2": "-"}}, true},
+		{&Filter{Columns: map[string]string{"unknown": "-"}}, false},
+	}
+
+	for _, test := range tests {
+		if test.filter.Matches(entry) != test.matches {
+			t.Errorf("Filter %+v: expected match to be %v", test.filter, test.matches)
+		}
+	}
+}
+
+func TestFilterCheckColumns(t *testing.T) {
+	fiveColumns := []string{"readID", "chr1", "pos1", "chr2", "pos2"}
+	allColumns := []string{"readID", "chrom1", "pos1", "chrom2", "pos2", "strand1", "strand2", "pair_type", "mapq1", "mapq2"}
+
+	tests := []struct {
+		filter  *Filter
+		columns []string
+		valid   bool
+	}{
+		{nil, fiveColumns, true},
+		{&Filter{MinMapQ: 10}, fiveColumns, false},
+		{&Filter{MinMapQ: 10}, allColumns, true},
+		{&Filter{MinMapQ: 10}, []string{"readID", "chrom1", "pos1", "chrom2", "pos2", "mapq"}, true},
+		{&Filter{Orientations: ParseOrientation("convergent")}, fiveColumns, false},
+		{&Filter{Orientations: ParseOrientation("convergent")}, allColumns, true},
+		{&Filter{PairTypes: []string{"UU"}}, fiveColumns, false},
+		{&Filter{ReadIDPrefix: "SRR1."}, fiveColumns, true},
+		{&Filter{Columns: map[string]string{"chrom1": "chr1"}}, fiveColumns, true},
+		{&Filter{Columns: map[string]string{"unknown": "-"}}, allColumns, false},
+	}
+
+	for _, test := range tests {
+		if err := test.filter.CheckColumns(test.columns); (err == nil) != test.valid {
+			t.Errorf("Filter %+v on %v: expected valid to be %v, got %v", test.filter, test.columns, test.valid, err)
+		}
+	}
+}
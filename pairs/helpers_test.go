@@ -0,0 +1,154 @@
+package pairs
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/imbbLab/v3c-viz/pairs/bgzf"
+)
+
+var testChromsizes = []Chromsize{{Name: "chr1", Length: 2000000}, {Name: "chr2", Length: 1500000}}
+
+// generateEntries creates a sorted (chr1-chr2-pos1-pos2), upper triangle set of entries
+func generateEntries(numEntries int) []*Entry {
+	random := rand.New(rand.NewSource(42))
+
+	var entries []*Entry
+	for i := 0; i < numEntries; i++ {
+		source := random.Intn(len(testChromsizes))
+		target := source
+		if random.Float64() < 0.2 {
+			target = random.Intn(len(testChromsizes))
+		}
+		if source > target {
+			source, target = target, source
+		}
+
+		entry := &Entry{SourceChrom: testChromsizes[source].Name, TargetChrom: testChromsizes[target].Name}
+		entry.SourcePosition = uint64(random.Int63n(int64(testChromsizes[source].Length))) + 1
+		entry.TargetPosition = uint64(random.Int63n(int64(testChromsizes[target].Length))) + 1
+		if source == target && entry.SourcePosition > entry.TargetPosition {
+			entry.SourcePosition, entry.TargetPosition = entry.TargetPosition, entry.SourcePosition
+		}
+
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.SourceChrom != b.SourceChrom {
+			return a.SourceChrom < b.SourceChrom
+		}
+		if a.TargetChrom != b.TargetChrom {
+			return a.TargetChrom < b.TargetChrom
+		}
+		if a.SourcePosition != b.SourcePosition {
+			return a.SourcePosition < b.SourcePosition
+		}
+		return a.TargetPosition < b.TargetPosition
+	})
+
+	return entries
+}
+
+// generateDecayingEntries creates unsorted entries on chr1 with contacts decaying with distance, without any
+// enrichment
+func generateDecayingEntries(numEntries int, seed int64) []*Entry {
+	random := rand.New(rand.NewSource(seed))
+	length := int64(testChromsizes[0].Length)
+
+	var entries []*Entry
+	for len(entries) < numEntries {
+		position1 := uint64(random.Int63n(length))
+		position2 := position1 + uint64(random.ExpFloat64()*200000)
+		if position2 < uint64(length) {
+			entries = append(entries, &Entry{SourceChrom: "chr1", SourcePosition: position1, TargetChrom: "chr1", TargetPosition: position2})
+		}
+	}
+
+	return entries
+}
+
+func writeEntries(writer io.Writer, entries []*Entry) {
+	writeSortedEntries(writer, entries, Chr1Chr2Pos1Pos2, UpperTriangle)
+}
+
+// writeSortedEntries writes the (upper triangle) entries with the requested sort order and shape
+func writeSortedEntries(writer io.Writer, entries []*Entry, order Order, shape Shape) {
+	toWrite := make([]Entry, len(entries))
+	for index, entry := range entries {
+		toWrite[index] = *entry
+		if shape == LowerTriangle {
+			toWrite[index].mirror()
+		}
+	}
+
+	sort.SliceStable(toWrite, func(i, j int) bool {
+		a, b := toWrite[i], toWrite[j]
+		if a.SourceChrom != b.SourceChrom {
+			return a.SourceChrom < b.SourceChrom
+		}
+		if order == Chr1Pos1Chr2Pos2 && a.SourcePosition != b.SourcePosition {
+			return a.SourcePosition < b.SourcePosition
+		}
+		if a.TargetChrom != b.TargetChrom {
+			return a.TargetChrom < b.TargetChrom
+		}
+		if a.SourcePosition != b.SourcePosition {
+			return a.SourcePosition < b.SourcePosition
+		}
+		return a.TargetPosition < b.TargetPosition
+	})
+
+	fmt.Fprintln(writer, "## pairs format v1.0")
+	fmt.Fprintf(writer, "#sorted: %s\n", order)
+	fmt.Fprintf(writer, "#shape: %s\n", shape)
+	fmt.Fprintln(writer, "#genome_assembly: test")
+	for _, chromsize := range testChromsizes {
+		fmt.Fprintf(writer, "#chromsize: %s %d\n", chromsize.Name, chromsize.Length)
+	}
+	fmt.Fprintln(writer, "#columns: readID chrom1 pos1 chrom2 pos2 strand1 strand2")
+	for index, entry := range toWrite {
+		fmt.Fprintf(writer, "read%d\t%s\t%d\t%s\t%d\t+\t-\n", index, entry.SourceChrom, entry.SourcePosition, entry.TargetChrom, entry.TargetPosition)
+	}
+}
+
+// writePairs writes the entries to a bgzip compressed .pairs file
+func writePairs(t testing.TB, filename string, entries []*Entry) {
+	file, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	writer := bgzf.NewWriter(file, 1)
+	writeEntries(writer, entries)
+
+	err = writer.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func countInRange(entries []*Entry, query Query) int {
+	count := 0
+	for _, entry := range entries {
+		if entry.IsInRange(query) || entry.IsInRange(query.Reverse()) {
+			count++
+		}
+	}
+
+	return count
+}
+
+var testQueries = []Query{
+	{SourceChrom: "chr1", SourceStart: 0, SourceEnd: 2000000, TargetChrom: "chr1", TargetStart: 0, TargetEnd: 2000000},
+	{SourceChrom: "chr1", SourceStart: 100000, SourceEnd: 400000, TargetChrom: "chr1", TargetStart: 300000, TargetEnd: 900000},
+	{SourceChrom: "chr1", SourceStart: 800000, SourceEnd: 1200000, TargetChrom: "chr1", TargetStart: 100000, TargetEnd: 500000},
+	{SourceChrom: "chr2", SourceStart: 1000000, SourceEnd: 1200000, TargetChrom: "chr2", TargetStart: 1100000, TargetEnd: 1500000},
+	{SourceChrom: "chr2", SourceStart: 0, SourceEnd: 1500000, TargetChrom: "chr1", TargetStart: 500000, TargetEnd: 1500000},
+}
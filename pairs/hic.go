@@ -0,0 +1,662 @@
+package pairs
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Juicer .hic files (versions 7 to 9) store contact matrices of each chromosome pair at several resolutions,
+// split into zlib compressed blocks. See https://github.com/aidenlab/hic-format for a description of the format.
+// Only the observed (unnormalised) base pair resolution matrices are read.
+
+var hicMagic = []byte{'H', 'I', 'C', 0}
+
+// Maximum number of bins in the region of a Search, used to choose the resolution of the pseudo-points
+const hicMaxSearchBins = 250000
+
+var errHicFilter = errors.New("Only the distance filter can be applied to .hic files, which don't contain individual pairs")
+
+func isHic(magic []byte) bool {
+	return bytes.HasPrefix(magic, hicMagic)
+}
+
+type hicFile struct {
+	baseFile
+
+	version     int32
+	chromIndex  map[string]int32
+	resolutions []uint64
+
+	masterIndex map[string]hicIndexEntry
+
+	// Zoom data of each chromosome pair (by resolution), read from the file when first needed
+	mu       sync.Mutex
+	zoomData map[string]map[uint64]*hicZoomData
+}
+
+type hicIndexEntry struct {
+	position int64
+	size     int32
+}
+
+type hicZoomData struct {
+	binSize          uint64
+	blockBinCount    int32
+	blockColumnCount int32
+
+	blocks map[int32]hicIndexEntry
+}
+
+type hicRecord struct {
+	binX  int32
+	binY  int32
+	count float32
+}
+
+// hicReader reads little endian values, keeping the first error that occurs so that it only needs to be checked
+// after a group of values have been read
+type hicReader struct {
+	reader *bufio.Reader
+	err    error
+}
+
+func newHicReader(reader io.Reader) *hicReader {
+	return &hicReader{reader: bufio.NewReader(reader)}
+}
+
+func (reader *hicReader) read(value interface{}) {
+	if reader.err == nil {
+		reader.err = binary.Read(reader.reader, binary.LittleEndian, value)
+	}
+}
+
+func (reader *hicReader) int8() int8 {
+	var value int8
+	reader.read(&value)
+	return value
+}
+
+func (reader *hicReader) int16() int16 {
+	var value int16
+	reader.read(&value)
+	return value
+}
+
+func (reader *hicReader) int32() int32 {
+	var value int32
+	reader.read(&value)
+	return value
+}
+
+func (reader *hicReader) int64() int64 {
+	var value int64
+	reader.read(&value)
+	return value
+}
+
+func (reader *hicReader) float32() float32 {
+	var value float32
+	reader.read(&value)
+	return value
+}
+
+// string reads a null terminated string
+func (reader *hicReader) string() string {
+	if reader.err != nil {
+		return ""
+	}
+
+	value, err := reader.reader.ReadString(0)
+	if err != nil {
+		reader.err = err
+		return ""
+	}
+
+	return strings.TrimSuffix(value, "\x00")
+}
+
+// ParseHic reads the header and master index of a Juicer .hic file
+func ParseHic(filename string) (File, error) {
+	var hic hicFile
+	var err error
+
+	hic.file, err = os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	err = hic.readHeader()
+	if err != nil {
+		hic.Close()
+		return nil, fmt.Errorf("Invalid .hic file %s: %w", filename, err)
+	}
+
+	log.Printf("Loaded .hic file (version %d) with %d chromosomes and resolutions %v\n", hic.version, len(hic.chromosomes), hic.resolutions)
+
+	return &hic, nil
+}
+
+func (hic *hicFile) readHeader() error {
+	hic.chromsizes = make(map[string]Chromsize)
+	hic.chromIndex = make(map[string]int32)
+	hic.masterIndex = make(map[string]hicIndexEntry)
+	hic.zoomData = make(map[string]map[uint64]*hicZoomData)
+	hic.layout = defaultColumnLayout
+
+	reader := newHicReader(hic.file)
+
+	magic := make([]byte, len(hicMagic))
+	reader.read(magic)
+	if reader.err == nil && !isHic(magic) {
+		return errors.New("unexpected magic")
+	}
+
+	hic.version = reader.int32()
+	if reader.err == nil && (hic.version < 7 || hic.version > 9) {
+		return fmt.Errorf("unsupported version %d (versions 7 to 9 are supported)", hic.version)
+	}
+
+	masterIndexPosition := reader.int64()
+	hic.GenomeAssembly = reader.string()
+	hic.header = append(hic.header, HeaderRecord{Key: "genome_assembly", Value: hic.GenomeAssembly})
+
+	if hic.version > 8 {
+		// Position and length of the normalisation vector index
+		reader.int64()
+		reader.int64()
+	}
+
+	numAttributes := reader.int32()
+	for i := int32(0); i < numAttributes && reader.err == nil; i++ {
+		key := reader.string()
+		value := reader.string()
+		hic.header = append(hic.header, HeaderRecord{Key: key, Value: value})
+
+		if key == "software" || key == "genomeID" {
+			log.Printf(".hic %s: %s\n", key, value)
+		}
+	}
+
+	numChromosomes := reader.int32()
+	for i := int32(0); i < numChromosomes && reader.err == nil; i++ {
+		var chromsize Chromsize
+		chromsize.Name = reader.string()
+		if hic.version > 8 {
+			chromsize.Length = uint64(reader.int64())
+		} else {
+			chromsize.Length = uint64(reader.int32())
+		}
+
+		hic.chromIndex[chromsize.Name] = i
+
+		// The first chromosome is a pseudo-chromosome representing the whole genome
+		if strings.EqualFold(chromsize.Name, "all") {
+			continue
+		}
+
+		hic.chromosomes = append(hic.chromosomes, chromsize.Name)
+		hic.chromsizes[chromsize.Name] = chromsize
+		hic.header = append(hic.header, HeaderRecord{Key: "chromsize", Value: fmt.Sprintf("%s %d", chromsize.Name, chromsize.Length)})
+	}
+
+	numResolutions := reader.int32()
+	for i := int32(0); i < numResolutions && reader.err == nil; i++ {
+		hic.resolutions = append(hic.resolutions, uint64(reader.int32()))
+	}
+	sort.Slice(hic.resolutions, func(i, j int) bool { return hic.resolutions[i] < hic.resolutions[j] })
+
+	if reader.err != nil {
+		return reader.err
+	}
+
+	// Master index of the matrix for each chromosome pair
+	reader = newHicReader(io.NewSectionReader(hic.file, masterIndexPosition, math.MaxInt64-masterIndexPosition))
+	if hic.version > 8 {
+		reader.int64()
+	} else {
+		reader.int32()
+	}
+
+	numEntries := reader.int32()
+	for i := int32(0); i < numEntries && reader.err == nil; i++ {
+		key := reader.string()
+		hic.masterIndex[key] = hicIndexEntry{position: reader.int64(), size: reader.int32()}
+	}
+
+	return reader.err
+}
+
+func (hic *hicFile) ChromPairList() []string {
+	names := make([]string, len(hic.chromIndex))
+	for name, index := range hic.chromIndex {
+		names[index] = name
+	}
+
+	var pairs []string
+	for key := range hic.masterIndex {
+		var chrom1, chrom2 int
+		if _, err := fmt.Sscanf(key, "%d_%d", &chrom1, &chrom2); err != nil || chrom1 == 0 || chrom2 >= len(names) {
+			continue
+		}
+
+		pairs = append(pairs, names[chrom1]+"|"+names[chrom2])
+	}
+	sort.Strings(pairs)
+
+	return pairs
+}
+
+// zoom returns the block index of the chromosome pair at the resolution (nil if not present). chrom1 must not be
+// after chrom2.
+func (hic *hicFile) zoom(chrom1, chrom2 int32, resolution uint64) (*hicZoomData, error) {
+	key := fmt.Sprintf("%d_%d", chrom1, chrom2)
+
+	hic.mu.Lock()
+	defer hic.mu.Unlock()
+
+	if zooms, ok := hic.zoomData[key]; ok {
+		return zooms[resolution], nil
+	}
+
+	entry, ok := hic.masterIndex[key]
+	if !ok {
+		return nil, nil
+	}
+
+	reader := newHicReader(io.NewSectionReader(hic.file, entry.position, int64(entry.size)))
+	reader.int32()
+	reader.int32()
+
+	zooms := make(map[uint64]*hicZoomData)
+
+	numResolutions := reader.int32()
+	for i := int32(0); i < numResolutions && reader.err == nil; i++ {
+		unit := reader.string()
+		// Zoom index, sum of counts, occupied cell count, standard deviation and 95th percentile
+		reader.int32()
+		reader.float32()
+		reader.float32()
+		reader.float32()
+		reader.float32()
+
+		zoom := &hicZoomData{blocks: make(map[int32]hicIndexEntry)}
+		zoom.binSize = uint64(reader.int32())
+		zoom.blockBinCount = reader.int32()
+		zoom.blockColumnCount = reader.int32()
+		if reader.err == nil && zoom.blockBinCount <= 0 {
+			return nil, fmt.Errorf("Invalid block bin count (%d) in .hic matrix %s", zoom.blockBinCount, key)
+		}
+
+		numBlocks := reader.int32()
+		for block := int32(0); block < numBlocks && reader.err == nil; block++ {
+			blockNumber := reader.int32()
+			zoom.blocks[blockNumber] = hicIndexEntry{position: reader.int64(), size: reader.int32()}
+		}
+
+		if unit == "BP" {
+			zooms[zoom.binSize] = zoom
+		}
+	}
+	if reader.err != nil {
+		return nil, reader.err
+	}
+
+	hic.zoomData[key] = zooms
+
+	return zooms[resolution], nil
+}
+
+// blockNumbers lists the blocks that can contain records with binX between x1 and x2 and binY between y1 and y2
+func (hic *hicFile) blockNumbers(zoom *hicZoomData, x1, x2, y1, y2 int64, intra bool) []int32 {
+	var blocks []int32
+	blockBinCount := int64(zoom.blockBinCount)
+	blockColumnCount := int64(zoom.blockColumnCount)
+
+	if hic.version > 8 && intra {
+		// Intrachromosomal blocks of version 9 files are arranged by the position along the diagonal and
+		// the (log) distance from the diagonal
+		depth := func(distance int64) int64 {
+			return int64(math.Log2(1 + float64(distance)/math.Sqrt2/float64(blockBinCount)))
+		}
+		abs := func(value int64) int64 {
+			if value < 0 {
+				return -value
+			}
+			return value
+		}
+
+		lowerPAD := (x1 + y1) / 2 / blockBinCount
+		higherPAD := (x2+y2)/2/blockBinCount + 1
+		nearerDepth := depth(abs(x1 - y2))
+		furtherDepth := depth(abs(x2 - y1))
+		if nearerDepth > furtherDepth {
+			nearerDepth, furtherDepth = furtherDepth, nearerDepth
+		}
+		// The region crosses the diagonal
+		if x1 <= y2 && y1 <= x2 {
+			nearerDepth = 0
+		}
+		furtherDepth++
+
+		for depth := nearerDepth; depth <= furtherDepth; depth++ {
+			for pad := lowerPAD; pad <= higherPAD; pad++ {
+				blocks = append(blocks, int32(depth*blockColumnCount+pad))
+			}
+		}
+
+		return blocks
+	}
+
+	addBlocks := func(x1, x2, y1, y2 int64) {
+		for row := y1 / blockBinCount; row <= (y2+1)/blockBinCount; row++ {
+			for column := x1 / blockBinCount; column <= (x2+1)/blockBinCount; column++ {
+				blocks = append(blocks, int32(row*blockColumnCount+column))
+			}
+		}
+	}
+
+	addBlocks(x1, x2, y1, y2)
+	if intra {
+		addBlocks(y1, y2, x1, x2)
+	}
+
+	return blocks
+}
+
+// readBlock decompresses the records of a block
+func (hic *hicFile) readBlock(block hicIndexEntry) ([]hicRecord, error) {
+	compressed := make([]byte, block.size)
+	if _, err := hic.file.ReadAt(compressed, block.position); err != nil {
+		return nil, err
+	}
+
+	zlibReader, err := zlib.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, err
+	}
+	defer zlibReader.Close()
+
+	data, err := ioutil.ReadAll(zlibReader)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := newHicReader(bytes.NewReader(data))
+
+	numRecords := reader.int32()
+	if numRecords < 0 {
+		return nil, fmt.Errorf("Invalid number of records (%d) in .hic block", numRecords)
+	}
+	records := make([]hicRecord, 0, min(uint64(numRecords), 1<<20))
+
+	binXOffset := reader.int32()
+	binYOffset := reader.int32()
+	// Counts are stored as int16 when the flag is 0
+	useShort := reader.int8() == 0
+	useShortBinX, useShortBinY := true, true
+	if hic.version > 8 {
+		useShortBinX = reader.int8() == 0
+		useShortBinY = reader.int8() == 0
+	}
+
+	readCount := func() float32 {
+		if useShort {
+			return float32(reader.int16())
+		}
+		return reader.float32()
+	}
+	readBin := func(short bool) int32 {
+		if short {
+			return int32(reader.int16())
+		}
+		return reader.int32()
+	}
+
+	switch blockType := reader.int8(); blockType {
+	case 1:
+		// List of rows, each with a list of columns
+		rowCount := readBin(useShortBinY)
+		for row := int32(0); row < rowCount && reader.err == nil; row++ {
+			binY := binYOffset + readBin(useShortBinY)
+
+			columnCount := readBin(useShortBinX)
+			for column := int32(0); column < columnCount && reader.err == nil; column++ {
+				binX := binXOffset + readBin(useShortBinX)
+				records = append(records, hicRecord{binX: binX, binY: binY, count: readCount()})
+			}
+		}
+	case 2:
+		// Dense block, with missing values stored as -32768 or NaN
+		numPoints := reader.int32()
+		width := int32(reader.int16())
+		for point := int32(0); point < numPoints && reader.err == nil; point++ {
+			record := hicRecord{binX: binXOffset + point%width, binY: binYOffset + point/width}
+
+			if useShort {
+				count := reader.int16()
+				if count == math.MinInt16 {
+					continue
+				}
+				record.count = float32(count)
+			} else {
+				record.count = reader.float32()
+				if math.IsNaN(float64(record.count)) {
+					continue
+				}
+			}
+
+			records = append(records, record)
+		}
+	default:
+		if reader.err == nil {
+			return nil, fmt.Errorf("Unknown .hic block type %d", blockType)
+		}
+	}
+
+	return records, reader.err
+}
+
+// forEachPixel calls pixelFunction for each pixel of the chromosome pair with bins on the first chromosome
+// (of the stored pair) between x1 and x2 and the second chromosome between y1 and y2. For intrachromosomal
+// data, the mirrored region is also included.
+func (hic *hicFile) forEachPixel(ctx context.Context, chrom1, chrom2 int32, resolution uint64, x1, x2, y1, y2 uint64, pixelFunction func(bin1, bin2 uint64, count uint32)) error {
+	zoom, err := hic.zoom(chrom1, chrom2, resolution)
+	if err != nil || zoom == nil {
+		return err
+	}
+
+	intra := chrom1 == chrom2
+
+	visited := make(map[int32]bool)
+	for _, blockNumber := range hic.blockNumbers(zoom, int64(x1), int64(x2), int64(y1), int64(y2), intra) {
+		block, ok := zoom.blocks[blockNumber]
+		if !ok || visited[blockNumber] {
+			continue
+		}
+		visited[blockNumber] = true
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		records, err := hic.readBlock(block)
+		if err != nil {
+			return err
+		}
+
+		for _, record := range records {
+			x, y := uint64(record.binX), uint64(record.binY)
+
+			if (x >= x1 && x <= x2 && y >= y1 && y <= y2) || (intra && y >= x1 && y <= x2 && x >= y1 && x <= y2) {
+				pixelFunction(x, y, uint32(math.Round(float64(record.count))))
+			}
+		}
+	}
+
+	return nil
+}
+
+// pairQuery returns the .hic indices of the chromosomes of the query, with the bin ranges on the first and second
+// stored chromosome, and whether the query is in the opposite order to the stored data
+func (hic *hicFile) pairQuery(query Query, resolution uint64) (chrom1, chrom2 int32, x1, x2, y1, y2 uint64, swapped bool, ok bool) {
+	chrom1, ok1 := hic.chromIndex[query.SourceChrom]
+	chrom2, ok2 := hic.chromIndex[query.TargetChrom]
+	if !ok1 || !ok2 {
+		return 0, 0, 0, 0, 0, 0, false, false
+	}
+
+	x1, x2 = query.SourceStart/resolution, query.SourceEnd/resolution
+	y1, y2 = query.TargetStart/resolution, query.TargetEnd/resolution
+
+	if chrom1 > chrom2 {
+		chrom1, chrom2 = chrom2, chrom1
+		x1, x2, y1, y2 = y1, y2, x1, x2
+		swapped = true
+	}
+
+	return chrom1, chrom2, x1, x2, y1, y2, swapped, true
+}
+
+// imageResolution returns the largest resolution no bigger than the bin sizes, or the smallest resolution
+func (hic *hicFile) imageResolution(binSizeX, binSizeY uint64) uint64 {
+	binSize := min(binSizeX, binSizeY)
+
+	for index := len(hic.resolutions) - 1; index > 0; index-- {
+		if hic.resolutions[index] <= binSize {
+			return hic.resolutions[index]
+		}
+	}
+
+	return hic.resolutions[0]
+}
+
+// binResolutions lists the base pair resolutions of the file
+func (hic *hicFile) binResolutions() []uint64 {
+	return hic.resolutions
+}
+
+// binnedPixels reads the pixels of the whole chromosome pair at the resolution
+func (hic *hicFile) binnedPixels(ctx context.Context, source, target Chromsize, resolution uint64, pixelFunction func(bin1, bin2 uint64, count uint32)) (bool, error) {
+	stored := false
+	for _, hicResolution := range hic.resolutions {
+		stored = stored || hicResolution == resolution
+	}
+	if !stored {
+		return false, nil
+	}
+
+	chrom1, chrom2, x1, x2, y1, y2, swapped, ok := hic.pairQuery(Query{SourceChrom: source.Name, SourceStart: 0, SourceEnd: source.Length,
+		TargetChrom: target.Name, TargetStart: 0, TargetEnd: target.Length}, resolution)
+	if !ok {
+		return true, nil
+	}
+
+	return true, hic.forEachPixel(ctx, chrom1, chrom2, resolution, x1, x2, y1, y2, func(bin1, bin2 uint64, count uint32) {
+		if swapped {
+			bin1, bin2 = bin2, bin1
+		}
+		pixelFunction(bin1, bin2, count)
+	})
+}
+
+// searchResolution returns the smallest resolution at which the query covers at most hicMaxSearchBins bins
+func (hic *hicFile) searchResolution(query Query) uint64 {
+	for _, resolution := range hic.resolutions {
+		if (query.SourceEnd-query.SourceStart)/resolution*((query.TargetEnd-query.TargetStart)/resolution) <= hicMaxSearchBins {
+			return resolution
+		}
+	}
+
+	return hic.resolutions[len(hic.resolutions)-1]
+}
+
+func (hic *hicFile) Image(query Query, viewQuery Query, binSizeX uint64, binSizeY uint64) (Image, error) {
+	return hic.ImageContext(context.Background(), query, viewQuery, binSizeX, binSizeY)
+}
+
+// ImageContext creates the image from the matrix at the nearest resolution. The .hic file doesn't contain
+// individual entries, so the distance filter is applied to the centre of each bin and other filters are an error.
+func (hic *hicFile) ImageContext(ctx context.Context, query Query, viewQuery Query, binSizeX uint64, binSizeY uint64) (Image, error) {
+	if len(hic.resolutions) == 0 {
+		return Image{}, errors.New("No base pair resolutions in .hic file")
+	}
+	if query.Filter != nil {
+		return Image{}, errHicFilter
+	}
+
+	resolution := hic.imageResolution(binSizeX, binSizeY)
+	chrom1, chrom2, x1, x2, y1, y2, swapped, ok := hic.pairQuery(query, resolution)
+
+	return binnedImage(query, viewQuery, binSizeX, binSizeY, resolution, swapped, fmt.Sprintf("the %d bp .hic matrix", resolution),
+		func(pixelFunction func(bin1, bin2 uint64, count uint32)) error {
+			if !ok {
+				return nil
+			}
+
+			return hic.forEachPixel(ctx, chrom1, chrom2, resolution, x1, x2, y1, y2, pixelFunction)
+		})
+}
+
+// Iterate returns one pseudo-entry at the centre of each non-empty bin within the query, at the smallest
+// resolution that keeps the number of bins manageable. As with images, only the distance filter can be applied.
+func (hic *hicFile) Iterate(ctx context.Context, query Query) (Iterator, error) {
+	if len(hic.resolutions) == 0 {
+		return nil, errors.New("No base pair resolutions in .hic file")
+	}
+	if query.Filter != nil {
+		return nil, errHicFilter
+	}
+
+	resolution := hic.searchResolution(query)
+	chrom1, chrom2, x1, x2, y1, y2, swapped, ok := hic.pairQuery(query, resolution)
+	if !ok {
+		return &memoryIterator{ctx: ctx}, nil
+	}
+
+	var entries []Entry
+	err := hic.forEachPixel(ctx, chrom1, chrom2, resolution, x1, x2, y1, y2, func(bin1, bin2 uint64, count uint32) {
+		entry := Entry{SourceChrom: query.SourceChrom, TargetChrom: query.TargetChrom,
+			SourcePosition: bin1*resolution + resolution/2, TargetPosition: bin2*resolution + resolution/2, layout: defaultColumnLayout}
+		if swapped || (chrom1 == chrom2 && entry.SourcePosition > entry.TargetPosition) {
+			entry.SourcePosition, entry.TargetPosition = entry.TargetPosition, entry.SourcePosition
+		}
+
+		entries = append(entries, entry)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &memoryIterator{ctx: ctx, query: query, revQuery: query.Reverse(), candidates: [][]Entry{entries}}, nil
+}
+
+// QueryContext calls entryFunction for the pseudo-entry of each non-empty bin within the query
+func (hic *hicFile) QueryContext(ctx context.Context, query Query, entryFunction func(entry *Entry)) error {
+	iterator, err := hic.Iterate(ctx, query)
+	if err != nil {
+		return err
+	}
+
+	return forEachEntry(iterator, entryFunction)
+}
+
+func (hic *hicFile) Search(query Query) ([]*Entry, error) {
+	return searchEntries(context.Background(), query, hic.QueryContext)
+}
+
+func (hic *hicFile) SearchContext(ctx context.Context, query Query) ([]*Entry, error) {
+	return searchEntries(ctx, query, hic.QueryContext)
+}
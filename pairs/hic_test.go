@@ -0,0 +1,235 @@
+package pairs
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"testing"
+)
+
+// writeHic writes the entries as a .hic file, with small blocks so that queries need to select blocks
+func writeHic(t testing.TB, filename string, version int32, entries []*Entry, resolutions []uint64) {
+	const blockBinCount = 8
+
+	var buf bytes.Buffer
+	write := func(values ...interface{}) {
+		for _, value := range values {
+			if s, ok := value.(string); ok {
+				buf.WriteString(s)
+				buf.WriteByte(0)
+				continue
+			}
+			binary.Write(&buf, binary.LittleEndian, value)
+		}
+	}
+	writeLength := func(length uint64) {
+		if version > 8 {
+			write(int64(length))
+		} else {
+			write(int32(length))
+		}
+	}
+
+	write([]byte("HIC\x00"), version, int64(0), "test")
+	if version > 8 {
+		write(int64(0), int64(0))
+	}
+	write(int32(1), "software", "v3c-viz test")
+
+	write(int32(len(testChromsizes)+1), "All")
+	writeLength(1000)
+	for _, chromsize := range testChromsizes {
+		write(chromsize.Name)
+		writeLength(chromsize.Length)
+	}
+
+	write(int32(len(resolutions)))
+	for _, resolution := range resolutions {
+		write(int32(resolution))
+	}
+	write(int32(0))
+
+	type pixel struct{ x, y int32 }
+	masterIndex := make(map[string]hicIndexEntry)
+
+	for chrom1 := range testChromsizes {
+		for chrom2 := chrom1; chrom2 < len(testChromsizes); chrom2++ {
+			var matrix bytes.Buffer
+			binary.Write(&matrix, binary.LittleEndian, []int32{int32(chrom1 + 1), int32(chrom2 + 1), int32(len(resolutions))})
+
+			for resolutionIndex, resolution := range resolutions {
+				blockColumnCount := int32(testChromsizes[chrom2].Length/resolution/blockBinCount + 1)
+
+				// Group the counts of each pixel by block
+				blocks := make(map[int32]map[pixel]float32)
+				for _, entry := range entries {
+					if entry.SourceChrom != testChromsizes[chrom1].Name || entry.TargetChrom != testChromsizes[chrom2].Name {
+						continue
+					}
+
+					p := pixel{x: int32(entry.SourcePosition / resolution), y: int32(entry.TargetPosition / resolution)}
+
+					var blockNumber int32
+					if version > 8 && chrom1 == chrom2 {
+						depth := int32(math.Log2(1 + math.Abs(float64(p.x-p.y))/math.Sqrt2/blockBinCount))
+						blockNumber = depth*blockColumnCount + (p.x+p.y)/2/blockBinCount
+					} else {
+						blockNumber = (p.y/blockBinCount)*blockColumnCount + p.x/blockBinCount
+					}
+
+					if blocks[blockNumber] == nil {
+						blocks[blockNumber] = make(map[pixel]float32)
+					}
+					blocks[blockNumber][p]++
+				}
+
+				binary.Write(&matrix, binary.LittleEndian, []byte("BP\x00"))
+				binary.Write(&matrix, binary.LittleEndian, int32(resolutionIndex))
+				binary.Write(&matrix, binary.LittleEndian, []float32{0, 0, 0, 0})
+				binary.Write(&matrix, binary.LittleEndian, []int32{int32(resolution), blockBinCount, blockColumnCount, int32(len(blocks))})
+
+				for blockNumber, counts := range blocks {
+					// Version 8 uses short bins and counts, version 9 uses int bins and float counts
+					var block bytes.Buffer
+					if version > 8 {
+						binary.Write(&block, binary.LittleEndian, []int32{int32(len(counts)), 0, 0})
+						binary.Write(&block, binary.LittleEndian, []byte{1, 1, 1, 1})
+						binary.Write(&block, binary.LittleEndian, int32(len(counts)))
+						for p, count := range counts {
+							binary.Write(&block, binary.LittleEndian, []int32{p.y, 1, p.x})
+							binary.Write(&block, binary.LittleEndian, count)
+						}
+					} else {
+						binary.Write(&block, binary.LittleEndian, []int32{int32(len(counts)), 0, 0})
+						binary.Write(&block, binary.LittleEndian, []byte{0, 1})
+						binary.Write(&block, binary.LittleEndian, int16(len(counts)))
+						for p, count := range counts {
+							binary.Write(&block, binary.LittleEndian, []int16{int16(p.y), 1, int16(p.x), int16(count)})
+						}
+					}
+
+					var compressed bytes.Buffer
+					zlibWriter := zlib.NewWriter(&compressed)
+					zlibWriter.Write(block.Bytes())
+					zlibWriter.Close()
+
+					binary.Write(&matrix, binary.LittleEndian, blockNumber)
+					binary.Write(&matrix, binary.LittleEndian, int64(buf.Len()))
+					binary.Write(&matrix, binary.LittleEndian, int32(compressed.Len()))
+					buf.Write(compressed.Bytes())
+				}
+			}
+
+			masterIndex[fmt.Sprintf("%d_%d", chrom1+1, chrom2+1)] = hicIndexEntry{position: int64(buf.Len()), size: int32(matrix.Len())}
+			buf.Write(matrix.Bytes())
+		}
+	}
+
+	masterIndexPosition := int64(buf.Len())
+	writeLength(0)
+	write(int32(len(masterIndex)))
+	for key, entry := range masterIndex {
+		write(key, entry.position, entry.size)
+	}
+
+	data := buf.Bytes()
+	binary.LittleEndian.PutUint64(data[8:16], uint64(masterIndexPosition))
+
+	if err := ioutil.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHic(t *testing.T) {
+	entries := generateEntries(20000)
+
+	var plain bytes.Buffer
+	writeEntries(&plain, entries)
+	plainFile, err := ParsePlain(&plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queries := []Query{
+		{SourceChrom: "chr1", SourceStart: 0, SourceEnd: 2000000, TargetChrom: "chr1", TargetStart: 0, TargetEnd: 2000000},
+		{SourceChrom: "chr1", SourceStart: 400000, SourceEnd: 1200000, TargetChrom: "chr1", TargetStart: 800000, TargetEnd: 2000000},
+		{SourceChrom: "chr1", SourceStart: 1000000, SourceEnd: 2000000, TargetChrom: "chr1", TargetStart: 0, TargetEnd: 600000},
+		{SourceChrom: "chr1", SourceStart: 0, SourceEnd: 2000000, TargetChrom: "chr2", TargetStart: 0, TargetEnd: 1500000},
+		{SourceChrom: "chr2", SourceStart: 500000, SourceEnd: 1500000, TargetChrom: "chr1", TargetStart: 0, TargetEnd: 1000000},
+	}
+
+	for _, version := range []int32{8, 9} {
+		filename := filepath.Join(t.TempDir(), "test.hic")
+		writeHic(t, filename, version, entries, []uint64{100000, 20000})
+
+		pairsFile, err := Parse(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, ok := pairsFile.(*hicFile); !ok {
+			t.Fatalf("Expected .hic file, got %T", pairsFile)
+		}
+		if pairsFile.Genome() != "test" || len(pairsFile.Chromosomes()) != len(testChromsizes) || pairsFile.Chromsizes()["chr2"].Length != 1500000 {
+			t.Errorf("Version %d: header not parsed, genome %s and chromosomes %v", version, pairsFile.Genome(), pairsFile.Chromsizes())
+		}
+		if chromPairs := pairsFile.ChromPairList(); len(chromPairs) != 3 {
+			t.Errorf("Version %d: expected 3 chromosome pairs, got %v", version, chromPairs)
+		}
+
+		// Bins of the images line up with the bins of the .hic file, so the images must be identical
+		for _, binSize := range []uint64{20000, 100000, 200000} {
+			for _, query := range queries {
+				expected, err := plainFile.Image(query, query, binSize, binSize)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				image, err := pairsFile.Image(query, query, binSize, binSize)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				for index := range image.Data {
+					if image.Data[index] != expected.Data[index] {
+						t.Fatalf("Version %d, query %v (bin size %d): pixel %d expected %d, got %d", version, query, binSize, index, expected.Data[index], image.Data[index])
+					}
+				}
+			}
+		}
+
+		for _, query := range queries {
+			points, err := pairsFile.Search(query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(points) == 0 {
+				t.Errorf("Version %d, query %v: expected pseudo-points", version, query)
+			}
+			for _, point := range points {
+				if !point.IsInRange(query) && !point.IsInRange(query.Reverse()) {
+					t.Fatalf("Version %d, query %v: point %+v outside of query", version, query, point)
+				}
+			}
+		}
+
+		// Only the distance filter can be applied to the bins
+		filtered := queries[0]
+		filtered.Filter = &Filter{Orientations: ParseOrientation("convergent")}
+		if _, err := pairsFile.Image(filtered, filtered, 100000, 100000); err == nil {
+			t.Errorf("Version %d: expected filtered image to fail", version)
+		}
+		if _, err := pairsFile.Search(filtered); err == nil {
+			t.Errorf("Version %d: expected filtered search to fail", version)
+		}
+		if err := filtered.Filter.CheckFile(pairsFile); err == nil {
+			t.Errorf("Version %d: expected filter check to fail", version)
+		}
+
+		pairsFile.Close()
+	}
+}
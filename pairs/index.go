@@ -2,7 +2,7 @@ package pairs
 
 import (
 	"bufio"
-	"fmt"
+	"log"
 	"sort"
 	"sync"
 
@@ -20,6 +20,9 @@ type Query struct {
 
 	// Ignore points that are within abs(x - y) < FilterDistance
 	FilterDistance uint64
+
+	// Restrict entries by strand, pair type, MAPQ or column values (nil includes all entries)
+	Filter *Filter
 }
 
 func (query Query) Reverse() Query {
@@ -32,6 +35,9 @@ func (query Query) Reverse() Query {
 	revQuery.TargetStart = query.SourceStart
 	revQuery.TargetEnd = query.SourceEnd
 
+	revQuery.FilterDistance = query.FilterDistance
+	revQuery.Filter = query.Filter
+
 	return revQuery
 }
 
@@ -196,9 +202,9 @@ func (index *BGZFIndex) Query(query Query, entryFunction func(entry *Entry)) err
 				}
 			}
 
-			entry, err = parseEntry(string(lineData))
+			entry, err = parseEntry(string(lineData), defaultColumnLayout)
 			if err != nil {
-				fmt.Printf("Problem parsing entry: %s\n", string(lineData))
+				log.Printf("Problem parsing entry: %s\n", string(lineData))
 				return err
 			}
 
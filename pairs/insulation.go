@@ -0,0 +1,166 @@
+package pairs
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// InsulationOptions control the sliding diamond of the insulation score
+type InsulationOptions struct {
+	// Size of the diamond in base pairs, a multiple of the resolution
+	Window uint64
+	// Number of diagonals ignored, as they are dominated by short range contacts
+	IgnoreDiagonals uint64
+	// Balance the counts with the weights before summing, when not nil
+	Weights *BalanceWeights
+}
+
+// InsulationScore slides a diamond of window x window along the diagonal of the binned intrachromosomal matrix,
+// giving the log2 of the contacts within the diamond relative to the mean over the chromosome. Low values mark
+// bins that few contacts cross, such as the boundaries of domains. Bins where the diamond doesn't fit within the
+// chromosome, or contains no contacts, are NaN.
+func InsulationScore(ctx context.Context, pairsFile File, chrom string, resolution uint64, options InsulationOptions) ([]TrackBin, error) {
+	if resolution == 0 || options.Window < resolution {
+		return nil, errors.New("Window must be at least the resolution, which must be greater than 0")
+	}
+	if err := options.Weights.checkResolution(resolution); err != nil {
+		return nil, err
+	}
+
+	chromsize, ok := pairsFile.Chromsizes()[chrom]
+	if !ok {
+		return nil, fmt.Errorf("Unknown chromosome %s", chrom)
+	}
+
+	pixels, err := chromPairPixels(ctx, pairsFile, chromsize, chromsize, resolution)
+	if err != nil {
+		return nil, err
+	}
+
+	numBins := int(chromsize.Length/resolution + 1)
+	window := int(options.Window / resolution)
+
+	// The diamond of bin i covers rows i-window+1 to i and columns i to i+window-1, so pixel (a, b) is within the
+	// diamonds of bins max(a, b-window+1) to min(a+window-1, b). Record where each pixel starts and stops counting.
+	changes := make([]float64, numBins+1)
+	for _, pixel := range pixels {
+		a, b := int(pixel.bin1), int(pixel.bin2)
+		if b-a > 2*window-2 || uint64(b-a) < options.IgnoreDiagonals {
+			continue
+		}
+
+		value := float64(pixel.count)
+		if options.Weights != nil {
+			value *= options.Weights.Weight(chrom, uint64(a)*resolution) * options.Weights.Weight(chrom, uint64(b)*resolution)
+			if math.IsNaN(value) {
+				continue
+			}
+		}
+
+		first, last := b-window+1, a+window-1
+		if first < a {
+			first = a
+		}
+		if last > b {
+			last = b
+		}
+
+		changes[first] += value
+		changes[last+1] -= value
+	}
+
+	scores := make([]TrackBin, numBins)
+	var sum, total float64
+	var count int
+	for bin := range scores {
+		sum += changes[bin]
+
+		scores[bin] = TrackBin{Chrom: chrom, Start: uint64(bin) * resolution, End: min(uint64(bin+1)*resolution, chromsize.Length), Value: math.NaN()}
+		if bin-window+1 >= 0 && bin+window-1 < numBins && sum > 0 {
+			scores[bin].Value = sum
+			total += sum
+			count++
+		}
+	}
+
+	mean := total / float64(count)
+	for bin := range scores {
+		scores[bin].Value = math.Log2(scores[bin].Value / mean)
+	}
+
+	return scores, nil
+}
+
+// Boundary is a local minimum of the insulation score
+type Boundary struct {
+	TrackBin
+	// Height of the lower of the maxima on either side of the minimum (within the window) above the minimum
+	Strength float64
+}
+
+// CallBoundaries finds the local minima of the insulation score with at least the strength. The window (in bins)
+// limits how far either side of a minimum is searched for the maxima used to measure its strength.
+func CallBoundaries(scores []TrackBin, window int, minStrength float64) []Boundary {
+	var boundaries []Boundary
+
+	// The nearest bins either side with a score
+	previous := func(bin int) int {
+		bin--
+		for bin >= 0 && math.IsNaN(scores[bin].Value) {
+			bin--
+		}
+		return bin
+	}
+	next := func(bin int) int {
+		bin++
+		for bin < len(scores) && math.IsNaN(scores[bin].Value) {
+			bin++
+		}
+		return bin
+	}
+	maximum := func(first, last int) float64 {
+		value := math.NaN()
+		for bin := first; bin <= last; bin++ {
+			if bin < 0 || bin >= len(scores) || math.IsNaN(scores[bin].Value) {
+				continue
+			}
+			if math.IsNaN(value) || scores[bin].Value > value {
+				value = scores[bin].Value
+			}
+		}
+		return value
+	}
+
+	for bin, score := range scores {
+		if math.IsNaN(score.Value) {
+			continue
+		}
+
+		before, after := previous(bin), next(bin)
+		if before < 0 || after >= len(scores) || score.Value >= scores[before].Value || score.Value > scores[after].Value {
+			continue
+		}
+
+		strength := math.Min(maximum(bin-window, bin-1), maximum(bin+1, bin+window)) - score.Value
+		if strength >= minStrength {
+			boundaries = append(boundaries, Boundary{TrackBin: score, Strength: strength})
+		}
+	}
+
+	return boundaries
+}
+
+// WriteBoundariesBED writes the boundaries as BED, with the strength as the score
+func WriteBoundariesBED(writer io.Writer, boundaries []Boundary) error {
+	bufWriter := bufio.NewWriter(writer)
+
+	for index, boundary := range boundaries {
+		fmt.Fprintf(bufWriter, "%s\t%d\t%d\tboundary%d\t%g\n", boundary.Chrom, boundary.Start, boundary.End, index+1, boundary.Strength)
+	}
+
+	return bufWriter.Flush()
+}
@@ -0,0 +1,107 @@
+package pairs
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestInsulation(t *testing.T) {
+	entries := generateEntries(20000)
+
+	var plain bytes.Buffer
+	writeEntries(&plain, entries)
+	pairsFile, err := ParsePlain(&plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const resolution = 50000
+	const window = 4
+	scores, err := InsulationScore(context.Background(), pairsFile, "chr1", resolution, InsulationOptions{Window: window * resolution, IgnoreDiagonals: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	numBins := int(testChromsizes[0].Length/resolution + 1)
+	if len(scores) != numBins {
+		t.Fatalf("Expected %d bins, got %d", numBins, len(scores))
+	}
+
+	// Sum each diamond directly
+	counts := make(map[[2]int]float64)
+	for _, entry := range entries {
+		if entry.SourceChrom == "chr1" && entry.TargetChrom == "chr1" {
+			counts[[2]int{int(entry.SourcePosition / resolution), int(entry.TargetPosition / resolution)}]++
+		}
+	}
+	sums := make([]float64, numBins)
+	var total float64
+	var valid int
+	for bin := window - 1; bin+window-1 < numBins; bin++ {
+		for a := bin - window + 1; a <= bin; a++ {
+			for b := bin; b <= bin+window-1; b++ {
+				if b-a >= 2 {
+					sums[bin] += counts[[2]int{a, b}]
+				}
+			}
+		}
+		total += sums[bin]
+		valid++
+	}
+	for bin, score := range scores {
+		if bin < window-1 || bin+window-1 >= numBins {
+			if !math.IsNaN(score.Value) {
+				t.Errorf("Bin %d: expected NaN at the end of the chromosome, got %f", bin, score.Value)
+			}
+			continue
+		}
+
+		if expected := math.Log2(sums[bin] / (total / float64(valid))); math.Abs(score.Value-expected) > 1e-9 {
+			t.Errorf("Bin %d: expected %f, got %f", bin, expected, score.Value)
+		}
+	}
+
+	// Entries only within domains should give boundaries between the domains
+	random := rand.New(rand.NewSource(1))
+	domains := []uint64{0, 600000, 1200000, 2000000}
+	var domainEntries []*Entry
+	for index := 0; index < 50000; index++ {
+		domain := random.Intn(len(domains) - 1)
+		start, end := domains[domain], domains[domain+1]
+		position1, position2 := start+uint64(random.Int63n(int64(end-start))), start+uint64(random.Int63n(int64(end-start)))
+		domainEntries = append(domainEntries, &Entry{SourceChrom: "chr1", SourcePosition: min(position1, position2), TargetChrom: "chr1", TargetPosition: max(position1, position2)})
+	}
+
+	plain.Reset()
+	writeEntries(&plain, domainEntries)
+	pairsFile, err = ParsePlain(&plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scores, err = InsulationScore(context.Background(), pairsFile, "chr1", resolution, InsulationOptions{Window: window * resolution, IgnoreDiagonals: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	boundaries := CallBoundaries(scores, window, 0.5)
+	if len(boundaries) != 2 {
+		t.Fatalf("Expected 2 boundaries, got %v", boundaries)
+	}
+	for index, boundary := range boundaries {
+		// The diamond of the bin starting at the boundary is the first to include no contacts across it
+		if domains[index+1] < boundary.Start-resolution || domains[index+1] > boundary.End {
+			t.Errorf("Boundary %d at %d-%d, expected at %d", index, boundary.Start, boundary.End, domains[index+1])
+		}
+	}
+
+	var bed bytes.Buffer
+	WriteBoundariesBED(&bed, boundaries)
+	if lines := strings.Split(strings.TrimSpace(bed.String()), "\n"); len(lines) != 2 || !strings.HasPrefix(lines[0], "chr1\t") {
+		t.Errorf("Unexpected BED output %q", bed.String())
+	}
+}
@@ -0,0 +1,297 @@
+package pairs
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+
+	"github.com/imbbLab/v3c-viz/pairs/bgzf"
+	bgzfindex "github.com/imbbLab/v3c-viz/pairs/bgzf/index"
+)
+
+// Iterator steps through the entries within a query without holding them all in memory:
+//
+//	iterator, err := pairsFile.Iterate(ctx, query)
+//	if err != nil {
+//		return err
+//	}
+//	defer iterator.Close()
+//
+//	for iterator.Next() {
+//		entry := iterator.Entry()
+//		...
+//	}
+//	return iterator.Err()
+//
+// The same Entry is reused for every step, so it is only valid until the next call to Next. Use Clone to keep it.
+type Iterator interface {
+	// Next advances to the next entry, returning false when there are no more entries, an error occurred or
+	// the context of the query was cancelled
+	Next() bool
+	// Entry returns the current entry
+	Entry() *Entry
+	// Err returns the error that stopped the iterator, or nil if all entries were read
+	Err() error
+	// Close releases the resources of the iterator. It can be called at any point to stop early.
+	Close() error
+}
+
+// forEachEntry calls entryFunction for every entry of the iterator and then closes it
+func forEachEntry(iterator Iterator, entryFunction func(entry *Entry)) error {
+	defer iterator.Close()
+
+	for iterator.Next() {
+		entryFunction(iterator.Entry())
+	}
+
+	return iterator.Err()
+}
+
+// bgzfIterator reads the entries within the chunks of a query using a reader taken from the pool of the file
+type bgzfIterator struct {
+	ctx  context.Context
+	file *bgzfFile
+
+	query    Query
+	revQuery Query
+	// Every entry is returned, rather than those within the query
+	all bool
+
+	reader      *bgzf.Reader
+	chunkReader *bgzfindex.ChunkReader
+	bufReader   *bufio.Reader
+	parser      *entryParser
+
+	line      []byte
+	lineCount int
+
+	entry Entry
+	err   error
+}
+
+// Iterate returns an Iterator over the entries within the query. The iterator holds one of the readers of the
+// file until it is closed or has returned all entries.
+func (file *bgzfFile) Iterate(ctx context.Context, query Query) (Iterator, error) {
+	iterator := &bgzfIterator{ctx: ctx, file: file, query: query, revQuery: query.Reverse()}
+
+	if err := iterator.open(file.index.getChunksFromQuery(query, file.Shape)); err != nil {
+		return nil, err
+	}
+
+	return iterator, nil
+}
+
+// scan returns an Iterator over the chunks of every sequence of the index, so reads each entry once
+func (file *bgzfFile) scan(ctx context.Context) (Iterator, error) {
+	iterator := &bgzfIterator{ctx: ctx, file: file, all: true}
+
+	var chunks []bgzf.Chunk
+	for name := range file.index.BinIndex {
+		chunks = append(chunks, file.index.getChunks(name, 0, math.MaxUint64)...)
+	}
+	sort.Slice(chunks, func(i, j int) bool {
+		return toVirtualOffset(chunks[i].Begin) < toVirtualOffset(chunks[j].Begin)
+	})
+
+	if err := iterator.open(chunkMergeStrategy(chunks)); err != nil {
+		return nil, err
+	}
+
+	return iterator, nil
+}
+
+// open prepares the iterator to read the chunks
+func (iterator *bgzfIterator) open(chunks []bgzf.Chunk) error {
+	if len(chunks) == 0 {
+		return nil
+	}
+
+	// Take a reader from the pool, waiting if they are all in use
+	select {
+	case iterator.reader = <-iterator.file.readers:
+	case <-iterator.ctx.Done():
+		return iterator.ctx.Err()
+	}
+
+	// Only the data within the chunks is read, and each chunk starts and ends on a line boundary
+	var err error
+	iterator.chunkReader, err = bgzfindex.NewChunkReader(iterator.reader, chunks)
+	if err != nil {
+		iterator.Close()
+		return err
+	}
+
+	iterator.bufReader = bufio.NewReader(iterator.chunkReader)
+	iterator.parser = newEntryParser(iterator.file.layout, iterator.file.chromsizes, iterator.file.Shape == LowerTriangle)
+
+	return nil
+}
+
+// readLine reads the next line into the line buffer of the iterator
+func (iterator *bgzfIterator) readLine() error {
+	iterator.line = iterator.line[:0]
+
+	for {
+		lineData, err := iterator.bufReader.ReadSlice('\n')
+		iterator.line = append(iterator.line, lineData...)
+
+		if err == bufio.ErrBufferFull {
+			continue
+		} else if err == io.EOF && len(iterator.line) > 0 {
+			return nil
+		}
+
+		return err
+	}
+}
+
+func (iterator *bgzfIterator) Next() bool {
+	if iterator.bufReader == nil {
+		return false
+	}
+
+	for {
+		if iterator.lineCount%contextCheckInterval == 0 && iterator.ctx.Err() != nil {
+			return iterator.stop(iterator.ctx.Err())
+		}
+		iterator.lineCount++
+
+		err := iterator.readLine()
+		if err == io.EOF {
+			return iterator.stop(nil)
+		} else if err != nil {
+			return iterator.stop(err)
+		}
+
+		// Skip all comments
+		if iterator.line[0] == '#' {
+			continue
+		}
+
+		err = iterator.parser.parse(iterator.line, &iterator.entry)
+		if err != nil {
+			return iterator.stop(fmt.Errorf("Problem parsing entry: %w", err))
+		}
+
+		// Check that the data fits in the requested window
+		if iterator.all || (iterator.query.Filter.Matches(&iterator.entry) && (iterator.entry.IsInRange(iterator.query) || iterator.entry.IsInRange(iterator.revQuery))) {
+			return true
+		}
+	}
+}
+
+// stop records the error and returns the reader to the pool, so that it is released even if Close is not called
+func (iterator *bgzfIterator) stop(err error) bool {
+	iterator.err = err
+	iterator.Close()
+
+	return false
+}
+
+func (iterator *bgzfIterator) Entry() *Entry {
+	return &iterator.entry
+}
+
+func (iterator *bgzfIterator) Err() error {
+	return iterator.err
+}
+
+func (iterator *bgzfIterator) Close() error {
+	if iterator.chunkReader != nil {
+		iterator.chunkReader.Close()
+		iterator.chunkReader = nil
+	}
+	if iterator.reader != nil {
+		iterator.file.readers <- iterator.reader
+		iterator.reader = nil
+	}
+	iterator.bufReader = nil
+
+	return nil
+}
+
+// memoryIterator steps through the candidate entries of a query held by a memoryFile
+type memoryIterator struct {
+	ctx context.Context
+
+	query    Query
+	revQuery Query
+	// Every entry is returned, rather than those within the query
+	all bool
+
+	candidates [][]Entry
+	count      int
+
+	entry Entry
+	err   error
+}
+
+// Iterate returns an Iterator over the entries within the query
+func (file *memoryFile) Iterate(ctx context.Context, query Query) (Iterator, error) {
+	iterator := &memoryIterator{ctx: ctx, query: query, revQuery: query.Reverse()}
+
+	if query.SourceChrom == query.TargetChrom {
+		iterator.candidates = append(iterator.candidates, file.entriesInRange(query.SourceChrom, query.TargetChrom,
+			min(query.SourceStart, query.TargetStart), max(query.SourceEnd, query.TargetEnd)))
+	} else {
+		iterator.candidates = append(iterator.candidates, file.entriesInRange(query.SourceChrom, query.TargetChrom, query.SourceStart, query.SourceEnd))
+		iterator.candidates = append(iterator.candidates, file.entriesInRange(query.TargetChrom, query.SourceChrom, query.TargetStart, query.TargetEnd))
+	}
+
+	return iterator, nil
+}
+
+// scan returns an Iterator over the entries of every chromosome pair
+func (file *memoryFile) scan(ctx context.Context) (Iterator, error) {
+	iterator := &memoryIterator{ctx: ctx, all: true}
+	for _, chromPair := range file.chromPairs {
+		iterator.candidates = append(iterator.candidates, file.entries[chromPair])
+	}
+
+	return iterator, nil
+}
+
+func (iterator *memoryIterator) Next() bool {
+	for len(iterator.candidates) > 0 {
+		entries := iterator.candidates[0]
+		if len(entries) == 0 {
+			iterator.candidates = iterator.candidates[1:]
+			continue
+		}
+
+		if iterator.count%contextCheckInterval == 0 && iterator.ctx.Err() != nil {
+			iterator.err = iterator.ctx.Err()
+			iterator.candidates = nil
+			return false
+		}
+		iterator.count++
+
+		entry := &entries[0]
+		iterator.candidates[0] = entries[1:]
+
+		if iterator.all || (iterator.query.Filter.Matches(entry) && (entry.IsInRange(iterator.query) || entry.IsInRange(iterator.revQuery))) {
+			// Copy the entry so that changes made by the caller don't affect the stored entries
+			iterator.entry = *entry
+			return true
+		}
+	}
+
+	return false
+}
+
+func (iterator *memoryIterator) Entry() *Entry {
+	return &iterator.entry
+}
+
+func (iterator *memoryIterator) Err() error {
+	return iterator.err
+}
+
+func (iterator *memoryIterator) Close() error {
+	iterator.candidates = nil
+
+	return nil
+}
@@ -0,0 +1,67 @@
+package pairs
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+func TestIterator(t *testing.T) {
+	entries := generateEntries(50000)
+	filename := filepath.Join(t.TempDir(), "test.pairs.gz")
+	writePairs(t, filename, entries)
+
+	var plain bytes.Buffer
+	writeEntries(&plain, entries)
+	plainFile, err := ParsePlain(&plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bgzfFile, err := ParseWithOptions(filename, Options{Readers: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bgzfFile.Close()
+
+	for _, pairsFile := range []File{plainFile, bgzfFile} {
+		for _, query := range testQueries {
+			iterator, err := pairsFile.Iterate(context.Background(), query)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			found := 0
+			var first *Entry
+			for iterator.Next() {
+				if first == nil {
+					first = iterator.Entry()
+				} else if iterator.Entry() != first {
+					t.Fatalf("%T: expected the entry to be reused", pairsFile)
+				}
+				found++
+			}
+			if err := iterator.Err(); err != nil {
+				t.Fatal(err)
+			}
+			iterator.Close()
+
+			if expected := countInRange(entries, query); found != expected {
+				t.Errorf("%T: query %v: expected %d entries, found %d", pairsFile, query, expected, found)
+			}
+		}
+
+		// Stop early, which must release the only reader
+		for i := 0; i < 3; i++ {
+			iterator, err := pairsFile.Iterate(context.Background(), testQueries[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !iterator.Next() {
+				t.Fatalf("%T: expected at least one entry", pairsFile)
+			}
+			iterator.Close()
+		}
+	}
+}
@@ -0,0 +1,340 @@
+package pairs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// LoopOptions control the pixels tested for enrichment and the local backgrounds they are compared to
+type LoopOptions struct {
+	// Range of distances between the bins of the pixels tested. Pixels closer to the diagonal than the window are
+	// never tested, as their backgrounds would cross the diagonal.
+	MinDistance uint64
+	MaxDistance uint64
+	// Half-width (in bins) of the peak excluded from the backgrounds, and of the backgrounds themselves
+	PeakWidth   int
+	WindowWidth int
+	// Maximum false discovery rate of the enriched pixels
+	FDR float64
+	// Minimum ratio of the count to the expected count of both backgrounds, and the minimum count, of an enriched pixel
+	MinEnrichment float64
+	MinCount      uint64
+	// Balance the counts with the weights when computing the expected counts, when not nil
+	Weights *BalanceWeights
+}
+
+// DefaultLoopOptions are the options commonly used at a resolution of 10 kb
+var DefaultLoopOptions = LoopOptions{MaxDistance: 2000000, PeakWidth: 2, WindowWidth: 5, FDR: 0.1, MinEnrichment: 1.5, MinCount: 5}
+
+// Loop is a cluster of adjacent enriched pixels, represented by the pixel with the lowest q-value
+type Loop struct {
+	Chrom  string
+	Start1 uint64
+	End1   uint64
+	Start2 uint64
+	End2   uint64
+	Count  uint64
+	// Expected counts of the pixel from the donut and lower-left backgrounds
+	ExpectedDonut     float64
+	ExpectedLowerLeft float64
+	// Ratio of the count to the larger expected count
+	Enrichment float64
+	PValue     float64
+	QValue     float64
+	// Number of enriched pixels in the cluster
+	Pixels int
+}
+
+// loopPixel is a pixel tested for enrichment
+type loopPixel struct {
+	bin1, bin2       int
+	count            uint64
+	donut, lowerLeft float64
+	pValue, qValue   float64
+	enrichment       float64
+}
+
+// CallLoops finds pixels of the binned intrachromosomal matrix with more contacts than expected from both their
+// donut and lower-left neighbourhoods (as in HiCCUPS). The expected count of a pixel is the expected contacts at its
+// distance, scaled by the ratio of the observed to the expected contacts of the neighbourhood. Pixels are tested with
+// a Poisson test, corrected for multiple testing with the Benjamini-Hochberg procedure and adjacent enriched pixels
+// are clustered into a single loop.
+func CallLoops(ctx context.Context, pairsFile File, chrom string, resolution uint64, options LoopOptions) ([]Loop, error) {
+	if resolution == 0 {
+		return nil, errors.New("Resolution must be greater than 0")
+	}
+	if options.PeakWidth < 0 || options.WindowWidth <= options.PeakWidth {
+		return nil, errors.New("Window width must be greater than the peak width")
+	}
+	if err := options.Weights.checkResolution(resolution); err != nil {
+		return nil, err
+	}
+
+	chromsize, ok := pairsFile.Chromsizes()[chrom]
+	if !ok {
+		return nil, fmt.Errorf("Unknown chromosome %s", chrom)
+	}
+
+	pixels, err := chromPairPixels(ctx, pairsFile, chromsize, chromsize, resolution)
+	if err != nil {
+		return nil, err
+	}
+
+	numBins := int(chromsize.Length/resolution + 1)
+	window, peak := options.WindowWidth, options.PeakWidth
+
+	minDistance := max(options.MinDistance/resolution, uint64(window+1))
+	maxDistance := min(options.MaxDistance/resolution, uint64(numBins-1))
+	if minDistance > maxDistance {
+		return nil, nil
+	}
+
+	weights := make([]float64, numBins)
+	for bin := range weights {
+		weights[bin] = 1
+		if options.Weights != nil {
+			weights[bin] = options.Weights.Weight(chrom, uint64(bin)*resolution)
+		}
+	}
+	// When the length is a multiple of the resolution, the last bin only holds the last position and is ignored
+	valid := func(bin int) bool {
+		return bin >= 0 && bin < numBins && uint64(bin)*resolution < chromsize.Length && !math.IsNaN(weights[bin])
+	}
+
+	// Only the band of the matrix that the backgrounds of the tested pixels reach is kept, indexed by the first bin
+	// and the distance
+	bandWidth := int(maxDistance) + 2*window + 1
+	counts := make([]uint32, numBins*bandWidth)
+	for _, pixel := range pixels {
+		if distance := int(pixel.bin2 - pixel.bin1); distance < bandWidth {
+			counts[int(pixel.bin1)*bandWidth+distance] = pixel.count
+		}
+	}
+
+	// The balanced value of the pixel (in either triangle), or NaN if it is outside the band or has a masked bin
+	value := func(bin1, bin2 int) float64 {
+		if bin1 > bin2 {
+			bin1, bin2 = bin2, bin1
+		}
+		if !valid(bin1) || !valid(bin2) || bin2-bin1 >= bandWidth {
+			return math.NaN()
+		}
+		return float64(counts[bin1*bandWidth+bin2-bin1]) * weights[bin1] * weights[bin2]
+	}
+
+	// Mean balanced value of each diagonal, and the number of tested pixels
+	expected := make([]float64, bandWidth)
+	var numTested int
+	for distance := range expected {
+		var pairs int
+		for bin := 0; bin+distance < numBins; bin++ {
+			if v := value(bin, bin+distance); !math.IsNaN(v) {
+				expected[distance] += v
+				pairs++
+			}
+		}
+		if pairs > 0 {
+			expected[distance] /= float64(pairs)
+		}
+		if uint64(distance) >= minDistance && uint64(distance) <= maxDistance {
+			numTested += pairs
+		}
+	}
+
+	// localExpected scales the expected value of the pixel by the ratio of observed to expected within the kernel
+	localExpected := func(bin1, bin2 int, inKernel func(x, y int) bool) float64 {
+		var sumObserved, sumExpected float64
+		for x := bin1 - window; x <= bin1+window; x++ {
+			for y := bin2 - window; y <= bin2+window; y++ {
+				if !inKernel(x, y) {
+					continue
+				}
+
+				v := value(x, y)
+				if math.IsNaN(v) {
+					continue
+				}
+
+				distance := y - x
+				if distance < 0 {
+					distance = -distance
+				}
+				sumObserved += v
+				sumExpected += expected[distance]
+			}
+		}
+		if sumExpected == 0 {
+			return 0
+		}
+
+		// Convert the balanced expected value back to a count
+		return expected[bin2-bin1] * sumObserved / sumExpected / (weights[bin1] * weights[bin2])
+	}
+
+	var tested []loopPixel
+	for bin1 := 0; bin1 < numBins; bin1++ {
+		if bin1%1000 == 0 && ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		for distance := int(minDistance); distance <= int(maxDistance) && bin1+distance < numBins; distance++ {
+			bin2 := bin1 + distance
+
+			count := uint64(counts[bin1*bandWidth+distance])
+			if count == 0 || count < options.MinCount || !valid(bin1) || !valid(bin2) {
+				continue
+			}
+
+			// The donut excludes the peak and the row and column of the pixel, the lower-left is the quadrant
+			// towards the diagonal without the peak
+			donut := localExpected(bin1, bin2, func(x, y int) bool {
+				return x != bin1 && y != bin2 && (abs(x-bin1) > peak || abs(y-bin2) > peak)
+			})
+			lowerLeft := localExpected(bin1, bin2, func(x, y int) bool {
+				return x > bin1 && y < bin2 && (x-bin1 > peak || bin2-y > peak)
+			})
+			if donut <= 0 || lowerLeft <= 0 {
+				continue
+			}
+
+			pixel := loopPixel{bin1: bin1, bin2: bin2, count: count, donut: donut, lowerLeft: lowerLeft}
+			pixel.pValue = math.Max(poissonSurvival(count, donut), poissonSurvival(count, lowerLeft))
+			pixel.enrichment = float64(count) / math.Max(donut, lowerLeft)
+			tested = append(tested, pixel)
+		}
+	}
+
+	// Benjamini-Hochberg over all pixels in range, where the pixels that weren't tested (such as those without
+	// contacts) have a p-value of 1
+	sort.Slice(tested, func(i, j int) bool { return tested[i].pValue < tested[j].pValue })
+	qValue := 1.0
+	for index := len(tested) - 1; index >= 0; index-- {
+		qValue = math.Min(qValue, tested[index].pValue*float64(numTested)/float64(index+1))
+		tested[index].qValue = qValue
+	}
+
+	enriched := make(map[[2]int]*loopPixel)
+	for index := range tested {
+		if tested[index].qValue <= options.FDR && tested[index].enrichment >= options.MinEnrichment {
+			enriched[[2]int{tested[index].bin1, tested[index].bin2}] = &tested[index]
+		}
+	}
+
+	return clusterLoops(chrom, chromsize.Length, resolution, tested, enriched), nil
+}
+
+// clusterLoops groups enriched pixels that touch (including diagonally) into loops, visiting the pixels in order of
+// their p-value so that each loop is represented by its most significant pixel
+func clusterLoops(chrom string, length uint64, resolution uint64, tested []loopPixel, enriched map[[2]int]*loopPixel) []Loop {
+	var loops []Loop
+	visited := make(map[[2]int]bool)
+
+	for index := range tested {
+		summit := &tested[index]
+		key := [2]int{summit.bin1, summit.bin2}
+		if enriched[key] == nil || visited[key] {
+			continue
+		}
+
+		// Flood fill the cluster from the summit
+		size := 0
+		stack := [][2]int{key}
+		visited[key] = true
+		for len(stack) > 0 {
+			current := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			size++
+
+			for dx := -1; dx <= 1; dx++ {
+				for dy := -1; dy <= 1; dy++ {
+					neighbour := [2]int{current[0] + dx, current[1] + dy}
+					if enriched[neighbour] != nil && !visited[neighbour] {
+						visited[neighbour] = true
+						stack = append(stack, neighbour)
+					}
+				}
+			}
+		}
+
+		start1, start2 := uint64(summit.bin1)*resolution, uint64(summit.bin2)*resolution
+		loops = append(loops, Loop{Chrom: chrom, Start1: start1, End1: min(start1+resolution, length),
+			Start2: start2, End2: min(start2+resolution, length), Count: summit.count,
+			ExpectedDonut: summit.donut, ExpectedLowerLeft: summit.lowerLeft, Enrichment: summit.enrichment,
+			PValue: summit.pValue, QValue: summit.qValue, Pixels: size})
+	}
+
+	sort.Slice(loops, func(i, j int) bool {
+		if loops[i].Start1 != loops[j].Start1 {
+			return loops[i].Start1 < loops[j].Start1
+		}
+		return loops[i].Start2 < loops[j].Start2
+	})
+
+	return loops
+}
+
+// poissonSurvival returns the probability of at least count events from a Poisson distribution with mean lambda,
+// which is the regularised lower incomplete gamma function P(count, lambda)
+func poissonSurvival(count uint64, lambda float64) float64 {
+	if count == 0 {
+		return 1
+	}
+	if lambda <= 0 {
+		return 0
+	}
+
+	a := float64(count)
+	logGamma, _ := math.Lgamma(a)
+	logPrefactor := a*math.Log(lambda) - lambda - logGamma
+
+	if lambda < a+1 {
+		// Series expansion of P
+		term := 1 / a
+		sum := term
+		for n := 1.0; n < 10000; n++ {
+			term *= lambda / (a + n)
+			sum += term
+			if term < sum*1e-15 {
+				break
+			}
+		}
+		return math.Min(1, sum*math.Exp(logPrefactor))
+	}
+
+	// Continued fraction (modified Lentz) for Q = 1 - P
+	const tiny = 1e-300
+	b := lambda + 1 - a
+	c := 1 / tiny
+	d := 1 / b
+	h := d
+	for n := 1.0; n < 10000; n++ {
+		an := -n * (n - a)
+		b += 2
+		d = an*d + b
+		if math.Abs(d) < tiny {
+			d = tiny
+		}
+		c = b + an/c
+		if math.Abs(c) < tiny {
+			c = tiny
+		}
+		d = 1 / d
+		delta := d * c
+		h *= delta
+		if math.Abs(delta-1) < 1e-15 {
+			break
+		}
+	}
+
+	return math.Max(0, 1-math.Exp(logPrefactor)*h)
+}
+
+func abs(value int) int {
+	if value < 0 {
+		return -value
+	}
+	return value
+}
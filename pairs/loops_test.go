@@ -0,0 +1,71 @@
+package pairs
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestLoops(t *testing.T) {
+	// Contacts decaying with distance, with extra contacts between two pairs of sites
+	const resolution = 10000
+	entries := generateDecayingEntries(200000, 1)
+	random := rand.New(rand.NewSource(2))
+
+	// The second loop covers 2 x 2 pixels, which should be clustered
+	loops := [][2]uint64{{500000, 900000}, {1200000, 1500000}}
+	widths := []int64{resolution, 2 * resolution}
+	for index, loop := range loops {
+		for count := 0; count < 400; count++ {
+			entries = append(entries, &Entry{SourceChrom: "chr1", SourcePosition: loop[0] + uint64(random.Int63n(widths[index])),
+				TargetChrom: "chr1", TargetPosition: loop[1] + uint64(random.Int63n(widths[index]))})
+		}
+	}
+
+	var plain bytes.Buffer
+	writeEntries(&plain, entries)
+	pairsFile, err := ParsePlain(&plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	options := DefaultLoopOptions
+	options.FDR = 0.01
+	called, err := CallLoops(context.Background(), pairsFile, "chr1", resolution, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(called) != len(loops) {
+		t.Fatalf("Expected %d loops, got %v", len(loops), called)
+	}
+	for index, loop := range called {
+		if loop.Start1 < loops[index][0] || loop.Start1 >= loops[index][0]+uint64(widths[index]) ||
+			loop.Start2 < loops[index][1] || loop.Start2 >= loops[index][1]+uint64(widths[index]) {
+			t.Errorf("Expected loop at %d-%d, got %d-%d", loops[index][0], loops[index][1], loop.Start1, loop.Start2)
+		}
+		if loop.QValue > options.FDR || loop.Enrichment < options.MinEnrichment {
+			t.Errorf("Unexpected loop %+v", loop)
+		}
+	}
+	if called[0].Pixels != 1 || called[1].Pixels < 2 {
+		t.Errorf("Expected clusters of 1 and at least 2 pixels, got %d and %d", called[0].Pixels, called[1].Pixels)
+	}
+
+	// The Poisson tail against sums of the probability mass function
+	for _, test := range []struct {
+		count  uint64
+		lambda float64
+	}{{0, 3}, {1, 0.5}, {5, 2}, {3, 10}, {40, 10}, {100, 120}} {
+		var cdf float64
+		for k := uint64(0); k < test.count; k++ {
+			logGamma, _ := math.Lgamma(float64(k + 1))
+			cdf += math.Exp(float64(k)*math.Log(test.lambda) - test.lambda - logGamma)
+		}
+		if survival := poissonSurvival(test.count, test.lambda); math.Abs(survival-(1-cdf)) > 1e-9 {
+			t.Errorf("P(X >= %d | %f): expected %g, got %g", test.count, test.lambda, 1-cdf, survival)
+		}
+	}
+}
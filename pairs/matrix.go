@@ -0,0 +1,657 @@
+package pairs
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"time"
+)
+
+// The binned matrix file stores the number of entries in each pair of bins for every chromosome pair at several
+// resolutions, so that zoomed out images don't have to read every entry. All values are little endian.
+//
+//	magic          [8]byte  "V3CMTX\x00\x01"
+//	matrices       for each resolution and chromosome pair (upper triangle, in chromosome order):
+//	  rowOffsets   [numRows + 1]uint64  index of the first pixel of each row (first bin)
+//	  pixels       [numPixels]{bin2 uint32, count uint32}  sorted by first bin and then bin2
+//	footer
+//	  resolutions  uint32 count, then uint64 each
+//	  chromosomes  uint32 count, then for each: uint32 name length, name, uint64 length
+//	  matrices     uint32 count, then matrixDetails each
+//	footerOffset   int64
+//
+// Cis matrices only store the upper triangle (bin1 <= bin2).
+
+var matrixMagic = [8]byte{'V', '3', 'C', 'M', 'T', 'X', 0, 1}
+
+// Resolutions (bin sizes) stored when none are specified
+var DefaultResolutions = []uint64{10000, 20000, 50000, 100000, 200000, 500000, 1000000, 2000000}
+
+// MatrixFilename returns the location of the binned matrix accompanying the pairs file
+func MatrixFilename(filename string) string {
+	return filename + ".v3cm"
+}
+
+type matrixDetails struct {
+	Resolution uint64
+	Chrom1     uint32
+	Chrom2     uint32
+	NumRows    uint64
+	RowOffsets int64
+	Pixels     int64
+	NumPixels  uint64
+	// Total number of entries in the matrix
+	Sum uint64
+}
+
+type matrixPixel struct {
+	bin1  uint32
+	bin2  uint32
+	count uint32
+}
+
+// Matrix provides access to a binned matrix file. Pixels are read from the file when requested, so a Matrix
+// uses little memory and can be used by concurrent queries.
+type Matrix struct {
+	file *os.File
+
+	resolutions []uint64
+	chromosomes []Chromsize
+	chromIndex  map[string]uint32
+
+	matrices map[matrixKey]matrixDetails
+}
+
+type matrixKey struct {
+	resolution uint64
+	chrom1     uint32
+	chrom2     uint32
+}
+
+// Resolutions lists the bin sizes stored in the matrix, from smallest to largest
+func (matrix *Matrix) Resolutions() []uint64 {
+	return matrix.resolutions
+}
+
+func (matrix *Matrix) Close() {
+	matrix.file.Close()
+}
+
+// details returns the matrix of the chromosome pair at the resolution, and whether the chromosomes are
+// stored in the opposite order
+func (matrix *Matrix) details(resolution uint64, sourceChrom, targetChrom string) (matrixDetails, bool, bool) {
+	source, ok := matrix.chromIndex[sourceChrom]
+	if !ok {
+		return matrixDetails{}, false, false
+	}
+	target, ok := matrix.chromIndex[targetChrom]
+	if !ok {
+		return matrixDetails{}, false, false
+	}
+
+	swapped := source > target
+	if swapped {
+		source, target = target, source
+	}
+
+	details, ok := matrix.matrices[matrixKey{resolution: resolution, chrom1: source, chrom2: target}]
+
+	return details, swapped, ok
+}
+
+// resolutionFor returns the largest resolution at which every bin is either entirely within or outside of the
+// query and within a single pixel of the image, so the image is the same as binning the entries
+func (matrix *Matrix) resolutionFor(query Query, viewQuery Query, binSizeX, binSizeY uint64) (uint64, bool) {
+	lengths := make(map[string]uint64)
+	for _, chrom := range []string{query.SourceChrom, query.TargetChrom, viewQuery.SourceChrom, viewQuery.TargetChrom} {
+		index, ok := matrix.chromIndex[chrom]
+		if !ok {
+			return 0, false
+		}
+		lengths[chrom] = matrix.chromosomes[index].Length
+	}
+
+	for index := len(matrix.resolutions) - 1; index >= 0; index-- {
+		resolution := matrix.resolutions[index]
+
+		// A boundary is at the start of a bin, or past the end of the chromosome. The end of the query is
+		// inclusive, so the boundary is the position after it.
+		aligned := func(boundary uint64, chrom string) bool {
+			return boundary%resolution == 0 || boundary > lengths[chrom]
+		}
+
+		// The pixels start at a bin and cover a whole number of bins, or the first pixel covers the rest of the chromosome
+		pixelsAligned := func(start, binSize uint64, chrom string) bool {
+			return aligned(start, chrom) && (binSize%resolution == 0 || start+binSize > lengths[chrom])
+		}
+
+		if aligned(query.SourceStart, query.SourceChrom) && aligned(query.SourceEnd+1, query.SourceChrom) &&
+			aligned(query.TargetStart, query.TargetChrom) && aligned(query.TargetEnd+1, query.TargetChrom) &&
+			pixelsAligned(viewQuery.SourceStart, binSizeX, viewQuery.SourceChrom) && pixelsAligned(viewQuery.TargetStart, binSizeY, viewQuery.TargetChrom) {
+			return resolution, true
+		}
+	}
+
+	return 0, false
+}
+
+// readRows calls pixelFunction for every pixel with a first bin between startRow and endRow (inclusive)
+func (matrix *Matrix) readRows(ctx context.Context, details matrixDetails, startRow, endRow uint64, pixelFunction func(bin1, bin2 uint64, count uint32)) error {
+	if details.NumRows == 0 || startRow >= details.NumRows {
+		return nil
+	}
+	endRow = min(endRow, details.NumRows-1)
+
+	offsets := make([]uint64, endRow-startRow+2)
+	err := binary.Read(io.NewSectionReader(matrix.file, details.RowOffsets+int64(startRow)*8, int64(len(offsets))*8), binary.LittleEndian, offsets)
+	if err != nil {
+		return err
+	}
+
+	pixels := io.NewSectionReader(matrix.file, details.Pixels+int64(offsets[0])*8, int64(offsets[len(offsets)-1]-offsets[0])*8)
+	reader := bufio.NewReaderSize(pixels, 1<<16)
+
+	var pixel [8]byte
+	for row := startRow; row <= endRow; row++ {
+		if row%contextCheckInterval == 0 && ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		for index := offsets[row-startRow]; index < offsets[row-startRow+1]; index++ {
+			if _, err := io.ReadFull(reader, pixel[:]); err != nil {
+				return err
+			}
+
+			pixelFunction(row, uint64(binary.LittleEndian.Uint32(pixel[0:4])), binary.LittleEndian.Uint32(pixel[4:8]))
+		}
+	}
+
+	return nil
+}
+
+// image creates the image from the coarsest resolution that lines up with the query and the pixels of the image.
+// False is returned when the matrix can't be used, because the query filters entries, no resolution lines up or
+// the chromosomes are unknown.
+func (matrix *Matrix) image(ctx context.Context, query Query, viewQuery Query, binSizeX uint64, binSizeY uint64) (Image, bool, error) {
+	// The matrix includes all entries, so can't be used when filtering
+	if query.Filter != nil || query.FilterDistance > 0 {
+		return Image{}, false, nil
+	}
+
+	resolution, ok := matrix.resolutionFor(query, viewQuery, binSizeX, binSizeY)
+	if !ok {
+		return Image{}, false, nil
+	}
+
+	details, swapped, ok := matrix.details(resolution, query.SourceChrom, query.TargetChrom)
+	if !ok {
+		return Image{}, false, nil
+	}
+
+	// Rows are the bins of the first chromosome of the stored matrix
+	startRow, endRow := query.SourceStart/resolution, query.SourceEnd/resolution
+	if query.SourceChrom == query.TargetChrom {
+		startRow, endRow = min(query.SourceStart, query.TargetStart)/resolution, max(query.SourceEnd, query.TargetEnd)/resolution
+	} else if swapped {
+		startRow, endRow = query.TargetStart/resolution, query.TargetEnd/resolution
+	}
+
+	image, err := binnedImage(query, viewQuery, binSizeX, binSizeY, resolution, swapped, fmt.Sprintf("the %d bp matrix", resolution),
+		func(pixelFunction func(bin1, bin2 uint64, count uint32)) error {
+			return matrix.readRows(ctx, details, startRow, endRow, pixelFunction)
+		})
+
+	return image, true, err
+}
+
+// binnedImage creates an image from binned data at the resolution. forEachPixel must call pixelFunction with
+// the bins on the first and second chromosome of the stored data (swapped if the query is in the opposite order)
+// and the number of entries of each pixel that may be within the query.
+func binnedImage(query Query, viewQuery Query, binSizeX uint64, binSizeY uint64, resolution uint64, swapped bool, source string,
+	forEachPixel func(pixelFunction func(bin1, bin2 uint64, count uint32)) error) (Image, error) {
+	start := time.Now()
+
+	numBinsX := uint32(math.Ceil(float64(viewQuery.SourceEnd-viewQuery.SourceStart) / float64(binSizeX)))
+	numBinsY := uint32(math.Ceil(float64(viewQuery.TargetEnd-viewQuery.TargetStart) / float64(binSizeY)))
+
+	imageData := make([]uint32, numBinsX*numBinsY)
+
+	addToImage := func(x, y uint64, count uint32) {
+		if x < viewQuery.SourceStart || y < viewQuery.TargetStart {
+			return
+		}
+
+		xPos := (x - viewQuery.SourceStart) / binSizeX
+		yPos := (y - viewQuery.TargetStart) / binSizeY
+		if xPos < uint64(numBinsX) && yPos < uint64(numBinsY) {
+			imageData[yPos*uint64(numBinsX)+xPos] += count
+		}
+	}
+
+	sameChrom := query.SourceChrom == query.TargetChrom
+	revQuery := query.Reverse()
+
+	pixelCount := 0
+	err := forEachPixel(func(bin1, bin2 uint64, count uint32) {
+		// Treat the entries of each pixel as if they were at the centre of the pixel
+		entry := Entry{SourceChrom: query.SourceChrom, TargetChrom: query.TargetChrom,
+			SourcePosition: bin1*resolution + resolution/2, TargetPosition: bin2*resolution + resolution/2}
+		if swapped || (sameChrom && entry.SourcePosition > entry.TargetPosition) {
+			entry.SourcePosition, entry.TargetPosition = entry.TargetPosition, entry.SourcePosition
+		}
+
+		if !entry.IsInRange(query) && !entry.IsInRange(revQuery) {
+			return
+		}
+
+		pixelCount++
+		addToImage(entry.SourcePosition, entry.TargetPosition, count)
+
+		// Check if reverse is within view, as we only store diagonal
+		if sameChrom {
+			addToImage(entry.TargetPosition, entry.SourcePosition, count)
+		}
+	})
+
+	log.Printf("Image query finished using %s, having processed %d pixels, taking %s\n", source, pixelCount, time.Since(start))
+
+	return Image{Width: numBinsX, Height: numBinsY, Data: imageData}, err
+}
+
+// OpenMatrix reads the footer of a binned matrix file created by BuildMatrix
+func OpenMatrix(filename string) (*Matrix, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	matrix := &Matrix{file: file, chromIndex: make(map[string]uint32), matrices: make(map[matrixKey]matrixDetails)}
+
+	err = matrix.readFooter()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("Invalid matrix file %s: %w", filename, err)
+	}
+
+	return matrix, nil
+}
+
+func (matrix *Matrix) readFooter() error {
+	var magic [8]byte
+	if _, err := matrix.file.ReadAt(magic[:], 0); err != nil {
+		return err
+	}
+	if magic != matrixMagic {
+		return errors.New("unexpected magic")
+	}
+
+	info, err := matrix.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	var footerOffset int64
+	err = binary.Read(io.NewSectionReader(matrix.file, info.Size()-8, 8), binary.LittleEndian, &footerOffset)
+	if err != nil {
+		return err
+	}
+	if footerOffset < int64(len(magic)) || footerOffset > info.Size()-8 {
+		return errors.New("footer offset out of range")
+	}
+
+	reader := bufio.NewReader(io.NewSectionReader(matrix.file, footerOffset, info.Size()-8-footerOffset))
+
+	var count uint32
+	if err := binary.Read(reader, binary.LittleEndian, &count); err != nil {
+		return err
+	}
+	matrix.resolutions = make([]uint64, count)
+	if err := binary.Read(reader, binary.LittleEndian, matrix.resolutions); err != nil {
+		return err
+	}
+
+	if err := binary.Read(reader, binary.LittleEndian, &count); err != nil {
+		return err
+	}
+	for index := uint32(0); index < count; index++ {
+		var nameLength uint32
+		if err := binary.Read(reader, binary.LittleEndian, &nameLength); err != nil {
+			return err
+		}
+		name := make([]byte, nameLength)
+		if _, err := io.ReadFull(reader, name); err != nil {
+			return err
+		}
+
+		chromsize := Chromsize{Name: string(name)}
+		if err := binary.Read(reader, binary.LittleEndian, &chromsize.Length); err != nil {
+			return err
+		}
+
+		matrix.chromIndex[chromsize.Name] = index
+		matrix.chromosomes = append(matrix.chromosomes, chromsize)
+	}
+
+	if err := binary.Read(reader, binary.LittleEndian, &count); err != nil {
+		return err
+	}
+	for index := uint32(0); index < count; index++ {
+		var details matrixDetails
+		if err := binary.Read(reader, binary.LittleEndian, &details); err != nil {
+			return err
+		}
+
+		matrix.matrices[matrixKey{resolution: details.Resolution, chrom1: details.Chrom1, chrom2: details.Chrom2}] = details
+	}
+
+	return nil
+}
+
+// countingWriter keeps track of the current offset in the file being written
+type countingWriter struct {
+	writer io.Writer
+	offset int64
+}
+
+func (writer *countingWriter) Write(p []byte) (int, error) {
+	n, err := writer.writer.Write(p)
+	writer.offset += int64(n)
+
+	return n, err
+}
+
+// countPixels bins all entries of the chromosome pair, with the first bin on the source chromosome
+func countPixels(ctx context.Context, pairsFile File, source, target Chromsize, resolution uint64) ([]matrixPixel, error) {
+	iterator, err := pairsFile.Iterate(ctx, Query{SourceChrom: source.Name, SourceStart: 0, SourceEnd: source.Length,
+		TargetChrom: target.Name, TargetStart: 0, TargetEnd: target.Length})
+	if err != nil {
+		return nil, err
+	}
+	defer iterator.Close()
+
+	counts := make(map[uint64]uint32)
+	for iterator.Next() {
+		entry := iterator.Entry()
+
+		bin1, bin2 := entry.SourcePosition/resolution, entry.TargetPosition/resolution
+		if entry.SourceChrom != source.Name || (source.Name == target.Name && bin1 > bin2) {
+			bin1, bin2 = bin2, bin1
+		}
+
+		counts[bin1<<32|bin2]++
+	}
+	if err := iterator.Err(); err != nil {
+		return nil, err
+	}
+
+	return pixelsFromCounts(counts), nil
+}
+
+// binResolutions lists the resolutions of the binned matrix, if it has been loaded
+func (file *bgzfFile) binResolutions() []uint64 {
+	if matrix := file.loadedMatrix(); matrix != nil {
+		return matrix.Resolutions()
+	}
+
+	return nil
+}
+
+// binnedPixels reads the pixels of the chromosome pair from the binned matrix
+func (file *bgzfFile) binnedPixels(ctx context.Context, source, target Chromsize, resolution uint64, pixelFunction func(bin1, bin2 uint64, count uint32)) (bool, error) {
+	matrix := file.loadedMatrix()
+	if matrix == nil {
+		return false, nil
+	}
+
+	details, swapped, ok := matrix.details(resolution, source.Name, target.Name)
+	if !ok {
+		return false, nil
+	}
+
+	return true, matrix.readRows(ctx, details, 0, details.NumRows, func(bin1, bin2 uint64, count uint32) {
+		if swapped {
+			bin1, bin2 = bin2, bin1
+		}
+		pixelFunction(bin1, bin2, count)
+	})
+}
+
+// pixelsFromCounts converts counts keyed by bin1<<32|bin2 into sorted pixels
+func pixelsFromCounts(counts map[uint64]uint32) []matrixPixel {
+	pixels := make([]matrixPixel, 0, len(counts))
+	for key, count := range counts {
+		pixels = append(pixels, matrixPixel{bin1: uint32(key >> 32), bin2: uint32(key), count: count})
+	}
+
+	sortPixels(pixels)
+
+	return pixels
+}
+
+// chromPairPixels returns the binned counts of the whole chromosome pair at the resolution, with the first bin on
+// the source chromosome and, for intrachromosomal data, only the upper triangle. Binned data stored with the file
+// is used when available at the resolution, otherwise all entries are read.
+func chromPairPixels(ctx context.Context, pairsFile File, source, target Chromsize, resolution uint64) ([]matrixPixel, error) {
+	var pixels []matrixPixel
+	addPixel := func(bin1, bin2 uint64, count uint32) {
+		if source.Name == target.Name && bin1 > bin2 {
+			bin1, bin2 = bin2, bin1
+		}
+		pixels = append(pixels, matrixPixel{bin1: uint32(bin1), bin2: uint32(bin2), count: count})
+	}
+
+	if binned, ok := pairsFile.(binnedFile); ok {
+		stored, err := binned.binnedPixels(ctx, source, target, resolution, addPixel)
+		if stored || err != nil {
+			return pixels, err
+		}
+	}
+
+	return countPixels(ctx, pairsFile, source, target, resolution)
+}
+
+func sortPixels(pixels []matrixPixel) {
+	sort.Slice(pixels, func(i, j int) bool {
+		return pixels[i].bin1 < pixels[j].bin1 || (pixels[i].bin1 == pixels[j].bin1 && pixels[i].bin2 < pixels[j].bin2)
+	})
+}
+
+// rebinPixels combines each factor x factor block of pixels into a single pixel
+func rebinPixels(pixels []matrixPixel, factor uint32) []matrixPixel {
+	counts := make(map[uint64]uint32)
+	for _, pixel := range pixels {
+		counts[uint64(pixel.bin1/factor)<<32|uint64(pixel.bin2/factor)] += pixel.count
+	}
+
+	return pixelsFromCounts(counts)
+}
+
+// writeMatrix writes the row offsets and pixels of a single matrix
+func writeMatrix(writer *countingWriter, details *matrixDetails, pixels []matrixPixel) error {
+	for _, pixel := range pixels {
+		if uint64(pixel.bin1) >= details.NumRows {
+			details.NumRows = uint64(pixel.bin1) + 1
+		}
+	}
+
+	details.RowOffsets = writer.offset
+
+	var buf [8]byte
+	pixelIndex := 0
+	for row := uint64(0); row <= details.NumRows; row++ {
+		for pixelIndex < len(pixels) && uint64(pixels[pixelIndex].bin1) < row {
+			pixelIndex++
+		}
+
+		binary.LittleEndian.PutUint64(buf[:], uint64(pixelIndex))
+		if _, err := writer.Write(buf[:]); err != nil {
+			return err
+		}
+	}
+
+	details.Pixels = writer.offset
+	details.NumPixels = uint64(len(pixels))
+
+	for _, pixel := range pixels {
+		binary.LittleEndian.PutUint32(buf[0:4], pixel.bin2)
+		binary.LittleEndian.PutUint32(buf[4:8], pixel.count)
+		if _, err := writer.Write(buf[:]); err != nil {
+			return err
+		}
+
+		details.Sum += uint64(pixel.count)
+	}
+
+	return nil
+}
+
+// BuildMatrix bins all entries of the file at each of the resolutions, reading the file once, and writes them to
+// filename. Every
+// resolution must be a multiple of the smallest resolution. The file must have #chromsize: headers.
+func BuildMatrix(ctx context.Context, pairsFile File, filename string, resolutions []uint64) error {
+	if len(resolutions) == 0 {
+		resolutions = DefaultResolutions
+	}
+
+	resolutions = append([]uint64(nil), resolutions...)
+	sort.Slice(resolutions, func(i, j int) bool { return resolutions[i] < resolutions[j] })
+
+	for index, resolution := range resolutions {
+		if resolution == 0 || resolution%resolutions[0] != 0 {
+			return fmt.Errorf("Invalid resolution %d: resolutions must be multiples of the smallest resolution (%d)", resolution, resolutions[0])
+		}
+		if index > 0 && resolution == resolutions[index-1] {
+			return fmt.Errorf("Resolution %d specified more than once", resolution)
+		}
+	}
+
+	var chromosomes []Chromsize
+	for _, name := range pairsFile.Chromosomes() {
+		chromosomes = append(chromosomes, pairsFile.Chromsizes()[name])
+	}
+	if len(chromosomes) == 0 {
+		return errors.New("Unable to bin .pairs file without #chromsize: headers")
+	}
+
+	scanner, ok := pairsFile.(entryScanner)
+	if !ok {
+		return errors.New("Unable to bin a file without individual entries")
+	}
+
+	start := time.Now()
+
+	chromIndex := make(map[string]int)
+	for index, chromsize := range chromosomes {
+		chromIndex[chromsize.Name] = index
+	}
+
+	// Count the entries of every chromosome pair at the smallest resolution in a single pass over the file, with
+	// the chromosomes in order and only the upper triangle of intrachromosomal matrices
+	counts := make(map[[2]int]map[uint64]uint32)
+	iterator, err := scanner.scan(ctx)
+	if err != nil {
+		return err
+	}
+	err = forEachEntry(iterator, func(entry *Entry) {
+		source, sourceOK := chromIndex[entry.SourceChrom]
+		target, targetOK := chromIndex[entry.TargetChrom]
+		if !sourceOK || !targetOK {
+			return
+		}
+
+		bin1, bin2 := entry.SourcePosition/resolutions[0], entry.TargetPosition/resolutions[0]
+		if source > target || (source == target && bin1 > bin2) {
+			source, target = target, source
+			bin1, bin2 = bin2, bin1
+		}
+
+		pairCounts, ok := counts[[2]int{source, target}]
+		if !ok {
+			pairCounts = make(map[uint64]uint32)
+			counts[[2]int{source, target}] = pairCounts
+		}
+		pairCounts[bin1<<32|bin2]++
+	})
+	if err != nil {
+		return err
+	}
+
+	tmpFilename := filename + ".tmp"
+	outFile, err := os.Create(tmpFilename)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFilename)
+	defer outFile.Close()
+
+	bufWriter := bufio.NewWriterSize(outFile, 1<<20)
+	writer := &countingWriter{writer: bufWriter}
+
+	if _, err := writer.Write(matrixMagic[:]); err != nil {
+		return err
+	}
+
+	var matrices []matrixDetails
+	for source := range chromosomes {
+		for target := source; target < len(chromosomes); target++ {
+			pixels := pixelsFromCounts(counts[[2]int{source, target}])
+			delete(counts, [2]int{source, target})
+
+			for _, resolution := range resolutions {
+				binned := pixels
+				if resolution != resolutions[0] {
+					binned = rebinPixels(pixels, uint32(resolution/resolutions[0]))
+				}
+
+				details := matrixDetails{Resolution: resolution, Chrom1: uint32(source), Chrom2: uint32(target),
+					NumRows: chromosomes[source].Length/resolution + 1}
+
+				if err := writeMatrix(writer, &details, binned); err != nil {
+					return err
+				}
+
+				matrices = append(matrices, details)
+			}
+		}
+	}
+
+	// Write the footer
+	footerOffset := writer.offset
+
+	binary.Write(writer, binary.LittleEndian, uint32(len(resolutions)))
+	binary.Write(writer, binary.LittleEndian, resolutions)
+
+	binary.Write(writer, binary.LittleEndian, uint32(len(chromosomes)))
+	for _, chromsize := range chromosomes {
+		binary.Write(writer, binary.LittleEndian, uint32(len(chromsize.Name)))
+		writer.Write([]byte(chromsize.Name))
+		binary.Write(writer, binary.LittleEndian, chromsize.Length)
+	}
+
+	binary.Write(writer, binary.LittleEndian, uint32(len(matrices)))
+	for _, details := range matrices {
+		binary.Write(writer, binary.LittleEndian, details)
+	}
+
+	if err := binary.Write(writer, binary.LittleEndian, footerOffset); err != nil {
+		return err
+	}
+
+	if err := bufWriter.Flush(); err != nil {
+		return err
+	}
+	if err := outFile.Close(); err != nil {
+		return err
+	}
+
+	log.Printf("Binned matrix with %d resolutions written to %s in %s\n", len(resolutions), filename, time.Since(start))
+
+	return os.Rename(tmpFilename, filename)
+}
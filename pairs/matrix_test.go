@@ -0,0 +1,154 @@
+package pairs
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+func TestMatrix(t *testing.T) {
+	entries := generateEntries(50000)
+	filename := filepath.Join(t.TempDir(), "test.pairs.gz")
+	writePairs(t, filename, entries)
+
+	pairsFile, err := Parse(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = BuildMatrix(context.Background(), pairsFile, MatrixFilename(filename), []uint64{50000, 10000})
+	pairsFile.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := BuildMatrix(context.Background(), pairsFile, filepath.Join(t.TempDir(), "invalid"), []uint64{10000, 15000}); err == nil {
+		t.Errorf("Expected error when resolutions are not multiples of each other")
+	}
+
+	// The matrix is opened when it exists
+	pairsFile, err = Parse(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pairsFile.Close()
+
+	matrix := pairsFile.(*bgzfFile).loadedMatrix()
+	if matrix == nil {
+		t.Fatal("Matrix was not loaded")
+	}
+	if resolutions := matrix.Resolutions(); len(resolutions) != 2 || resolutions[0] != 10000 || resolutions[1] != 50000 {
+		t.Errorf("Unexpected resolutions %v", resolutions)
+	}
+
+	var plain bytes.Buffer
+	writeEntries(&plain, entries)
+	plainFile, err := ParsePlain(&plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := BuildMatrix(context.Background(), plainFile, filepath.Join(t.TempDir(), "default"), nil); err != nil {
+		t.Errorf("Unable to build matrix with the default resolutions: %v", err)
+	}
+
+	queries := []Query{
+		{SourceChrom: "chr1", SourceStart: 0, SourceEnd: 2000000, TargetChrom: "chr1", TargetStart: 0, TargetEnd: 2000000},
+		{SourceChrom: "chr1", SourceStart: 400000, SourceEnd: 1199999, TargetChrom: "chr1", TargetStart: 800000, TargetEnd: 2000000},
+		{SourceChrom: "chr1", SourceStart: 0, SourceEnd: 2000000, TargetChrom: "chr2", TargetStart: 0, TargetEnd: 1500000},
+		{SourceChrom: "chr2", SourceStart: 500000, SourceEnd: 1500000, TargetChrom: "chr1", TargetStart: 0, TargetEnd: 999999},
+	}
+
+	compare := func(query Query, binSizeX, binSizeY uint64, image Image) {
+		expected, err := plainFile.Image(query, query, binSizeX, binSizeY)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if image.Width != expected.Width || image.Height != expected.Height {
+			t.Fatalf("Query %v: expected %dx%d image, got %dx%d", query, expected.Width, expected.Height, image.Width, image.Height)
+		}
+		for index := range image.Data {
+			if image.Data[index] != expected.Data[index] {
+				t.Fatalf("Query %v (bin size %dx%d): pixel %d expected %d, got %d", query, binSizeX, binSizeY, index, expected.Data[index], image.Data[index])
+			}
+		}
+	}
+
+	// When the bins of the image line up with the bins of the matrix, the images must be identical
+	for _, binSize := range []uint64{20000, 40000, 200000} {
+		for _, query := range queries {
+			image, ok, err := matrix.image(context.Background(), query, query, binSize, binSize)
+			if err != nil || !ok {
+				t.Fatalf("Query %v: matrix not used (%v)", query, err)
+			}
+
+			compare(query, binSize, binSize, image)
+		}
+	}
+
+	// A single pixel covering the whole chromosome, as used when counting entries
+	whole := queries[0]
+	image, ok, err := matrix.image(context.Background(), whole, whole, 2000001, 2000001)
+	if err != nil || !ok {
+		t.Fatalf("Matrix not used for the whole chromosome (%v)", err)
+	}
+	compare(whole, 2000001, 2000001, image)
+
+	// Bins which would straddle the edge of the query or a pixel can't be answered from the matrix
+	unaligned := []struct {
+		query    Query
+		binSizeX uint64
+		binSizeY uint64
+	}{
+		{queries[0], 15000, 15000},
+		{queries[0], 40000, 25000},
+		{Query{SourceChrom: "chr1", SourceStart: 405000, SourceEnd: 1199999, TargetChrom: "chr1", TargetStart: 800000, TargetEnd: 2000000}, 40000, 40000},
+		{Query{SourceChrom: "chr1", SourceStart: 400000, SourceEnd: 1200000, TargetChrom: "chr1", TargetStart: 800000, TargetEnd: 2000000}, 40000, 40000},
+		{Query{SourceChrom: "chr1", SourceStart: 0, SourceEnd: 2000000, TargetChrom: "chr2", TargetStart: 5000, TargetEnd: 1500000}, 40000, 40000},
+	}
+	for _, test := range unaligned {
+		if _, ok, _ := matrix.image(context.Background(), test.query, test.query, test.binSizeX, test.binSizeY); ok {
+			t.Errorf("Query %v (bin size %dx%d): expected matrix not to be used", test.query, test.binSizeX, test.binSizeY)
+		}
+	}
+
+	// The largest resolution that lines up is used
+	if resolution, ok := matrix.resolutionFor(queries[0], queries[0], 200000, 200000); !ok || resolution != 50000 {
+		t.Errorf("Expected the 50000 bp resolution to be used, got %d", resolution)
+	}
+	if resolution, ok := matrix.resolutionFor(queries[0], queries[0], 20000, 20000); !ok || resolution != 10000 {
+		t.Errorf("Expected the 10000 bp resolution to be used, got %d", resolution)
+	}
+
+	// Filtered queries can't be answered from the matrix
+	filtered := queries[0]
+	filtered.Filter = &Filter{Orientations: []string{"+-"}}
+	if _, ok, _ := matrix.image(context.Background(), filtered, filtered, 200000, 200000); ok {
+		t.Errorf("Expected matrix not to be used when filtering")
+	}
+
+	// Pixels of whole chromosome pairs are read from the matrix, and must match binning the entries
+	for _, chromPair := range [][2]Chromsize{{testChromsizes[0], testChromsizes[0]}, {testChromsizes[0], testChromsizes[1]}, {testChromsizes[1], testChromsizes[0]}} {
+		expected, err := countPixels(context.Background(), plainFile, chromPair[0], chromPair[1], 50000)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pixels, err := chromPairPixels(context.Background(), pairsFile, chromPair[0], chromPair[1], 50000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sortPixels(pixels)
+
+		if len(pixels) != len(expected) {
+			t.Fatalf("%s-%s: expected %d pixels, got %d", chromPair[0].Name, chromPair[1].Name, len(expected), len(pixels))
+		}
+		for index := range pixels {
+			if pixels[index] != expected[index] {
+				t.Fatalf("%s-%s: pixel %d expected %v, got %v", chromPair[0].Name, chromPair[1].Name, index, expected[index], pixels[index])
+			}
+		}
+	}
+}
@@ -2,9 +2,10 @@ package pairs
 
 import (
 	"bufio"
+	"compress/gzip"
+	"context"
 	"encoding/binary"
 	"errors"
-	"fmt"
 	"image"
 	"image/color"
 	"image/png"
@@ -12,27 +13,53 @@ import (
 	"log"
 	"math"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	//"github.com/biogo/hts/bgzf"
 	"github.com/imbbLab/v3c-viz/pairs/bgzf"
+	"github.com/imbbLab/v3c-viz/pairs/bgzf/cache"
+	bgzfindex "github.com/imbbLab/v3c-viz/pairs/bgzf/index"
 )
 
 type Order int
 
 const (
+	// Sorted by chromosome pair, then by position (as required by pairix)
 	Chr1Chr2Pos1Pos2 Order = iota
+	// Sorted by first chromosome and position, with chromosome pairs interleaved
+	Chr1Pos1Chr2Pos2
 )
 
+func (order Order) String() string {
+	switch order {
+	case Chr1Pos1Chr2Pos2:
+		return "chr1-pos1-chr2-pos2"
+	default:
+		return "chr1-chr2-pos1-pos2"
+	}
+}
+
 type Shape int
 
 const (
 	UpperTriangle Shape = iota
+	LowerTriangle
 )
 
+func (shape Shape) String() string {
+	switch shape {
+	case LowerTriangle:
+		return "lower triangle"
+	default:
+		return "upper triangle"
+	}
+}
+
 type Chromsize struct {
 	Name   string
 	Length uint64
@@ -68,11 +95,61 @@ type File interface {
 
 	ChromPairList() []string
 	Search(pairsQuery Query) ([]*Entry, error)
+	// SearchContext is the same as Search, but stops reading and returns the context error when ctx is cancelled
+	SearchContext(ctx context.Context, pairsQuery Query) ([]*Entry, error)
 
 	Image(query Query, viewQuery Query, binSizeX uint64, binSizeY uint64) (Image, error)
+	// ImageContext is the same as Image, but stops reading and returns the context error when ctx is cancelled
+	ImageContext(ctx context.Context, query Query, viewQuery Query, binSizeX uint64, binSizeY uint64) (Image, error)
+
+	// Iterate returns an Iterator over the entries within the query, which must be closed after use
+	Iterate(ctx context.Context, query Query) (Iterator, error)
 
 	Chromsizes() map[string]Chromsize
 	Chromosomes() []string
+
+	// Columns lists the name of each column in the file
+	Columns() []string
+	// Header lists the records of the header of the file in the order they appear
+	Header() []HeaderRecord
+}
+
+// Files can also have optional capabilities, which are checked for where they are used
+
+// entryScanner is implemented by files that contain the individual entries, which can all be read in a single pass
+type entryScanner interface {
+	// scan returns an Iterator over every entry of the file
+	scan(ctx context.Context) (Iterator, error)
+}
+
+// binnedFile is implemented by files that store the number of entries in pairs of bins
+type binnedFile interface {
+	// binResolutions lists the resolutions of the stored bins, from smallest to largest
+	binResolutions() []uint64
+	// binnedPixels calls pixelFunction with the bins on the source and target chromosome and the number of
+	// entries of every stored pixel of the whole chromosome pair. False is returned when the resolution isn't stored.
+	binnedPixels(ctx context.Context, source, target Chromsize, resolution uint64, pixelFunction func(bin1, bin2 uint64, count uint32)) (bool, error)
+}
+
+// countEstimator is implemented by files that can estimate the number of entries of each chromosome pair without
+// reading them
+type countEstimator interface {
+	// estimateChromPairCounts returns false when no estimate is available
+	estimateChromPairCounts() ([]ChromPairCount, bool)
+}
+
+// hasEntries returns whether the file contains the individual entries, rather than only binned counts
+func hasEntries(pairsFile File) bool {
+	_, ok := pairsFile.(entryScanner)
+
+	return ok
+}
+
+// HeaderRecord is a line of the header of a .pairs file, such as "#chromsize: chr1 1000" with the key chromsize
+// and the value "chr1 1000". Lines without a value (no ':') only have a key.
+type HeaderRecord struct {
+	Key   string
+	Value string
 }
 
 func (file baseFile) Genome() string {
@@ -87,20 +164,34 @@ func (file baseFile) Chromsizes() map[string]Chromsize {
 	return file.chromsizes
 }
 
+func (file baseFile) Columns() []string {
+	return file.layout.names
+}
+
+func (file baseFile) Header() []HeaderRecord {
+	return file.header
+}
+
 type baseFile struct {
 	Sorted         Order
 	Shape          Shape
 	GenomeAssembly string
 	Samheader      []string
 
+	header []HeaderRecord
+
 	chromosomes []string
 	chromsizes  map[string]Chromsize
 
+	layout *columnLayout
+
 	file *os.File
 }
 
 func (file baseFile) Close() {
-	file.file.Close()
+	if file.file != nil {
+		file.file.Close()
+	}
 }
 
 func (file *baseFile) parseHeader(reader *bufio.Reader) (*Entry, error) {
@@ -108,7 +199,7 @@ func (file *baseFile) parseHeader(reader *bufio.Reader) (*Entry, error) {
 
 	firstLine, err := reader.ReadBytes('\n')
 	if err != nil {
-		fmt.Println("Failed to read from buffer")
+		log.Println("Failed to read from buffer")
 		return nil, err
 	}
 
@@ -116,31 +207,51 @@ func (file *baseFile) parseHeader(reader *bufio.Reader) (*Entry, error) {
 		return nil, errors.New("Invalid .pairs file: Missing header line. First line is: " + string(firstLine))
 	}
 
+	// The format line (## pairs format v1.0) is kept with the key format
+	file.header = append(file.header, HeaderRecord{Key: "format", Value: strings.TrimSpace(strings.TrimLeft(string(firstLine), "#"))})
+	file.layout = defaultColumnLayout
+
 	for {
 		lineData, err := reader.ReadBytes('\n')
-		if err != nil {
+		if err == io.EOF && len(lineData) == 0 {
+			// A file with a header but no entries is empty rather than invalid
+			return nil, nil
+		} else if err != nil && err != io.EOF {
 			return nil, err
 		}
 
-		lineToProcess := string(lineData[:len(lineData)-1])
+		lineToProcess := strings.TrimRight(string(lineData), "\r\n")
+		if lineToProcess == "" {
+			continue
+		}
 
 		if lineToProcess[0] == '#' {
 			splitString := strings.SplitN(lineToProcess[1:], ":", 2)
 
 			tag := strings.TrimSpace(splitString[0])
-			value := strings.TrimSpace(splitString[1])
+			value := ""
+			if len(splitString) > 1 {
+				value = strings.TrimSpace(splitString[1])
+			}
+			file.header = append(file.header, HeaderRecord{Key: tag, Value: value})
 
 			switch tag {
 			case "sorted":
-				if value == "chr1-chr2-pos1-pos2" {
+				switch value {
+				case "chr1-chr2-pos1-pos2":
 					file.Sorted = Chr1Chr2Pos1Pos2
-				} else {
+				case "chr1-pos1-chr2-pos2":
+					file.Sorted = Chr1Pos1Chr2Pos2
+				default:
 					return nil, errors.New("Unsupported .pairs file: not supported sorted: " + value)
 				}
 			case "shape":
-				if value == "upper triangle" {
+				switch value {
+				case "upper triangle":
 					file.Shape = UpperTriangle
-				} else {
+				case "lower triangle":
+					file.Shape = LowerTriangle
+				default:
 					return nil, errors.New("Unsupported .pairs file: not supported shape: " + value)
 				}
 			case "genome_assembly":
@@ -161,11 +272,14 @@ func (file *baseFile) parseHeader(reader *bufio.Reader) (*Entry, error) {
 				file.chromsizes[chromsize.Name] = chromsize
 			case "samheader":
 				file.Samheader = append(file.Samheader, value)
-			default:
-				fmt.Println(lineToProcess)
+			case "columns":
+				file.layout, err = newColumnLayout(strings.Fields(value))
+				if err != nil {
+					return nil, err
+				}
 			}
 		} else {
-			return parseEntry(lineToProcess)
+			return parseEntry(lineToProcess, file.layout)
 		}
 	}
 
@@ -190,7 +304,7 @@ func OutputImage(overviewImage []uint32, numBins int, name string) {
 	}
 
 	if maxValue > 100 {
-		fmt.Println(maxValue)
+		log.Println(maxValue)
 
 		img := image.NewGray(image.Rect(0, 0, numBins, numBins))
 		for y := 0; y < numBins; y++ {
@@ -206,40 +320,134 @@ func OutputImage(overviewImage []uint32, numBins int, name string) {
 
 }
 
+// Parse loads the .pairs file using DefaultOptions
 func Parse(filename string) (File, error) {
-	// TODO: Check which function to call, ParseBGZF or ParsePlain
-
-	// TODO: Check if .gz, if so then create gzip reader
-	/*gz, err := gzip.NewReader(file)
+	return ParseWithOptions(filename, DefaultOptions)
+}
 
+// ParseWithOptions loads the .pairs file, detecting whether it is bgzip compressed (and so can be
+// queried using a .px2 index), gzip compressed or plain text (both loaded into memory).
+func ParseWithOptions(filename string, options Options) (File, error) {
+	file, err := os.Open(filename)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+	defer file.Close()
+
+	bufReader := bufio.NewReader(file)
+	magic, err := bufReader.Peek(14)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	if isBGZF(magic) {
+		return ParseBGZF(filename, options)
 	}
 
-	defer gz.Close()*/
+	if isHic(magic) {
+		return ParseHic(filename)
+	}
+
+	if len(magic) >= 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		log.Println("Loading gzip compressed .pairs file into memory. Compress with bgzip to avoid this.")
+
+		gz, err := gzip.NewReader(bufReader)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+
+		return ParsePlain(gz)
+	}
+
+	log.Println("Loading plain text .pairs file into memory.")
 
-	return ParseBGZF(filename)
+	return ParsePlain(bufReader)
 }
 
+// isBGZF checks whether the header is a gzip header containing the BGZF extra subfield ('B', 'C')
+func isBGZF(header []byte) bool {
+	if len(header) < 14 {
+		return false
+	}
+
+	// gzip magic, deflate compression and FEXTRA flag
+	if header[0] != 0x1f || header[1] != 0x8b || header[2] != 8 || header[3]&4 == 0 {
+		return false
+	}
+
+	return header[12] == 'B' && header[13] == 'C'
+}
+
+// Options controls how bgzip compressed .pairs files are accessed
+type Options struct {
+	// Number of independent readers, and so the number of queries that can run concurrently
+	Readers int
+	// Number of decompressed BGZF blocks cached by each reader (0 disables caching). Cached blocks belong
+	// to the reader that decompressed them, so each reader has its own cache.
+	CacheBlocks int
+
+	// Build the binned matrix (see BuildMatrix) in the background when it doesn't exist or is older than the
+	// .pairs file, so that zoomed out images don't need to read every entry
+	BuildMatrix bool
+	// Resolutions of the binned matrix when it is built (DefaultResolutions if empty)
+	Resolutions []uint64
+}
+
+var DefaultOptions = Options{Readers: 4}
+
 type bgzfFile struct {
 	baseFile
 
-	bgzfReader *bgzf.Reader
+	// Pool of readers, each reading from its own section of the file so that they can seek independently
+	readers chan *bgzf.Reader
 
 	//index *BGZFIndex
 	index *indexHeader
 
-	mu sync.Mutex
+	// Binned matrix (*Matrix) used to answer Image queries, stored once it has been opened or built
+	matrix      atomic.Value
+	cancelBuild context.CancelFunc
+	building    sync.WaitGroup
 }
 
 //func (file bgzfFile) Index() Index {
 //	return file.index
 //}
 
+func (file *bgzfFile) newReader(options Options) (*bgzf.Reader, error) {
+	info, err := file.file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := bgzf.NewReader(io.NewSectionReader(file.file, 0, info.Size()), 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if options.CacheBlocks > 0 {
+		reader.SetCache(cache.NewLRU(options.CacheBlocks))
+	}
+
+	return reader, nil
+}
+
+// Close waits for any running queries to finish before closing the readers and file
 func (file *bgzfFile) Close() {
-	file.mu.Lock()
-	file.bgzfReader.Close()
-	file.mu.Unlock()
+	if file.cancelBuild != nil {
+		file.cancelBuild()
+	}
+	file.building.Wait()
+
+	if matrix := file.loadedMatrix(); matrix != nil {
+		matrix.Close()
+	}
+
+	for i := 0; i < cap(file.readers); i++ {
+		reader := <-file.readers
+		reader.Close()
+	}
 
 	file.baseFile.Close()
 }
@@ -254,108 +462,121 @@ func (file *bgzfFile) ChromPairList() []string {
 	return pairs
 }
 
-type fileChunk struct {
-	Start bgzf.Offset
-	End   bgzf.Offset
-}
-
 func (file *bgzfFile) Query(query Query, entryFunction func(entry *Entry)) error {
-	var err error
-
-	// Create the reverse query to make searching easier
-	revQuery := query.Reverse()
-	chunks := file.index.getChunksFromQuery(query)
+	return file.QueryContext(context.Background(), query, entryFunction)
+}
 
-	// Merge together chunks (skipping) they follow on from one another to
-	// avoid seeking, then read in necessary number of lines to find desired data points
-	//seekRequired := true
-	var bufReader *bufio.Reader
-	var lineData []byte
-	var entry *Entry
+// QueryContext calls entryFunction for every entry within the query, stopping early with the context error
+// when ctx is cancelled. The entry is reused after entryFunction returns.
+func (file *bgzfFile) QueryContext(ctx context.Context, query Query, entryFunction func(entry *Entry)) error {
+	iterator, err := file.Iterate(ctx, query)
+	if err != nil {
+		return err
+	}
 
-	//fmt.Printf("About to process chunks %v\n", chunks)
+	return forEachEntry(iterator, entryFunction)
+}
 
-	file.mu.Lock()
+func (file *bgzfFile) Search(query Query) ([]*Entry, error) {
+	return searchEntries(context.Background(), query, file.QueryContext)
+}
 
-	for _, chunk := range chunks {
-		defer func() {
-			if x := recover(); x != nil {
-				// recovering from a panic; x contains whatever was passed to panic()
-				log.Printf("run time panic: %v", x)
-				log.Printf("%v Start [%v]\n", chunk, file.bgzfReader)
+func (file *bgzfFile) SearchContext(ctx context.Context, query Query) ([]*Entry, error) {
+	return searchEntries(ctx, query, file.QueryContext)
+}
 
-				// if you just want to log the panic, panic again
-				panic(x)
-			}
-		}()
+func (file *bgzfFile) Image(query Query, viewQuery Query, binSizeX uint64, binSizeY uint64) (Image, error) {
+	return file.ImageContext(context.Background(), query, viewQuery, binSizeX, binSizeY)
+}
 
-		err = file.bgzfReader.Seek(chunk.Start)
-		if err != nil {
-			return err
+// ImageContext answers from the binned matrix when it is available and has a resolution that lines up with the
+// query and bin sizes, otherwise all entries within the query are read
+func (file *bgzfFile) ImageContext(ctx context.Context, query Query, viewQuery Query, binSizeX uint64, binSizeY uint64) (Image, error) {
+	if matrix := file.loadedMatrix(); matrix != nil {
+		if image, ok, err := matrix.image(ctx, query, viewQuery, binSizeX, binSizeY); ok {
+			return image, err
 		}
+	}
 
-		bufReader = bufio.NewReader(file.bgzfReader)
+	return imageEntries(ctx, query, viewQuery, binSizeX, binSizeY, file.QueryContext)
+}
 
-		finished := false
+func (file *bgzfFile) loadedMatrix() *Matrix {
+	matrix, _ := file.matrix.Load().(*Matrix)
 
-		// Skip the first partial line, this should be captured by the previous chunk
-		//lineData, err = bufReader.ReadBytes('\n')
-		//if err != nil {
-		//	return err
-		//}
+	return matrix
+}
 
-		for !finished {
-			lineData, err = bufReader.ReadBytes('\n')
-			if err != nil {
-				return err
+// loadMatrix opens the binned matrix of the file if it is up to date, or builds it in the background when requested
+func (file *bgzfFile) loadMatrix(filename string, options Options) {
+	matrixFilename := MatrixFilename(filename)
+
+	matrixInfo, err := os.Stat(matrixFilename)
+	if err == nil {
+		pairsInfo, err := file.file.Stat()
+		if err == nil && !matrixInfo.ModTime().Before(pairsInfo.ModTime()) {
+			matrix, err := OpenMatrix(matrixFilename)
+			if err == nil {
+				log.Printf("Using binned matrix %s (resolutions %v)\n", matrixFilename, matrix.Resolutions())
+				file.matrix.Store(matrix)
+				return
 			}
 
-			// Skip all comments
-			for lineData[0] == '#' {
-				lineData, err = bufReader.ReadBytes('\n')
-				if err != nil {
-					return err
-				}
-			}
+			log.Println(err)
+		} else {
+			log.Printf("Binned matrix %s is older than the .pairs file, so will not be used\n", matrixFilename)
+		}
+	}
 
-			entry, err = parseEntry(string(lineData))
-			if err != nil {
-				fmt.Printf("Problem parsing entry: %s\n", string(lineData))
-				return err
-			}
+	if !options.BuildMatrix {
+		return
+	}
 
-			// Check that the data fits in the requested window
-			if entry.IsInRange(query) || entry.IsInRange(revQuery) {
-				entryFunction(entry)
-			}
+	var ctx context.Context
+	ctx, file.cancelBuild = context.WithCancel(context.Background())
 
-			// If we've gone past the end of our query region, then stop
-			if file.bgzfReader.LastChunk().Begin.File > chunk.End.File {
-				finished = true
-				break
-			}
+	file.building.Add(1)
+	go func() {
+		defer file.building.Done()
+
+		log.Printf("Building binned matrix %s in the background...\n", matrixFilename)
+		err := BuildMatrix(ctx, file, matrixFilename, options.Resolutions)
+		if err != nil {
+			log.Printf("Unable to build binned matrix: %v\n", err)
+			return
 		}
-	}
 
-	file.mu.Unlock()
+		matrix, err := OpenMatrix(matrixFilename)
+		if err != nil {
+			log.Println(err)
+			return
+		}
 
-	return err
+		file.matrix.Store(matrix)
+	}()
 }
 
-func (file *bgzfFile) Search(query Query) ([]*Entry, error) {
+// Number of entries processed between checks of whether the context of a query has been cancelled
+const contextCheckInterval = 1024
+
+// queryFunction calls entryFunction for every entry within the query, until ctx is cancelled. The entry
+// passed to entryFunction may be reused once it returns.
+type queryFunction func(ctx context.Context, query Query, entryFunction func(entry *Entry)) error
+
+func searchEntries(ctx context.Context, query Query, queryEntries queryFunction) ([]*Entry, error) {
 	var err error
 
 	var pairs []*Entry
 
-	err = file.Query(query, func(entry *Entry) {
-		pairs = append(pairs, entry)
+	err = queryEntries(ctx, query, func(entry *Entry) {
+		pairs = append(pairs, entry.Clone())
 	})
 
 	return pairs, err
 }
 
-func (file *bgzfFile) Image(query Query, viewQuery Query, binSizeX uint64, binSizeY uint64) (Image, error) {
-	fmt.Printf("Processing Image query %v\n", query)
+func imageEntries(ctx context.Context, query Query, viewQuery Query, binSizeX uint64, binSizeY uint64, queryEntries queryFunction) (Image, error) {
+	log.Printf("Processing Image query %v\n", query)
 	start := time.Now()
 
 	numBinsX := uint32(math.Ceil(float64(viewQuery.SourceEnd-viewQuery.SourceStart) / float64(binSizeX)))
@@ -373,7 +594,7 @@ func (file *bgzfFile) Image(query Query, viewQuery Query, binSizeX uint64, binSi
 
 	pointCounter := 0
 
-	err := file.Query(query, func(entry *Entry) {
+	err := queryEntries(ctx, query, func(entry *Entry) {
 		pointCounter++
 		if entry.SourceChrom != query.SourceChrom {
 			xPos = int32(float64(entry.TargetPosition-viewQuery.SourceStart) / float64(binSizeX))
@@ -401,7 +622,7 @@ func (file *bgzfFile) Image(query Query, viewQuery Query, binSizeX uint64, binSi
 	})
 
 	elapsed := time.Since(start)
-	fmt.Printf("Image query finished having processed %d points, taking %s\n", pointCounter, elapsed)
+	log.Printf("Image query finished having processed %d points, taking %s\n", pointCounter, elapsed)
 
 	return Image{Width: numBinsX, Height: numBinsY, Data: imageData}, err
 }
@@ -476,95 +697,98 @@ type indexHeader struct {
 	//Index
 }
 
-func (index indexHeader) getChunksFromQuery(query Query) []fileChunk {
-	// TODO: Check validity of search (e.g. start < end)
-
-	var chunkstoLoad []fileChunk
-
-	chromPairName := query.SourceChrom + string(index.Conf.RegionSplitCharacter) + query.TargetChrom
-
-	if _, ok := index.BinIndex[chromPairName]; ok {
-		var startBin, endBin uint64
-		// PX2.002
-		if index.Magic[6] == 50 {
-			startBin = query.SourceStart >> TAD_LIDX_SHIFT_ORIGINAL
-			endBin = query.SourceEnd >> TAD_LIDX_SHIFT_ORIGINAL
-		} else {
-			startBin = query.SourceStart >> TAD_LIDX_SHIFT
-			endBin = query.SourceEnd >> TAD_LIDX_SHIFT
-		}
-		endBin += 1
+// is1D returns true when the index only uses the first chromosome as the sequence name (e.g. for
+// chr1-pos1-chr2-pos2 sorted files, where chromosome pairs are not stored contiguously)
+func (index indexHeader) is1D() bool {
+	return index.Conf.SeqCol2 == 0
+}
 
-		if endBin >= uint64(len(index.LinearIndex[chromPairName])) {
-			endBin = uint64(len(index.LinearIndex[chromPairName]) - 1)
-		}
+func (index indexHeader) linearShift() uint64 {
+	// PX2.002
+	if index.Magic[6] == 50 {
+		return TAD_LIDX_SHIFT_ORIGINAL
+	}
 
-		for ; index.LinearIndex[chromPairName][startBin] == 0; startBin++ {
-		}
+	return TAD_LIDX_SHIFT
+}
 
-		startLocation := index.LinearIndex[chromPairName][startBin]
-		endLocation := index.LinearIndex[chromPairName][endBin]
+func (index indexHeader) binLevels() []binLevel {
+	// PX2.002
+	if index.Magic[6] == 50 {
+		return px2OriginalBinLevels
+	}
 
-		startBlock := getBGZFOffset(startLocation)
-		endBlock := getBGZFOffset(endLocation)
+	return px2BinLevels
+}
 
-		chunkstoLoad = append(chunkstoLoad, fileChunk{Start: startBlock, End: endBlock})
+// chunkMergeStrategy merges chunks which overlap or start within the same compressed block as the previous
+// chunk ends, so that each block is only decompressed once per query
+var chunkMergeStrategy = bgzfindex.CompressorStrategy(0)
+
+// getChunks uses the bin index to find the chunks of the file that can contain entries of the sequence with a
+// first position between start and end (inclusive). Chunks which end before the first entry of the window
+// containing start (taken from the linear index) are skipped.
+func (index indexHeader) getChunks(sequenceName string, start, end uint64) []bgzf.Chunk {
+	bins, ok := index.BinIndex[sequenceName]
+	if !ok || start > end {
+		return nil
 	}
 
-	if query.TargetChrom == query.SourceChrom {
-		return chunkstoLoad
+	// Positions in .pairs files are 1-based, whereas bins cover 0-based half open intervals
+	if start > 0 {
+		start--
 	}
 
-	// Process the inverse chrom pair
-	chromPairName = query.TargetChrom + string(index.Conf.RegionSplitCharacter) + query.SourceChrom
-
-	if _, ok := index.BinIndex[chromPairName]; ok {
-		startBin := query.TargetStart >> TAD_LIDX_SHIFT
-		endBin := query.TargetEnd >> TAD_LIDX_SHIFT
-		endBin += 1
+	var minOffset uint64
+	if linearIndex := index.LinearIndex[sequenceName]; len(linearIndex) > 0 {
+		window := min(start>>index.linearShift(), uint64(len(linearIndex)-1))
+		minOffset = linearIndex[window]
+	}
 
-		if endBin >= uint64(len(index.LinearIndex[chromPairName])) {
-			endBin = uint64(len(index.LinearIndex[chromPairName]) - 1)
+	var chunks []bgzf.Chunk
+	for _, bin := range reg2bins(start, end, index.binLevels()) {
+		for _, chunk := range bins[bin].Chunks {
+			if chunk.ChunkEnd > minOffset {
+				chunks = append(chunks, bgzf.Chunk{Begin: getBGZFOffset(chunk.ChunkBegin), End: getBGZFOffset(chunk.ChunkEnd)})
+			}
 		}
+	}
 
-		for ; index.LinearIndex[chromPairName][startBin] == 0; startBin++ {
-		}
+	return chunks
+}
 
-		startLocation := index.LinearIndex[chromPairName][startBin]
-		endLocation := index.LinearIndex[chromPairName][endBin]
+func (index indexHeader) getChunksFromQuery(query Query, shape Shape) []bgzf.Chunk {
+	var chunkstoLoad []bgzf.Chunk
 
-		startBlock := getBGZFOffset(startLocation)
-		endBlock := getBGZFOffset(endLocation)
+	addChunks := func(sequenceName string, start, end uint64) {
+		chunkstoLoad = append(chunkstoLoad, index.getChunks(sequenceName, start, end)...)
+	}
 
-		newChunk := fileChunk{Start: startBlock, End: endBlock}
+	sourceName := query.SourceChrom
+	targetName := query.TargetChrom
+	if !index.is1D() {
+		sourceName = query.SourceChrom + string(index.Conf.RegionSplitCharacter) + query.TargetChrom
+		targetName = query.TargetChrom + string(index.Conf.RegionSplitCharacter) + query.SourceChrom
+	}
 
-		if len(chunkstoLoad) == 0 {
-			chunkstoLoad = append(chunkstoLoad, newChunk)
+	if query.SourceChrom == query.TargetChrom {
+		// The first position is the smaller of the two when stored as the upper triangle, and the larger otherwise
+		if shape == LowerTriangle {
+			addChunks(sourceName, max(query.SourceStart, query.TargetStart), max(query.SourceEnd, query.TargetEnd))
 		} else {
-			updated := false
-			if newChunk.Start.File <= chunkstoLoad[0].Start.File && (newChunk.End.File >= chunkstoLoad[0].Start.File && newChunk.Start.File <= chunkstoLoad[0].End.File) {
-				chunkstoLoad[0].Start = newChunk.Start
-				updated = true
-			}
-			if newChunk.End.File >= chunkstoLoad[0].End.File && (newChunk.Start.File >= chunkstoLoad[0].End.File && newChunk.End.File <= chunkstoLoad[0].Start.File) {
-				chunkstoLoad[0].End = newChunk.End
-				updated = true
-			}
-
-			if !updated {
-				chunkstoLoad = append(chunkstoLoad, newChunk)
-			}
+			addChunks(sourceName, min(query.SourceStart, query.TargetStart), min(query.SourceEnd, query.TargetEnd))
 		}
+	} else {
+		addChunks(sourceName, query.SourceStart, query.SourceEnd)
+		addChunks(targetName, query.TargetStart, query.TargetEnd)
 	}
 
-	fmt.Println(chunkstoLoad)
-
-	// // Sort the chunks to load by File position
-	// sort.Slice(chunkstoLoad, func(i, j int) bool {
-	// 	return chunkstoLoad[i].StartChunk.Begin.File < chunkstoLoad[j].StartChunk.Begin.File
-	// })
+	// Sort the chunks to load by file position and merge those that overlap to avoid reading the same data twice
+	sort.Slice(chunkstoLoad, func(i, j int) bool {
+		return toVirtualOffset(chunkstoLoad[i].Begin) < toVirtualOffset(chunkstoLoad[j].Begin)
+	})
 
-	return chunkstoLoad
+	return chunkMergeStrategy(chunkstoLoad)
 }
 
 type binDetails struct {
@@ -584,6 +808,7 @@ func ParseIndex(filename string) (*indexHeader, error) {
 	if err != nil {
 		return nil, err
 	}
+	defer indexFile.Close()
 
 	indexReader, err := bgzf.NewReader(indexFile, 0)
 	if err != nil {
@@ -722,7 +947,7 @@ func getBGZFOffset(location uint64) bgzf.Offset {
 const TAD_LIDX_SHIFT = 15
 const TAD_LIDX_SHIFT_ORIGINAL = 14
 
-func ParseBGZF(filename string) (File, error) {
+func ParseBGZF(filename string, options Options) (File, error) {
 
 	var err error
 	var pairsFile bgzfFile
@@ -732,28 +957,62 @@ func ParseBGZF(filename string) (File, error) {
 		return nil, err
 	}
 
-	pairsFile.bgzfReader, err = bgzf.NewReader(pairsFile.file, 0)
-	if err != nil {
-		return nil, err
+	if options.Readers < 1 {
+		options.Readers = 1
 	}
+	pairsFile.readers = make(chan *bgzf.Reader, options.Readers)
 
-	bufReader := bufio.NewReader(pairsFile.bgzfReader)
+	for i := 0; i < options.Readers; i++ {
+		reader, err := pairsFile.newReader(options)
+		if err != nil {
+			for len(pairsFile.readers) > 0 {
+				(<-pairsFile.readers).Close()
+			}
+			pairsFile.baseFile.Close()
+			return nil, err
+		}
+
+		pairsFile.readers <- reader
+	}
 
-	_, err = pairsFile.parseHeader(bufReader)
+	headerReader := <-pairsFile.readers
+	_, err = pairsFile.parseHeader(bufio.NewReader(headerReader))
+	pairsFile.readers <- headerReader
 	if err != nil {
+		pairsFile.Close()
 		return nil, err
 	}
 
 	log.Println("Finished parsing header, reading index...")
 
+	indexFilename := IndexFilename(filename)
+	if _, err = os.Stat(indexFilename); os.IsNotExist(err) {
+		log.Printf("No index found at %s, creating one...\n", indexFilename)
+
+		err = BuildIndex(filename)
+		if err != nil {
+			pairsFile.Close()
+			return nil, err
+		}
+	}
+
 	start := time.Now()
-	pairsFile.index, err = ParseIndex(strings.Replace(filename, ".gz", ".gz.px2", 1))
+	pairsFile.index, err = ParseIndex(indexFilename)
 	if err != nil {
+		pairsFile.Close()
 		return nil, err
 	}
 	elapsed := time.Since(start)
 	log.Printf("Parsing index took %s", elapsed)
 
+	err = pairsFile.layout.validateConf(pairsFile.index.Conf)
+	if err != nil {
+		pairsFile.Close()
+		return nil, err
+	}
+
+	pairsFile.loadMatrix(filename, options)
+
 	// for i := 0; i < 10; i++ {
 	// 	go func(i int) {
 	// 		pairsFile.Query(Query{SourceChrom: "1", TargetChrom: "1", SourceStart: uint64(i) * 1e5, SourceEnd: uint64(i) * 1.1e5, TargetStart: uint64(i) * 1e5, TargetEnd: uint64(i) * 1.1e5}, func(entry *Entry) {})
@@ -916,85 +1175,107 @@ func ParseBGZF(filename string) (File, error) {
 	return &pairsFile, nil
 }
 
-func ParsePlain(reader io.Reader) error {
-	var err error
-	scanner := bufio.NewScanner(reader)
+type Entry struct {
+	SourceChrom    string
+	SourcePosition uint64
+	TargetChrom    string
+	TargetPosition uint64
 
-	// Advance to the first line
-	if !scanner.Scan() {
-		return errors.New("invalid .pairs file: No data?")
-	}
-	firstLine := scanner.Text()
-	if !strings.Contains(firstLine, "## pairs format v1.0") {
-		return errors.New("Invalid .pairs file: Missing header line. First line is: " + firstLine)
-	}
+	// Optional columns, empty (or 0) when not present in the file. Any other columns are available from
+	// Column. The read ID refers to the line of the entry, so is replaced when an Iterator reuses the entry.
+	ReadID       []byte
+	SourceStrand string
+	TargetStrand string
+	PairType     string
+	SourceMapQ   int
+	TargetMapQ   int
+
+	layout *columnLayout
+	// The line the entry was parsed from and the start of each field within it (followed by len(line)+1)
+	line    []byte
+	offsets []int
+}
 
-	var pairsFile baseFile
-	pairsFile.chromsizes = make(map[string]Chromsize)
+// Clone returns a copy of the entry, which is not affected when an Iterator reuses the entry
+func (entry *Entry) Clone() *Entry {
+	clone := *entry
+	clone.line = append([]byte(nil), entry.line...)
+	clone.offsets = append([]int(nil), entry.offsets...)
+	if clone.layout != nil {
+		clone.ReadID = clone.field(clone.layout.readID)
+	}
 
-	lineNumber := 0
-	for scanner.Scan() {
-		lineToProcess := scanner.Text()
+	return &clone
+}
 
-		if lineToProcess[0] == '#' {
-			splitString := strings.SplitN(lineToProcess[1:], ":", 2)
+// mirror swaps the source and target of the entry, for converting between lower and upper triangle
+func (entry *Entry) mirror() {
+	entry.SourceChrom, entry.TargetChrom = entry.TargetChrom, entry.SourceChrom
+	entry.SourcePosition, entry.TargetPosition = entry.TargetPosition, entry.SourcePosition
+	entry.SourceStrand, entry.TargetStrand = entry.TargetStrand, entry.SourceStrand
+	entry.SourceMapQ, entry.TargetMapQ = entry.TargetMapQ, entry.SourceMapQ
 
-			tag := strings.TrimSpace(splitString[0])
-			value := strings.TrimSpace(splitString[1])
+	if len(entry.PairType) == 2 {
+		entry.PairType = string([]byte{entry.PairType[1], entry.PairType[0]})
+	}
+}
 
-			switch tag {
-			case "sorted":
-				if value == "chr1-chr2-pos1-pos2" {
-					pairsFile.Sorted = Chr1Chr2Pos1Pos2
-				} else {
-					return errors.New("Unsupported .pairs file: not supported sorted: " + value)
-				}
-			case "shape":
-				if value == "upper triangle" {
-					pairsFile.Shape = UpperTriangle
-				} else {
-					return errors.New("Unsupported .pairs file: not supported shape: " + value)
-				}
-			case "genome_assembly":
-				pairsFile.GenomeAssembly = value
-			case "chromsize":
-				splitValue := strings.Split(value, " ")
+// Column returns the value of the named column (as listed in the #columns: header) and whether the
+// column is present. Core columns reflect any mirroring of the entry, additional columns are returned
+// exactly as they appear in the file.
+func (entry Entry) Column(name string) (string, bool) {
+	if entry.layout == nil {
+		return "", false
+	}
 
-				var chromsize Chromsize
-				chromsize.Name = strings.TrimSpace(splitValue[0])
-				chromsize.Length, err = strconv.ParseUint(strings.TrimSpace(splitValue[1]), 10, 64)
-				if err != nil {
-					return err
-				}
+	index := entry.layout.index(name)
+	if index < 0 {
+		return "", false
+	}
 
-				pairsFile.chromsizes[chromsize.Name] = chromsize
-				//pairsFile.Chromsizes = append(pairsFile.Chromsizes, chromsize)
-			case "samheader":
-				pairsFile.Samheader = append(pairsFile.Samheader, value)
-			default:
-				fmt.Println(lineToProcess)
-			}
-		} else {
-			fmt.Println(lineToProcess)
+	switch index {
+	case entry.layout.chrom1:
+		return entry.SourceChrom, true
+	case entry.layout.pos1:
+		return strconv.FormatUint(entry.SourcePosition, 10), true
+	case entry.layout.chrom2:
+		return entry.TargetChrom, true
+	case entry.layout.pos2:
+		return strconv.FormatUint(entry.TargetPosition, 10), true
+	case entry.layout.strand1:
+		return entry.SourceStrand, true
+	case entry.layout.strand2:
+		return entry.TargetStrand, true
+	case entry.layout.pairType:
+		return entry.PairType, true
+	case entry.layout.mapq1:
+		return strconv.Itoa(entry.SourceMapQ), true
+	case entry.layout.mapq2:
+		return strconv.Itoa(entry.TargetMapQ), true
+	}
 
-		}
+	if index >= entry.numFields() {
+		return "", false
+	}
 
-		lineNumber++
+	return string(entry.field(index)), true
+}
 
-		if lineNumber > 5000 {
-			fmt.Println(pairsFile)
-			break
-		}
+func (entry *Entry) numFields() int {
+	if len(entry.offsets) == 0 {
+		return 0
 	}
 
-	return nil
+	return len(entry.offsets) - 1
 }
 
-type Entry struct {
-	SourceChrom    string
-	SourcePosition uint64
-	TargetChrom    string
-	TargetPosition uint64
+// field returns the unparsed value of the column at index, or nil if not present
+func (entry *Entry) field(index int) []byte {
+	if index < 0 || index >= entry.numFields() {
+		return nil
+	}
+
+	return entry.line[entry.offsets[index] : entry.offsets[index+1]-1]
 }
 
 func (entry Entry) ChromPairName() string {
@@ -1013,9 +1294,10 @@ func (entry Entry) IsInRange(query Query) bool {
 		distance = entry.TargetPosition - entry.SourcePosition
 	}
 
+	// Distance filter only applies to intrachromosomal entries
 	if entry.SourcePosition >= query.SourceStart && entry.SourcePosition <= query.SourceEnd &&
 		entry.TargetPosition >= query.TargetStart && entry.TargetPosition <= query.TargetEnd &&
-		(entry.SourceChrom == entry.TargetChrom && distance >= query.FilterDistance) {
+		(entry.SourceChrom != entry.TargetChrom || distance >= query.FilterDistance) {
 
 		return true
 
@@ -1024,29 +1306,18 @@ func (entry Entry) IsInRange(query Query) bool {
 	return false
 }
 
-func parseEntry(line string) (*Entry, error) {
-	var entry Entry
-	var err error
-
-	splitLine := strings.Split(line, "\t")
-
-	if len(splitLine) < 4 {
-		// We have a problem, the line isn't formatted correctly
-		fmt.Println(line)
-		return nil, errors.New("Invalid line: " + line)
+func min(a, b uint64) uint64 {
+	if a < b {
+		return a
 	}
 
-	entry.SourceChrom = splitLine[1]
-	entry.TargetChrom = splitLine[3]
+	return b
+}
 
-	entry.SourcePosition, err = strconv.ParseUint(splitLine[2], 10, 64)
-	if err != nil {
-		return nil, err
-	}
-	entry.TargetPosition, err = strconv.ParseUint(splitLine[4], 10, 64)
-	if err != nil {
-		return nil, err
+func max(a, b uint64) uint64 {
+	if a > b {
+		return a
 	}
 
-	return &entry, nil
+	return b
 }
@@ -0,0 +1,275 @@
+package pairs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/imbbLab/v3c-viz/pairs/bgzf"
+)
+
+func TestSortedAndShape(t *testing.T) {
+	entries := generateEntries(20000)
+
+	for _, order := range []Order{Chr1Chr2Pos1Pos2, Chr1Pos1Chr2Pos2} {
+		for _, shape := range []Shape{UpperTriangle, LowerTriangle} {
+			filename := filepath.Join(t.TempDir(), "test.pairs.gz")
+
+			file, err := os.Create(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			writer := bgzf.NewWriter(file, 1)
+			writeSortedEntries(writer, entries, order, shape)
+			writer.Close()
+			file.Close()
+
+			pairsFile, err := Parse(filename)
+			if err != nil {
+				t.Fatalf("%s, %s: %v", order, shape, err)
+			}
+
+			for _, query := range testQueries {
+				found, err := pairsFile.Search(query)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if expected := countInRange(entries, query); len(found) != expected {
+					t.Errorf("%s, %s: query %v: expected %d entries, found %d", order, shape, query, expected, len(found))
+				}
+
+				// Entries should always be provided as upper triangle
+				for _, entry := range found {
+					if entry.SourceChrom == entry.TargetChrom && entry.SourcePosition > entry.TargetPosition {
+						t.Fatalf("%s, %s: entry not mirrored %v", order, shape, entry)
+					}
+				}
+			}
+
+			pairsFile.Close()
+		}
+	}
+}
+
+func TestTransViews(t *testing.T) {
+	// Trans entries are returned for interchromosomal views in either order, regardless of the distance filter,
+	// and the entry filter applies whichever way round the entry matched
+	entries := generateEntries(50000)
+	filename := filepath.Join(t.TempDir(), "test.pairs.gz")
+	writePairs(t, filename, entries)
+
+	var plain bytes.Buffer
+	writeEntries(&plain, entries)
+	plainFile, err := ParsePlain(&plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bgzfFile, err := Parse(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bgzfFile.Close()
+
+	expected := 0
+	for _, entry := range entries {
+		if entry.SourceChrom == "chr1" && entry.TargetChrom == "chr2" &&
+			entry.SourcePosition >= 500000 && entry.SourcePosition <= 1500000 && entry.TargetPosition <= 1000000 {
+			expected++
+		}
+	}
+	if expected == 0 {
+		t.Fatal("Expected some trans entries in the test data")
+	}
+
+	views := []Query{
+		{SourceChrom: "chr1", SourceStart: 500000, SourceEnd: 1500000, TargetChrom: "chr2", TargetStart: 0, TargetEnd: 1000000},
+		{SourceChrom: "chr2", SourceStart: 0, SourceEnd: 1000000, TargetChrom: "chr1", TargetStart: 500000, TargetEnd: 1500000},
+	}
+
+	tests := []struct {
+		filterDistance uint64
+		filter         *Filter
+		expected       int
+	}{
+		{0, nil, expected},
+		{1000000, nil, expected},
+		{0, &Filter{Orientations: ParseOrientation("convergent")}, expected},
+		{0, &Filter{Orientations: ParseOrientation("divergent")}, 0},
+	}
+
+	for _, pairsFile := range []File{plainFile, bgzfFile} {
+		for _, view := range views {
+			for _, test := range tests {
+				query := view
+				query.FilterDistance = test.filterDistance
+				query.Filter = test.filter
+
+				found, err := pairsFile.Search(query)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(found) != test.expected {
+					t.Errorf("%T %v: expected %d entries, found %d", pairsFile, query, test.expected, len(found))
+				}
+
+				image, err := pairsFile.Image(query, query, 10000, 10000)
+				if err != nil {
+					t.Fatal(err)
+				}
+				total := 0
+				for _, value := range image.Data {
+					total += int(value)
+				}
+				if total != test.expected {
+					t.Errorf("%T %v: expected %d entries in the image, found %d", pairsFile, query, test.expected, total)
+				}
+			}
+		}
+	}
+}
+
+func TestConcurrentQueries(t *testing.T) {
+	entries := generateEntries(50000)
+	filename := filepath.Join(t.TempDir(), "test.pairs.gz")
+	writePairs(t, filename, entries)
+
+	pairsFile, err := ParseWithOptions(filename, Options{Readers: 3, CacheBlocks: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pairsFile.Close()
+
+	errs := make(chan error)
+	for i := 0; i < 12; i++ {
+		go func(i int) {
+			query := testQueries[i%len(testQueries)]
+
+			found, err := pairsFile.Search(query)
+			if err == nil && len(found) != countInRange(entries, query) {
+				err = fmt.Errorf("Query %v: expected %d entries, found %d", query, countInRange(entries, query), len(found))
+			}
+			errs <- err
+		}(i)
+	}
+
+	for i := 0; i < 12; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestQueryContext(t *testing.T) {
+	entries := generateEntries(50000)
+	filename := filepath.Join(t.TempDir(), "test.pairs.gz")
+	writePairs(t, filename, entries)
+
+	var plain bytes.Buffer
+	writeEntries(&plain, entries)
+	plainFile, err := ParsePlain(&plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bgzfFile, err := ParseWithOptions(filename, Options{Readers: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bgzfFile.Close()
+
+	query := Query{SourceChrom: "chr1", SourceStart: 0, SourceEnd: 2000000, TargetChrom: "chr1", TargetStart: 0, TargetEnd: 2000000}
+	expected := countInRange(entries, query)
+
+	for _, pairsFile := range []File{plainFile, bgzfFile} {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		if _, err := pairsFile.SearchContext(ctx, query); err != context.Canceled {
+			t.Errorf("%T: expected cancelled search to fail with %v, got %v", pairsFile, context.Canceled, err)
+		}
+		if _, err := pairsFile.ImageContext(ctx, query, query, 10000, 10000); err != context.Canceled {
+			t.Errorf("%T: expected cancelled image to fail with %v, got %v", pairsFile, context.Canceled, err)
+		}
+
+		// Cancel part way through the query
+		ctx, cancel = context.WithCancel(context.Background())
+		found := 0
+		err = pairsFile.(interface {
+			QueryContext(context.Context, Query, func(*Entry)) error
+		}).QueryContext(ctx, query, func(entry *Entry) {
+			found++
+			cancel()
+		})
+		if err != context.Canceled || found >= expected {
+			t.Errorf("%T: expected query to stop early, found %d of %d entries (%v)", pairsFile, found, expected, err)
+		}
+
+		// The reader must be released, so that later queries still work
+		if found, err := pairsFile.Search(query); err != nil || len(found) != expected {
+			t.Errorf("%T: expected %d entries after cancelling, found %d (%v)", pairsFile, expected, len(found), err)
+		}
+	}
+}
+
+func BenchmarkImage(b *testing.B) {
+	entries := generateEntries(200000)
+	filename := filepath.Join(b.TempDir(), "test.pairs.gz")
+	writePairs(b, filename, entries)
+
+	pairsFile, err := Parse(filename)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer pairsFile.Close()
+
+	query := Query{SourceChrom: "chr1", SourceStart: 0, SourceEnd: 2000000, TargetChrom: "chr1", TargetStart: 0, TargetEnd: 2000000}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := pairsFile.Image(query, query, 10000, 10000); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestHeader(t *testing.T) {
+	plain := "## pairs format v1.0\n" +
+		"#sorted: chr1-chr2-pos1-pos2\n" +
+		"#shape: upper triangle\n" +
+		"#genome_assembly: test\n" +
+		"#chromsize: chr1 2000000\n" +
+		"#samheader: @SQ\tSN:chr1\tLN:2000000\n" +
+		"#command: pairtools parse --add-columns mapq\n" +
+		"#custom_key: a: b\n" +
+		"#no value\n" +
+		"#columns: readID chrom1 pos1 chrom2 pos2 strand1 strand2\n" +
+		"read1\tchr1\t100\tchr1\t200\t+\t-\n"
+
+	pairsFile, err := ParsePlain(strings.NewReader(plain))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []HeaderRecord{{Key: "format", Value: "pairs format v1.0"}, {Key: "sorted", Value: "chr1-chr2-pos1-pos2"},
+		{Key: "shape", Value: "upper triangle"}, {Key: "genome_assembly", Value: "test"}, {Key: "chromsize", Value: "chr1 2000000"},
+		{Key: "samheader", Value: "@SQ\tSN:chr1\tLN:2000000"}, {Key: "command", Value: "pairtools parse --add-columns mapq"},
+		{Key: "custom_key", Value: "a: b"}, {Key: "no value"},
+		{Key: "columns", Value: "readID chrom1 pos1 chrom2 pos2 strand1 strand2"}}
+
+	header := pairsFile.Header()
+	if len(header) != len(expected) {
+		t.Fatalf("Expected %d header records, got %v", len(expected), header)
+	}
+	for index := range expected {
+		if header[index] != expected[index] {
+			t.Errorf("Record %d: expected %+v, got %+v", index, expected[index], header[index])
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package pairs
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Maximum number of distinct chromosome names, strands and pair types stored by an entryParser. Values
+// seen after this are still parsed, but allocate a new string each time.
+const maxInternedValues = 1 << 16
+
+// entryParser parses lines of a .pairs file into an existing Entry without allocating. Chromosome names,
+// strands and pair types are interned, so all entries share the same strings, the read ID refers to the line
+// and additional columns are only converted to strings when requested.
+type entryParser struct {
+	layout *columnLayout
+
+	// Swap the source and target of each entry, for files stored as the lower triangle
+	mirror bool
+
+	interned map[string]string
+	pairType [2]byte
+}
+
+func newEntryParser(layout *columnLayout, chromsizes map[string]Chromsize, mirror bool) *entryParser {
+	parser := &entryParser{layout: layout, mirror: mirror, interned: make(map[string]string)}
+
+	for name := range chromsizes {
+		parser.interned[name] = name
+	}
+
+	return parser
+}
+
+// intern returns a string equal to value, reusing the previous string when the value has been seen before
+func (parser *entryParser) intern(value []byte) string {
+	// The compiler avoids allocating when converting the key for a map lookup
+	if interned, ok := parser.interned[string(value)]; ok {
+		return interned
+	}
+
+	interned := string(value)
+	if len(parser.interned) < maxInternedValues {
+		parser.interned[interned] = interned
+	}
+
+	return interned
+}
+
+// parse fills the entry from the line. The entry keeps its own copy of the line, so line can be reused
+// once parse returns.
+func (parser *entryParser) parse(line []byte, entry *Entry) error {
+	for len(line) > 0 && (line[len(line)-1] == '\n' || line[len(line)-1] == '\r') {
+		line = line[:len(line)-1]
+	}
+
+	// Reuse the buffers of the entry from the previous line
+	entry.line = append(entry.line[:0], line...)
+	entry.offsets = append(entry.offsets[:0], 0)
+	for index, c := range entry.line {
+		if c == '\t' {
+			entry.offsets = append(entry.offsets, index+1)
+		}
+	}
+	entry.offsets = append(entry.offsets, len(entry.line)+1)
+	entry.layout = parser.layout
+
+	layout := parser.layout
+	if entry.numFields() < layout.required {
+		return fmt.Errorf("Invalid line (expected %d columns): %s", layout.required, line)
+	}
+
+	var err error
+
+	entry.SourceChrom = parser.intern(entry.field(layout.chrom1))
+	entry.TargetChrom = parser.intern(entry.field(layout.chrom2))
+
+	entry.SourcePosition, err = parsePosition(entry.field(layout.pos1))
+	if err != nil {
+		return err
+	}
+	entry.TargetPosition, err = parsePosition(entry.field(layout.pos2))
+	if err != nil {
+		return err
+	}
+
+	entry.ReadID = entry.field(layout.readID)
+	entry.SourceStrand = parser.intern(entry.field(layout.strand1))
+	entry.TargetStrand = parser.intern(entry.field(layout.strand2))
+
+	pairType := entry.field(layout.pairType)
+
+	if layout.mapq >= 0 {
+		entry.SourceMapQ, err = parseMapQValue(entry.field(layout.mapq))
+		entry.TargetMapQ = entry.SourceMapQ
+	} else {
+		entry.SourceMapQ, err = parseMapQValue(entry.field(layout.mapq1))
+		if err == nil {
+			entry.TargetMapQ, err = parseMapQValue(entry.field(layout.mapq2))
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if parser.mirror {
+		entry.SourceChrom, entry.TargetChrom = entry.TargetChrom, entry.SourceChrom
+		entry.SourcePosition, entry.TargetPosition = entry.TargetPosition, entry.SourcePosition
+		entry.SourceStrand, entry.TargetStrand = entry.TargetStrand, entry.SourceStrand
+		entry.SourceMapQ, entry.TargetMapQ = entry.TargetMapQ, entry.SourceMapQ
+
+		if len(pairType) == 2 {
+			parser.pairType[0], parser.pairType[1] = pairType[1], pairType[0]
+			pairType = parser.pairType[:]
+		}
+	}
+
+	entry.PairType = parser.intern(pairType)
+
+	return nil
+}
+
+var errInvalidNumber = errors.New("Invalid number")
+
+// parseUint parses a base 10 unsigned integer from the bytes
+func parseUint(value []byte) (uint64, error) {
+	if len(value) == 0 {
+		return 0, errInvalidNumber
+	}
+
+	var result uint64
+	for _, c := range value {
+		if c < '0' || c > '9' {
+			return 0, errInvalidNumber
+		}
+
+		digit := uint64(c - '0')
+		if result > (1<<64-1-digit)/10 {
+			return 0, errInvalidNumber
+		}
+		result = result*10 + digit
+	}
+
+	return result, nil
+}
+
+func parsePosition(value []byte) (uint64, error) {
+	position, err := parseUint(value)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid position %q", value)
+	}
+
+	return position, nil
+}
+
+// parseMapQValue parses the MAPQ column, which is 0 when not present
+func parseMapQValue(value []byte) (int, error) {
+	if len(value) == 0 {
+		return 0, nil
+	}
+
+	mapq, err := parseUint(value)
+	if err != nil || mapq > 1<<31-1 {
+		return 0, fmt.Errorf("Invalid MAPQ %q", value)
+	}
+
+	return int(mapq), nil
+}
@@ -0,0 +1,161 @@
+package pairs
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var benchmarkColumns = []string{"readID", "chrom1", "pos1", "chrom2", "pos2", "strand1", "strand2", "pair_type", "mapq1", "mapq2"}
+
+// pairtoolsLines formats the entries as written by pairtools parse
+func pairtoolsLines(entries []*Entry) [][]byte {
+	strands := []string{"+", "-"}
+
+	var lines [][]byte
+	for index, entry := range entries {
+		lines = append(lines, []byte(fmt.Sprintf("SRR5229019.%d\t%s\t%d\t%s\t%d\t%s\t%s\tUU\t60\t%d\n", index, entry.SourceChrom, entry.SourcePosition,
+			entry.TargetChrom, entry.TargetPosition, strands[index%2], strands[(index/2)%2], index%61)))
+	}
+
+	return lines
+}
+
+// splitParseEntry is the string based parser previously used for every line, kept to compare against
+func splitParseEntry(line string, layout *columnLayout) (*Entry, error) {
+	var entry Entry
+	var err error
+
+	splitLine := strings.Split(strings.TrimRight(line, "\r\n"), "\t")
+	if len(splitLine) < layout.required {
+		return nil, fmt.Errorf("Invalid line (expected %d columns): %s", layout.required, line)
+	}
+
+	entry.SourceChrom = splitLine[layout.chrom1]
+	entry.TargetChrom = splitLine[layout.chrom2]
+	entry.SourcePosition, err = strconv.ParseUint(splitLine[layout.pos1], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	entry.TargetPosition, err = strconv.ParseUint(splitLine[layout.pos2], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	entry.SourceStrand = splitLine[layout.strand1]
+	entry.TargetStrand = splitLine[layout.strand2]
+	entry.PairType = splitLine[layout.pairType]
+	entry.SourceMapQ, err = strconv.Atoi(splitLine[layout.mapq1])
+	if err != nil {
+		return nil, err
+	}
+	entry.TargetMapQ, err = strconv.Atoi(splitLine[layout.mapq2])
+	if err != nil {
+		return nil, err
+	}
+
+	return &entry, nil
+}
+
+func TestEntryParser(t *testing.T) {
+	layout, err := newColumnLayout(benchmarkColumns)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chromsizes := make(map[string]Chromsize)
+	for _, chromsize := range testChromsizes {
+		chromsizes[chromsize.Name] = chromsize
+	}
+
+	lines := pairtoolsLines(generateEntries(1000))
+	parser := newEntryParser(layout, chromsizes, false)
+	mirrorParser := newEntryParser(layout, chromsizes, true)
+
+	var entry, mirrored Entry
+	for index, line := range lines {
+		expected, err := splitParseEntry(string(line), layout)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := parser.parse(line, &entry); err != nil {
+			t.Fatal(err)
+		}
+		if entry.SourceChrom != expected.SourceChrom || entry.SourcePosition != expected.SourcePosition ||
+			entry.TargetChrom != expected.TargetChrom || entry.TargetPosition != expected.TargetPosition ||
+			entry.SourceStrand != expected.SourceStrand || entry.TargetStrand != expected.TargetStrand ||
+			entry.PairType != expected.PairType || entry.SourceMapQ != expected.SourceMapQ || entry.TargetMapQ != expected.TargetMapQ {
+			t.Fatalf("Line %d parsed as %+v, expected %+v", index, entry, *expected)
+		}
+		if readID := "SRR5229019." + strconv.Itoa(index); string(entry.ReadID) != readID {
+			t.Fatalf("Line %d: expected read ID %s, got %s", index, readID, entry.ReadID)
+		}
+
+		if err := mirrorParser.parse(line, &mirrored); err != nil {
+			t.Fatal(err)
+		}
+		expected.mirror()
+		if mirrored.SourceChrom != expected.SourceChrom || mirrored.SourcePosition != expected.SourcePosition ||
+			mirrored.SourceStrand != expected.SourceStrand || mirrored.SourceMapQ != expected.SourceMapQ {
+			t.Fatalf("Line %d mirrored as %+v, expected %+v", index, mirrored, *expected)
+		}
+	}
+
+	// The read ID of a clone isn't replaced when the entry is reused
+	clone := entry.Clone()
+	if err := parser.parse(lines[0], &entry); err != nil {
+		t.Fatal(err)
+	}
+	if string(clone.ReadID) == string(entry.ReadID) || string(clone.ReadID) != "SRR5229019."+strconv.Itoa(len(lines)-1) {
+		t.Errorf("Expected the clone to keep its read ID, got %s", clone.ReadID)
+	}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		parser.parse(lines[len(lines)/2], &entry)
+	})
+	if allocs > 0 {
+		t.Errorf("Expected parsing to be allocation free, got %.1f allocations per line", allocs)
+	}
+
+	for _, invalid := range []string{"read\tchr1\t10\tchr1", "read\tchr1\tx\tchr1\t20\t+\t-\tUU\t1\t1", "read\tchr1\t10\tchr1\t20\t+\t-\tUU\t-1\t1"} {
+		if err := parser.parse([]byte(invalid), &entry); err == nil {
+			t.Errorf("Expected error parsing %q", invalid)
+		}
+	}
+}
+
+func BenchmarkParseEntry(b *testing.B) {
+	layout, err := newColumnLayout(benchmarkColumns)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	chromsizes := make(map[string]Chromsize)
+	for _, chromsize := range testChromsizes {
+		chromsizes[chromsize.Name] = chromsize
+	}
+
+	lines := pairtoolsLines(generateEntries(10000))
+
+	b.Run("split", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := splitParseEntry(string(lines[i%len(lines)]), layout); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("bytes", func(b *testing.B) {
+		b.ReportAllocs()
+		parser := newEntryParser(layout, chromsizes, false)
+		var entry Entry
+		for i := 0; i < b.N; i++ {
+			if err := parser.parse(lines[i%len(lines)], &entry); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
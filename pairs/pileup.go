@@ -0,0 +1,259 @@
+package pairs
+
+import (
+	"context"
+	"errors"
+	"math"
+)
+
+// PileupOptions control the windows around each feature that are stacked into a pile-up
+type PileupOptions struct {
+	Resolution uint64
+	// Number of bins either side of the bin at the centre of each feature, when the features aren't rescaled
+	Flank int
+	// Rescale each feature, padded by Padding times its length either side, to Size bins, rather than centring a
+	// window of fixed size on it
+	Rescale bool
+	Size    int
+	Padding float64
+	// Divide each pixel by the mean of its diagonal on the chromosome
+	ObsExp bool
+	// Balance the counts with the weights, when not nil
+	Weights *BalanceWeights
+}
+
+// DefaultPileupOptions are the options commonly used at a resolution of 10 kb
+var DefaultPileupOptions = PileupOptions{Resolution: 10000, Flank: 10, Size: 99, Padding: 1}
+
+// Pileup is the mean of the on-diagonal windows around each feature, oriented so that features on the - strand run
+// in the same direction as those on the + strand
+type Pileup struct {
+	Matrix FloatImage
+	// Number of features included, and skipped (on unknown chromosomes, too close to the end of the chromosome, or
+	// without a length when rescaling)
+	Features int
+	Skipped  int
+}
+
+// pileupBin is a bin of the matrix contributing to a bin of a pile-up window, weighted by their overlap
+type pileupBin struct {
+	bin    int
+	weight float64
+}
+
+// FeaturePileup stacks the intrachromosomal matrix around each feature, binned at the resolution. Each window is
+// either centred on the feature with a fixed number of bins, or covers the padded feature and is resampled to a
+// common size.
+func FeaturePileup(ctx context.Context, pairsFile File, features []Feature, options PileupOptions) (*Pileup, error) {
+	if options.Resolution == 0 {
+		return nil, errors.New("Resolution must be greater than 0")
+	}
+	if err := options.Weights.checkResolution(options.Resolution); err != nil {
+		return nil, err
+	}
+
+	size := 2*options.Flank + 1
+	if options.Rescale {
+		if options.Size <= 0 || options.Padding < 0 {
+			return nil, errors.New("Rescaled size must be greater than 0 and the padding can't be negative")
+		}
+		size = options.Size
+	} else if options.Flank < 0 {
+		return nil, errors.New("Flank can't be negative")
+	}
+
+	resolution := options.Resolution
+	chromsizes := pairsFile.Chromsizes()
+	pileup := &Pileup{}
+
+	// The windows of each chromosome, as the bins contributing to each row (and column) of the window
+	windows := make(map[string][][][]pileupBin)
+	var chroms []string
+	for _, feature := range features {
+		chromsize, ok := chromsizes[feature.Chrom]
+		if !ok {
+			pileup.Skipped++
+			continue
+		}
+
+		var start, end uint64
+		if options.Rescale {
+			padding := uint64(options.Padding * float64(feature.End-feature.Start))
+			if feature.End == feature.Start || feature.Start < padding || feature.End+padding > chromsize.Length {
+				pileup.Skipped++
+				continue
+			}
+			start, end = feature.Start-padding, feature.End+padding
+		} else {
+			centre := ((feature.Start + feature.End) / 2 / resolution) * resolution
+			flank := uint64(options.Flank) * resolution
+			if centre < flank || centre+flank+resolution > chromsize.Length {
+				pileup.Skipped++
+				continue
+			}
+			start, end = centre-flank, centre+flank+resolution
+		}
+
+		window := windowBins(start, end, resolution, size)
+		if feature.Strand == "-" {
+			for i, j := 0, len(window)-1; i < j; i, j = i+1, j-1 {
+				window[i], window[j] = window[j], window[i]
+			}
+		}
+
+		if _, ok := windows[feature.Chrom]; !ok {
+			chroms = append(chroms, feature.Chrom)
+		}
+		windows[feature.Chrom] = append(windows[feature.Chrom], window)
+	}
+
+	sums := make([]float64, size*size)
+	counts := make([]int, size*size)
+	for _, chrom := range chroms {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		value, err := pileupValues(ctx, pairsFile, chromsizes[chrom], windows[chrom], options)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, window := range windows[chrom] {
+			for y, rowBins := range window {
+				for x, columnBins := range window {
+					var sum, weight float64
+					for _, row := range rowBins {
+						for _, column := range columnBins {
+							if v := value(column.bin, row.bin); !math.IsNaN(v) {
+								sum += v * row.weight * column.weight
+								weight += row.weight * column.weight
+							}
+						}
+					}
+
+					if weight > 0 {
+						sums[y*size+x] += sum / weight
+						counts[y*size+x]++
+					}
+				}
+			}
+			pileup.Features++
+		}
+	}
+
+	pileup.Matrix = FloatImage{Width: uint32(size), Height: uint32(size), Data: make([]float32, size*size)}
+	for index := range sums {
+		if counts[index] > 0 {
+			pileup.Matrix.Data[index] = float32(sums[index] / float64(counts[index]))
+		}
+	}
+
+	return pileup, nil
+}
+
+// windowBins splits the range into size equal parts and returns the bins of the resolution overlapping each part
+func windowBins(start uint64, end uint64, resolution uint64, size int) [][]pileupBin {
+	window := make([][]pileupBin, size)
+	step := float64(end-start) / float64(size)
+
+	for index := range window {
+		partStart := float64(start) + float64(index)*step
+		partEnd := partStart + step
+
+		for bin := uint64(partStart) / resolution; float64(bin*resolution) < partEnd; bin++ {
+			overlap := math.Min(partEnd, float64((bin+1)*resolution)) - math.Max(partStart, float64(bin*resolution))
+			if overlap > 0 {
+				window[index] = append(window[index], pileupBin{bin: int(bin), weight: overlap})
+			}
+		}
+	}
+
+	return window
+}
+
+// pileupValues loads the pixels of the chromosome close enough to the diagonal to be in any of the windows, and
+// returns the function giving the (balanced and observed/expected, as requested) value of a pixel. Pixels with
+// masked bins, or without any expected contacts, are NaN.
+func pileupValues(ctx context.Context, pairsFile File, chromsize Chromsize, windows [][][]pileupBin, options PileupOptions) (func(bin1, bin2 int) float64, error) {
+	resolution := options.Resolution
+	numBins := int(chromsize.Length/resolution + 1)
+
+	bandWidth := 0
+	for _, window := range windows {
+		first, last := numBins, 0
+		for _, bins := range window {
+			for _, bin := range bins {
+				if bin.bin < first {
+					first = bin.bin
+				}
+				if bin.bin > last {
+					last = bin.bin
+				}
+			}
+		}
+		if last-first+1 > bandWidth {
+			bandWidth = last - first + 1
+		}
+	}
+
+	pixels, err := chromPairPixels(ctx, pairsFile, chromsize, chromsize, resolution)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[uint64]uint32)
+	for _, pixel := range pixels {
+		if int(pixel.bin2-pixel.bin1) < bandWidth {
+			counts[uint64(pixel.bin1)<<32|uint64(pixel.bin2)] = pixel.count
+		}
+	}
+
+	weights := make([]float64, numBins)
+	for bin := range weights {
+		weights[bin] = 1
+		if options.Weights != nil {
+			weights[bin] = options.Weights.Weight(chromsize.Name, uint64(bin)*resolution)
+		}
+	}
+	// When the length is a multiple of the resolution, the last bin only holds the last position and is ignored
+	valid := func(bin int) bool {
+		return bin >= 0 && bin < numBins && uint64(bin)*resolution < chromsize.Length && !math.IsNaN(weights[bin])
+	}
+
+	balanced := func(bin1, bin2 int) float64 {
+		if bin1 > bin2 {
+			bin1, bin2 = bin2, bin1
+		}
+		if !valid(bin1) || !valid(bin2) {
+			return math.NaN()
+		}
+		return float64(counts[uint64(bin1)<<32|uint64(bin2)]) * weights[bin1] * weights[bin2]
+	}
+	if !options.ObsExp {
+		return balanced, nil
+	}
+
+	// Mean balanced value of each diagonal over the pixels of valid bins
+	expected := make([]float64, bandWidth)
+	for distance := range expected {
+		var pairs int
+		for bin := 0; bin+distance < numBins; bin++ {
+			if v := balanced(bin, bin+distance); !math.IsNaN(v) {
+				expected[distance] += v
+				pairs++
+			}
+		}
+		if pairs > 0 {
+			expected[distance] /= float64(pairs)
+		}
+	}
+
+	return func(bin1, bin2 int) float64 {
+		distance := abs(bin2 - bin1)
+		if distance >= bandWidth || expected[distance] == 0 {
+			return math.NaN()
+		}
+		return balanced(bin1, bin2) / expected[distance]
+	}, nil
+}
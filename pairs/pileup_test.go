@@ -0,0 +1,156 @@
+package pairs
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestPileup(t *testing.T) {
+	const resolution = 10000
+	entries := generateDecayingEntries(100000, 1)
+
+	var plain bytes.Buffer
+	writeEntries(&plain, entries)
+	pairsFile, err := ParsePlain(&plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	features, err := ReadBed(strings.NewReader("track name=sites\n" +
+		"chr1\t500000\t550000\tsite1\t0\t+\n" +
+		"chr1\t1200000\t1250000\tsite2\t0\t-\n" +
+		"chr1\t1990000\t1998000\tsite3\t0\t+\n" +
+		"chrUn\t100\t200\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(features) != 4 || features[1].Strand != "-" || features[3].Strand != "." {
+		t.Fatalf("Unexpected features %v", features)
+	}
+
+	// Errors give the line number, without echoing the line
+	for _, invalid := range []string{"secret\n", "chr1\tsecret\t100\n", "chr1\t100\t200\tname\t0\tsecret\n"} {
+		if _, err := ReadBed(strings.NewReader("track name=sites\n" + invalid)); err == nil || strings.Contains(err.Error(), "secret") || !strings.Contains(err.Error(), "line 2") {
+			t.Errorf("Expected error for line 2 without its contents, got %v", err)
+		}
+	}
+
+	// Sum the windows of the bins directly, reversing those on the - strand
+	bruteForce := func(firstBins []int, reverse []bool, size int) []float64 {
+		expected := make([]float64, size*size)
+		for _, entry := range entries {
+			for index, first := range firstBins {
+				bin1, bin2 := int(entry.SourcePosition/resolution)-first, int(entry.TargetPosition/resolution)-first
+				if reverse[index] {
+					bin1, bin2 = size-1-bin1, size-1-bin2
+				}
+				if bin1 < 0 || bin1 >= size || bin2 < 0 || bin2 >= size {
+					continue
+				}
+
+				expected[bin2*size+bin1] += 1 / float64(len(firstBins))
+				if bin1 != bin2 {
+					expected[bin1*size+bin2] += 1 / float64(len(firstBins))
+				}
+			}
+		}
+		return expected
+	}
+
+	compare := func(name string, pileup *Pileup, expected []float64) {
+		for index, value := range pileup.Matrix.Data {
+			if math.Abs(float64(value)-expected[index]) > 1e-4 {
+				t.Errorf("%s pixel %d: expected %f, got %f", name, index, expected[index], value)
+			}
+		}
+	}
+
+	options := PileupOptions{Resolution: resolution, Flank: 5}
+	pileup, err := FeaturePileup(context.Background(), pairsFile, features, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pileup.Features != 2 || pileup.Skipped != 2 {
+		t.Errorf("Expected 2 features and 2 skipped, got %d and %d", pileup.Features, pileup.Skipped)
+	}
+	compare("Centred", pileup, bruteForce([]int{47, 117}, []bool{false, true}, 11))
+
+	// Padding the features by their length gives windows of 15 bins, so rescaling to 15 bins doesn't resample
+	options = PileupOptions{Resolution: resolution, Rescale: true, Size: 15, Padding: 1}
+	pileup, err = FeaturePileup(context.Background(), pairsFile, features, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pileup.Features != 2 || pileup.Skipped != 2 {
+		t.Errorf("Expected 2 rescaled features and 2 skipped, got %d and %d", pileup.Features, pileup.Skipped)
+	}
+	compare("Rescaled", pileup, bruteForce([]int{45, 115}, []bool{false, true}, 15))
+
+	// Resampling the 15 bins to 10 gives each pixel the mean of the pixels it overlaps, weighted by the overlap
+	counts := make(map[[2]int]float64)
+	for _, entry := range entries {
+		bin1, bin2 := int(entry.SourcePosition/resolution), int(entry.TargetPosition/resolution)
+		counts[[2]int{bin1, bin2}]++
+		if bin1 != bin2 {
+			counts[[2]int{bin2, bin1}]++
+		}
+	}
+	const size = 10
+	resampled := make([]float64, size*size)
+	for _, feature := range []struct {
+		start   int
+		reverse bool
+	}{{450000, false}, {1150000, true}} {
+		const step = 150000 / size
+		overlaps := make([]map[int]float64, size)
+		for part := range overlaps {
+			partStart, partEnd := feature.start+part*step, feature.start+(part+1)*step
+			overlaps[part] = make(map[int]float64)
+			for bin := partStart / resolution; bin*resolution < partEnd; bin++ {
+				overlaps[part][bin] = float64(min(uint64(partEnd), uint64(bin+1)*resolution) - max(uint64(partStart), uint64(bin)*resolution))
+			}
+		}
+		if feature.reverse {
+			for i, j := 0, size-1; i < j; i, j = i+1, j-1 {
+				overlaps[i], overlaps[j] = overlaps[j], overlaps[i]
+			}
+		}
+
+		for y := 0; y < size; y++ {
+			for x := 0; x < size; x++ {
+				var sum, weight float64
+				for row, rowWeight := range overlaps[y] {
+					for column, columnWeight := range overlaps[x] {
+						sum += counts[[2]int{column, row}] * rowWeight * columnWeight
+						weight += rowWeight * columnWeight
+					}
+				}
+				resampled[y*size+x] += sum / weight / 2
+			}
+		}
+	}
+
+	options.Size = size
+	pileup, err = FeaturePileup(context.Background(), pairsFile, features, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compare("Resampled", pileup, resampled)
+
+	// Without any enrichment at the features, observed/expected is close to 1 throughout
+	options.ObsExp = true
+	pileup, err = FeaturePileup(context.Background(), pairsFile, features, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sum float64
+	for _, value := range pileup.Matrix.Data {
+		sum += float64(value)
+	}
+	if mean := sum / float64(len(pileup.Matrix.Data)); math.Abs(mean-1) > 0.1 {
+		t.Errorf("Expected a mean observed/expected of 1, got %f", mean)
+	}
+}
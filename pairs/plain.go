@@ -0,0 +1,141 @@
+package pairs
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"sort"
+	"time"
+)
+
+// memoryFile holds all entries of a plain text or gzip compressed .pairs file in memory. Entries are grouped
+// by chromosome pair and sorted by source position, so queries can be answered without an external index.
+type memoryFile struct {
+	baseFile
+
+	chromPairs []string
+	entries    map[string][]Entry
+}
+
+func (file *memoryFile) ChromPairList() []string {
+	return file.chromPairs
+}
+
+// entriesInRange returns the entries of the chromosome pair with a source position between start and end
+func (file *memoryFile) entriesInRange(sourceChrom, targetChrom string, start, end uint64) []Entry {
+	entries := file.entries[sourceChrom+"|"+targetChrom]
+
+	first := sort.Search(len(entries), func(i int) bool {
+		return entries[i].SourcePosition >= start
+	})
+	last := sort.Search(len(entries), func(i int) bool {
+		return entries[i].SourcePosition > end
+	})
+
+	if first >= last {
+		return nil
+	}
+
+	return entries[first:last]
+}
+
+func (file *memoryFile) Query(query Query, entryFunction func(entry *Entry)) error {
+	return file.QueryContext(context.Background(), query, entryFunction)
+}
+
+// QueryContext calls entryFunction for every entry within the query, stopping early with the context error
+// when ctx is cancelled. The entry is reused after entryFunction returns.
+func (file *memoryFile) QueryContext(ctx context.Context, query Query, entryFunction func(entry *Entry)) error {
+	iterator, err := file.Iterate(ctx, query)
+	if err != nil {
+		return err
+	}
+
+	return forEachEntry(iterator, entryFunction)
+}
+
+func (file *memoryFile) Search(query Query) ([]*Entry, error) {
+	return searchEntries(context.Background(), query, file.QueryContext)
+}
+
+func (file *memoryFile) SearchContext(ctx context.Context, query Query) ([]*Entry, error) {
+	return searchEntries(ctx, query, file.QueryContext)
+}
+
+func (file *memoryFile) Image(query Query, viewQuery Query, binSizeX uint64, binSizeY uint64) (Image, error) {
+	return imageEntries(context.Background(), query, viewQuery, binSizeX, binSizeY, file.QueryContext)
+}
+
+func (file *memoryFile) ImageContext(ctx context.Context, query Query, viewQuery Query, binSizeX uint64, binSizeY uint64) (Image, error) {
+	return imageEntries(ctx, query, viewQuery, binSizeX, binSizeY, file.QueryContext)
+}
+
+// ParsePlain reads an uncompressed .pairs file from the reader (which can also be a gzip.Reader),
+// storing all entries in memory.
+func ParsePlain(reader io.Reader) (File, error) {
+	var pairsFile memoryFile
+	pairsFile.chromsizes = make(map[string]Chromsize)
+	pairsFile.entries = make(map[string][]Entry)
+
+	start := time.Now()
+
+	bufReader := bufio.NewReaderSize(reader, 1<<20)
+
+	entry, err := pairsFile.parseHeader(bufReader)
+	if err != nil {
+		return nil, err
+	}
+
+	if entry != nil && pairsFile.Shape == LowerTriangle {
+		entry.mirror()
+	}
+
+	parser := newEntryParser(pairsFile.layout, pairsFile.chromsizes, pairsFile.Shape == LowerTriangle)
+	var lineEntry Entry
+
+	for {
+		if entry != nil {
+			chromPairName := entry.SourceChrom + "|" + entry.TargetChrom
+			if _, ok := pairsFile.entries[chromPairName]; !ok {
+				pairsFile.chromPairs = append(pairsFile.chromPairs, chromPairName)
+			}
+			pairsFile.entries[chromPairName] = append(pairsFile.entries[chromPairName], *entry)
+		}
+
+		lineData, err := bufReader.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			return nil, errors.New("Invalid .pairs file: line longer than 1 MB")
+		} else if err == io.EOF && len(lineData) == 0 {
+			break
+		} else if err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		entry = nil
+
+		if len(lineData) > 0 && lineData[0] != '#' && lineData[0] != '\n' && lineData[0] != '\r' {
+			err = parser.parse(lineData, &lineEntry)
+			if err != nil {
+				return nil, err
+			}
+
+			// Each stored entry needs its own copy of the line
+			entry = lineEntry.Clone()
+		}
+	}
+
+	// Plain text files don't need to be sorted, so make sure that the entries can be searched
+	lineCount := 0
+	for _, entries := range pairsFile.entries {
+		sort.SliceStable(entries, func(i, j int) bool {
+			return entries[i].SourcePosition < entries[j].SourcePosition
+		})
+		lineCount += len(entries)
+	}
+
+	log.Printf("Loaded %d entries (%d chromosome pairs) into memory in %s\n", lineCount, len(pairsFile.chromPairs), time.Since(start))
+
+	return &pairsFile, nil
+}
@@ -0,0 +1,95 @@
+package pairs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestParsePlain(t *testing.T) {
+	entries := generateEntries(20000)
+
+	var plain bytes.Buffer
+	writeEntries(&plain, entries)
+
+	plainFilename := filepath.Join(t.TempDir(), "test.pairs")
+	err := ioutil.WriteFile(plainFilename, plain.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write(plain.Bytes())
+	gz.Close()
+
+	gzipFilename := filepath.Join(t.TempDir(), "test.pairs.gz")
+	err = ioutil.WriteFile(gzipFilename, compressed.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, filename := range []string{plainFilename, gzipFilename} {
+		pairsFile, err := Parse(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, ok := pairsFile.(*memoryFile); !ok {
+			t.Errorf("%s: expected file to be loaded into memory", filename)
+		}
+		if pairsFile.Genome() != "test" || len(pairsFile.Chromosomes()) != len(testChromsizes) {
+			t.Errorf("%s: header not parsed, genome %s and chromosomes %v", filename, pairsFile.Genome(), pairsFile.Chromosomes())
+		}
+
+		for _, query := range testQueries {
+			found, err := pairsFile.Search(query)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if expected := countInRange(entries, query); len(found) != expected {
+				t.Errorf("%s: query %v: expected %d entries, found %d", filename, query, expected, len(found))
+			}
+		}
+
+		pairsFile.Close()
+	}
+}
+
+func TestEmptyPairs(t *testing.T) {
+	var plain bytes.Buffer
+	writeEntries(&plain, nil)
+
+	plainFilename := filepath.Join(t.TempDir(), "empty.pairs")
+	err := ioutil.WriteFile(plainFilename, plain.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bgzfFilename := filepath.Join(t.TempDir(), "empty.pairs.gz")
+	writePairs(t, bgzfFilename, nil)
+
+	for _, filename := range []string{plainFilename, bgzfFilename} {
+		pairsFile, err := Parse(filename)
+		if err != nil {
+			t.Fatalf("%s: a file with only a header should be empty, got %v", filename, err)
+		}
+
+		if len(pairsFile.Chromosomes()) != len(testChromsizes) {
+			t.Errorf("%s: header not parsed, chromosomes %v", filename, pairsFile.Chromosomes())
+		}
+
+		found, err := pairsFile.Search(testQueries[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(found) != 0 {
+			t.Errorf("%s: expected no entries, found %d", filename, len(found))
+		}
+
+		pairsFile.Close()
+	}
+}
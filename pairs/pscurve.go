@@ -0,0 +1,209 @@
+package pairs
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Region is a range of a chromosome
+type Region struct {
+	Chrom string
+	Start uint64
+	End   uint64
+}
+
+// ParseRegion parses a region written as chrom:start-end, or just chrom for the whole chromosome
+func ParseRegion(region string, chromsizes map[string]Chromsize) (Region, error) {
+	// Chromosome names can contain ':'
+	if chromsize, ok := chromsizes[region]; ok {
+		return Region{Chrom: region, Start: 0, End: chromsize.Length}, nil
+	}
+
+	chrom, positions := region, ""
+	if index := strings.LastIndex(region, ":"); index >= 0 {
+		chrom, positions = region[:index], region[index+1:]
+	}
+
+	chromsize, ok := chromsizes[chrom]
+	if !ok {
+		return Region{}, fmt.Errorf("Unknown chromosome %s", chrom)
+	}
+
+	if positions == "" {
+		return Region{Chrom: chrom, Start: 0, End: chromsize.Length}, nil
+	}
+
+	splitPositions := strings.SplitN(strings.ReplaceAll(positions, ",", ""), "-", 2)
+	if len(splitPositions) != 2 {
+		return Region{}, fmt.Errorf("Invalid region %s, expected chrom:start-end", region)
+	}
+
+	start, err := strconv.ParseUint(splitPositions[0], 10, 64)
+	if err != nil {
+		return Region{}, fmt.Errorf("Invalid start of region %s", region)
+	}
+	end, err := strconv.ParseUint(splitPositions[1], 10, 64)
+	if err != nil || end < start {
+		return Region{}, fmt.Errorf("Invalid end of region %s", region)
+	}
+
+	return Region{Chrom: chrom, Start: start, End: end}, nil
+}
+
+func (region Region) String() string {
+	return fmt.Sprintf("%s:%d-%d", region.Chrom, region.Start, region.End)
+}
+
+// Query returns the query of the intrachromosomal entries with both ends in the region
+func (region Region) Query() Query {
+	return Query{SourceChrom: region.Chrom, SourceStart: region.Start, SourceEnd: region.End,
+		TargetChrom: region.Chrom, TargetStart: region.Start, TargetEnd: region.End}
+}
+
+// PsOptions control the distance bins of a P(s) curve
+type PsOptions struct {
+	// Number of log-spaced distance bins for each factor of 10
+	BinsPerDecade int
+	// Count each strand orientation (e.g. +-) separately
+	ByOrientation bool
+	// Only count entries that match the filter
+	Filter *Filter
+}
+
+// DefaultPsOptions are the options used when none are given
+var DefaultPsOptions = PsOptions{BinsPerDecade: 10}
+
+// PsBin is the number of entries with a distance in [Start, End)
+type PsBin struct {
+	Orientation string
+	Start       uint64
+	End         uint64
+	Count       uint64
+	// Count divided by the width of the bin and the total entries of the curve, so that the curve integrates to 1
+	Probability float64
+}
+
+// PsCurve is the contact probability as a function of distance (P(s)) over one or more regions
+type PsCurve struct {
+	Name  string
+	Total uint64
+	Bins  []PsBin
+}
+
+// psEdges returns the log-spaced edges of the distance bins up to maxDistance, starting with [0, 1)
+func psEdges(maxDistance uint64, binsPerDecade int) []uint64 {
+	edges := []uint64{0, 1}
+	for step := 1; edges[len(edges)-1] <= maxDistance; step++ {
+		edge := uint64(math.Ceil(math.Pow(10, float64(step)/float64(binsPerDecade))))
+		if edge > edges[len(edges)-1] {
+			edges = append(edges, edge)
+		}
+	}
+
+	return edges
+}
+
+// ComputePsCurve counts the intrachromosomal entries within the regions by the distance between their ends
+func ComputePsCurve(ctx context.Context, pairsFile File, name string, regions []Region, options PsOptions) (*PsCurve, error) {
+	if options.BinsPerDecade <= 0 {
+		return nil, errors.New("Number of bins per decade must be greater than 0")
+	}
+
+	var maxDistance uint64
+	for _, region := range regions {
+		maxDistance = max(maxDistance, region.End-region.Start)
+	}
+	edges := psEdges(maxDistance, options.BinsPerDecade)
+
+	counts := make(map[string][]uint64)
+	curve := &PsCurve{Name: name}
+
+	for _, region := range regions {
+		query := region.Query()
+		query.Filter = options.Filter
+
+		iterator, err := pairsFile.Iterate(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+
+		for iterator.Next() {
+			entry := iterator.Entry()
+
+			distance := entry.TargetPosition - entry.SourcePosition
+			if entry.SourcePosition > entry.TargetPosition {
+				distance = entry.SourcePosition - entry.TargetPosition
+			}
+
+			orientation := "all"
+			if options.ByOrientation {
+				orientation = entry.SourceStrand + entry.TargetStrand
+			}
+
+			orientationCounts, ok := counts[orientation]
+			if !ok {
+				orientationCounts = make([]uint64, len(edges)-1)
+				counts[orientation] = orientationCounts
+			}
+
+			// The first edge greater than the distance is the end of its bin
+			bin := sort.Search(len(edges), func(index int) bool { return edges[index] > distance }) - 1
+			if bin < len(orientationCounts) {
+				orientationCounts[bin]++
+				curve.Total++
+			}
+		}
+
+		err = iterator.Err()
+		iterator.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	orientations := make([]string, 0, len(counts))
+	for orientation := range counts {
+		orientations = append(orientations, orientation)
+	}
+	sort.Strings(orientations)
+
+	for _, orientation := range orientations {
+		orientationCounts := counts[orientation]
+
+		// Don't include the empty bins beyond the largest distance
+		last := len(orientationCounts) - 1
+		for last >= 0 && orientationCounts[last] == 0 {
+			last--
+		}
+
+		for bin := 0; bin <= last; bin++ {
+			psBin := PsBin{Orientation: orientation, Start: edges[bin], End: edges[bin+1], Count: orientationCounts[bin]}
+			psBin.Probability = float64(psBin.Count) / float64(psBin.End-psBin.Start) / float64(curve.Total)
+
+			curve.Bins = append(curve.Bins, psBin)
+		}
+	}
+
+	return curve, nil
+}
+
+// WritePsCurvesTSV writes the bins of the curves as tab separated values, with a header line
+func WritePsCurvesTSV(writer io.Writer, curves []*PsCurve) error {
+	bufWriter := bufio.NewWriter(writer)
+
+	fmt.Fprintln(bufWriter, "name\torientation\tstart\tend\tcount\tprobability")
+	for _, curve := range curves {
+		for _, bin := range curve.Bins {
+			fmt.Fprintf(bufWriter, "%s\t%s\t%d\t%d\t%d\t%g\n", curve.Name, bin.Orientation, bin.Start, bin.End, bin.Count, bin.Probability)
+		}
+	}
+
+	return bufWriter.Flush()
+}
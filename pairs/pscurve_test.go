@@ -0,0 +1,75 @@
+package pairs
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"testing"
+)
+
+func TestPsCurve(t *testing.T) {
+	entries := generateEntries(20000)
+
+	var plain bytes.Buffer
+	writeEntries(&plain, entries)
+	pairsFile, err := ParsePlain(&plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	region, err := ParseRegion("chr1:500,000-1500000", pairsFile.Chromsizes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if region != (Region{Chrom: "chr1", Start: 500000, End: 1500000}) {
+		t.Errorf("Unexpected region %v", region)
+	}
+	for _, invalid := range []string{"chrX", "chr1:100", "chr1:200-100"} {
+		if _, err := ParseRegion(invalid, pairsFile.Chromsizes()); err == nil {
+			t.Errorf("Expected error for region %s", invalid)
+		}
+	}
+
+	for _, byOrientation := range []bool{false, true} {
+		options := PsOptions{BinsPerDecade: 8, ByOrientation: byOrientation}
+
+		curve, err := ComputePsCurve(context.Background(), pairsFile, "test", []Region{region}, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var total uint64
+		var integral float64
+		for _, bin := range curve.Bins {
+			if bin.Orientation != "all" && bin.Orientation != "+-" {
+				t.Errorf("Unexpected orientation %s", bin.Orientation)
+			}
+
+			// Count the entries of the bin directly
+			var count uint64
+			for _, entry := range entries {
+				distance := entry.TargetPosition - entry.SourcePosition
+				if entry.IsInRange(region.Query()) && distance >= bin.Start && distance < bin.End {
+					count++
+				}
+			}
+			if count != bin.Count {
+				t.Errorf("Bin [%d, %d): expected %d entries, got %d", bin.Start, bin.End, count, bin.Count)
+			}
+
+			total += bin.Count
+			integral += bin.Probability * float64(bin.End-bin.Start)
+		}
+
+		if total != curve.Total || total != uint64(countInRange(entries, region.Query())) {
+			t.Errorf("Expected %d entries, got %d (total %d)", countInRange(entries, region.Query()), total, curve.Total)
+		}
+		if math.Abs(integral-1) > 1e-9 {
+			t.Errorf("Curve integrates to %f", integral)
+		}
+	}
+
+	if _, err := ComputePsCurve(context.Background(), pairsFile, "test", []Region{region}, PsOptions{}); err == nil {
+		t.Error("Expected error with no bins per decade")
+	}
+}
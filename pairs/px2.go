@@ -0,0 +1,456 @@
+package pairs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/imbbLab/v3c-viz/pairs/bgzf"
+)
+
+// PX2.003 bins positions using 6 levels on top of 32 kb (1 << TAD_LIDX_SHIFT) leaf bins
+const px2MaxBin = 299593
+
+// binLevel describes one level of a binning scheme, where bin numbers start at offset and each bin covers
+// 1 << shift bases
+type binLevel struct {
+	offset uint32
+	shift  uint
+}
+
+// Bin levels of PX2.003 indexes, from the single bin covering everything down to the leaf bins
+var px2BinLevels = []binLevel{{0, 33}, {1, 30}, {9, 27}, {73, 24}, {585, 21}, {4681, 18}, {37449, 15}}
+
+// Bin levels of PX2.002 indexes, which use the tabix binning scheme with 16 kb leaf bins
+var px2OriginalBinLevels = []binLevel{{0, 29}, {1, 26}, {9, 23}, {73, 20}, {585, 17}, {4681, 14}}
+
+var px2Magic = [8]byte{'P', 'X', '2', '.', '0', '0', '3', 1}
+
+// Column settings used by pairix for .pairs files (1-based column numbers)
+var pairsIndexConf = indexConf{
+	Format:  0,
+	SeqCol:  2,
+	SeqBeg:  3,
+	EndCol:  3,
+	SeqCol2: 4,
+	BegCol2: 5,
+	EndCol2: 5,
+
+	Delimiter:            '\t',
+	RegionSplitCharacter: '|',
+	MetaChar:             '#',
+	LineSkip:             0,
+}
+
+// IndexFilename returns the location of the .px2 index accompanying the bgzip compressed pairs file
+func IndexFilename(filename string) string {
+	return filename + ".px2"
+}
+
+// reg2bin calculates the smallest bin in the PX2.003 binning scheme that contains [beg, end)
+func reg2bin(beg, end uint64) uint32 {
+	end--
+	if beg>>15 == end>>15 {
+		return uint32(37449 + (beg >> 15))
+	}
+	if beg>>18 == end>>18 {
+		return uint32(4681 + (beg >> 18))
+	}
+	if beg>>21 == end>>21 {
+		return uint32(585 + (beg >> 21))
+	}
+	if beg>>24 == end>>24 {
+		return uint32(73 + (beg >> 24))
+	}
+	if beg>>27 == end>>27 {
+		return uint32(9 + (beg >> 27))
+	}
+	if beg>>30 == end>>30 {
+		return uint32(1 + (beg >> 30))
+	}
+	return 0
+}
+
+// reg2bins lists all bins in the binning scheme that may contain entries overlapping [beg, end)
+func reg2bins(beg, end uint64, levels []binLevel) []uint32 {
+	var bins []uint32
+
+	if end == 0 || beg >= end {
+		return bins
+	}
+	end--
+
+	for _, level := range levels {
+		// Positions past the range of the scheme are all stored in the last bin of each level
+		last := uint64(1) << (levels[0].shift - level.shift)
+		first := min(beg>>level.shift, last-1)
+		end := min(end>>level.shift, last-1)
+
+		for bin := first; bin <= end; bin++ {
+			bins = append(bins, level.offset+uint32(bin))
+		}
+	}
+
+	return bins
+}
+
+func toVirtualOffset(offset bgzf.Offset) uint64 {
+	return uint64(offset.File)<<16 | uint64(offset.Block)
+}
+
+// sequenceIndex holds the bin and linear index for a single chromosome pair while the index is being built
+type sequenceIndex struct {
+	name string
+
+	bins   map[uint32][]chunkDetails
+	linear []uint64
+}
+
+func (seq *sequenceIndex) addChunk(bin uint32, begin, end uint64) {
+	seq.bins[bin] = append(seq.bins[bin], chunkDetails{ChunkBegin: begin, ChunkEnd: end})
+}
+
+func (seq *sequenceIndex) addLinear(beg, end uint64, offset uint64) {
+	startWindow := beg >> TAD_LIDX_SHIFT
+	endWindow := (end - 1) >> TAD_LIDX_SHIFT
+
+	for uint64(len(seq.linear)) <= endWindow {
+		seq.linear = append(seq.linear, 0)
+	}
+
+	for window := startWindow; window <= endWindow; window++ {
+		if seq.linear[window] == 0 {
+			seq.linear[window] = offset
+		}
+	}
+}
+
+// finish merges chunks that start and end within the same BGZF block and fills gaps in the linear index
+func (seq *sequenceIndex) finish() {
+	for bin, chunks := range seq.bins {
+		merged := chunks[:1]
+		for _, chunk := range chunks[1:] {
+			last := &merged[len(merged)-1]
+			if last.ChunkEnd>>16 == chunk.ChunkBegin>>16 {
+				last.ChunkEnd = chunk.ChunkEnd
+			} else {
+				merged = append(merged, chunk)
+			}
+		}
+		seq.bins[bin] = merged
+	}
+
+	for i := 1; i < len(seq.linear); i++ {
+		if seq.linear[i] == 0 {
+			seq.linear[i] = seq.linear[i-1]
+		}
+	}
+}
+
+// indexBuilder follows the approach taken by tabix/pairix, recording each line's virtual offset
+// in the bin and linear index of the chromosome pair it belongs to
+type indexBuilder struct {
+	conf indexConf
+
+	sequences []*sequenceIndex
+	seen      map[string]bool
+	current   *sequenceIndex
+
+	lineCount uint64
+
+	lastPos uint64
+
+	saveBin    uint32
+	saveOffset uint64
+	hasSaved   bool
+}
+
+func newIndexBuilder(conf indexConf) *indexBuilder {
+	return &indexBuilder{conf: conf, seen: make(map[string]bool)}
+}
+
+func (builder *indexBuilder) flushChunk(end uint64) {
+	if builder.hasSaved {
+		builder.current.addChunk(builder.saveBin, builder.saveOffset, end)
+		builder.hasSaved = false
+	}
+}
+
+func (builder *indexBuilder) addLine(line []byte, begin, end bgzf.Offset) error {
+	if len(line) == 0 || line[0] == byte(builder.conf.MetaChar) {
+		return nil
+	}
+
+	fields := bytes.Split(line, []byte{builder.conf.Delimiter})
+	maxCol := builder.conf.SeqCol
+	if builder.conf.SeqBeg > maxCol {
+		maxCol = builder.conf.SeqBeg
+	}
+	if builder.conf.SeqCol2 > maxCol {
+		maxCol = builder.conf.SeqCol2
+	}
+	if len(fields) < int(maxCol) {
+		return errors.New("Invalid line: " + string(line))
+	}
+
+	name := string(fields[builder.conf.SeqCol-1])
+	if builder.conf.SeqCol2 > 0 {
+		name += string(builder.conf.RegionSplitCharacter) + string(fields[builder.conf.SeqCol2-1])
+	}
+	position, err := strconv.ParseUint(string(fields[builder.conf.SeqBeg-1]), 10, 64)
+	if err != nil {
+		return err
+	}
+
+	// Positions in .pairs files are 1-based
+	var beg uint64
+	if position > 0 {
+		beg = position - 1
+	}
+	bin := reg2bin(beg, beg+1)
+
+	beginOffset := toVirtualOffset(begin)
+
+	if builder.current == nil || builder.current.name != name {
+		if builder.seen[name] {
+			return fmt.Errorf("Unsorted .pairs file: chromosome pair %s is not contiguous", name)
+		}
+
+		if builder.current != nil {
+			builder.flushChunk(beginOffset)
+		}
+
+		builder.current = &sequenceIndex{name: name, bins: make(map[uint32][]chunkDetails)}
+		builder.sequences = append(builder.sequences, builder.current)
+		builder.seen[name] = true
+	} else if beg < builder.lastPos {
+		return fmt.Errorf("Unsorted .pairs file: position %d follows %d in chromosome pair %s", position, builder.lastPos+1, name)
+	}
+
+	builder.current.addLinear(beg, beg+1, beginOffset)
+
+	if !builder.hasSaved || builder.saveBin != bin {
+		builder.flushChunk(beginOffset)
+
+		builder.saveBin = bin
+		builder.saveOffset = beginOffset
+		builder.hasSaved = true
+	}
+
+	builder.lastPos = beg
+	builder.lineCount++
+
+	return nil
+}
+
+func (builder *indexBuilder) finish(end bgzf.Offset) {
+	if builder.current != nil {
+		builder.flushChunk(toVirtualOffset(end))
+	}
+
+	for _, seq := range builder.sequences {
+		seq.finish()
+	}
+}
+
+func (builder *indexBuilder) write(writer io.Writer) error {
+	var names []byte
+	for _, seq := range builder.sequences {
+		names = append(names, seq.name...)
+		names = append(names, 0)
+	}
+
+	header := []interface{}{
+		px2Magic,
+		int32(len(builder.sequences)),
+		builder.lineCount,
+		builder.conf,
+		int32(len(names)),
+		names,
+	}
+	for _, value := range header {
+		if err := binary.Write(writer, binary.LittleEndian, value); err != nil {
+			return err
+		}
+	}
+
+	for _, seq := range builder.sequences {
+		binNumbers := make([]uint32, 0, len(seq.bins))
+		for bin := range seq.bins {
+			binNumbers = append(binNumbers, bin)
+		}
+		sort.Slice(binNumbers, func(i, j int) bool { return binNumbers[i] < binNumbers[j] })
+
+		if err := binary.Write(writer, binary.LittleEndian, int32(len(binNumbers))); err != nil {
+			return err
+		}
+		for _, bin := range binNumbers {
+			chunks := seq.bins[bin]
+			if err := binary.Write(writer, binary.LittleEndian, bin); err != nil {
+				return err
+			}
+			if err := binary.Write(writer, binary.LittleEndian, int32(len(chunks))); err != nil {
+				return err
+			}
+			if err := binary.Write(writer, binary.LittleEndian, chunks); err != nil {
+				return err
+			}
+		}
+
+		if err := binary.Write(writer, binary.LittleEndian, int32(len(seq.linear))); err != nil {
+			return err
+		}
+		if err := binary.Write(writer, binary.LittleEndian, seq.linear); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// forEachLine reads the BGZF stream one block at a time, calling lineFunction with every line (excluding the
+// newline) together with the virtual offsets of the start of the line and the position directly after it.
+// The final offset reached is returned.
+func forEachLine(reader *bgzf.Reader, lineFunction func(line []byte, begin, end bgzf.Offset) error) (bgzf.Offset, error) {
+	reader.Blocked = true
+	defer func() { reader.Blocked = false }()
+
+	// Buffer larger than any decompressed block, so each Read returns the remainder of a single block
+	block := make([]byte, bgzf.MaxBlockSize+1)
+
+	var line []byte
+	var lineStart, end bgzf.Offset
+
+	for {
+		n, err := reader.Read(block)
+		if n == 0 {
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return end, err
+			}
+			continue
+		}
+
+		blockStart := reader.LastChunk().Begin
+		data := block[:n]
+
+		for pos := 0; pos < n; {
+			if len(line) == 0 {
+				lineStart = bgzf.Offset{File: blockStart.File, Block: blockStart.Block + uint16(pos)}
+			}
+
+			newLine := bytes.IndexByte(data[pos:], '\n')
+			if newLine < 0 {
+				line = append(line, data[pos:]...)
+				break
+			}
+
+			line = append(line, data[pos:pos+newLine]...)
+			pos += newLine + 1
+			end = bgzf.Offset{File: blockStart.File, Block: blockStart.Block + uint16(pos)}
+
+			if lineErr := lineFunction(bytes.TrimSuffix(line, []byte{'\r'}), lineStart, end); lineErr != nil {
+				return end, lineErr
+			}
+			line = line[:0]
+		}
+
+		if err != nil && err != io.EOF {
+			return end, err
+		}
+	}
+
+	// Final line without a trailing newline
+	if len(line) > 0 {
+		end = reader.LastChunk().End
+		if err := lineFunction(line, lineStart, end); err != nil {
+			return end, err
+		}
+	}
+
+	return end, nil
+}
+
+// BuildIndex creates a pairix compatible (PX2.003) index for the bgzip compressed .pairs file
+// and writes it alongside the data (see IndexFilename).
+func BuildIndex(filename string) error {
+	log.Printf("Building index for %s\n", filename)
+	start := time.Now()
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader, err := bgzf.NewReader(file, 0)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	// Chromosome pairs are only contiguous when sorted chr1-chr2-pos1-pos2, otherwise index on the first chromosome
+	var header baseFile
+	header.chromsizes = make(map[string]Chromsize)
+	_, err = header.parseHeader(bufio.NewReader(reader))
+	if err != nil {
+		return err
+	}
+
+	conf := header.layout.indexConf()
+	if header.Sorted == Chr1Pos1Chr2Pos2 {
+		conf.SeqCol2, conf.BegCol2, conf.EndCol2 = 0, 0, 0
+	}
+
+	err = reader.Seek(bgzf.Offset{})
+	if err != nil {
+		return err
+	}
+
+	builder := newIndexBuilder(conf)
+
+	end, err := forEachLine(reader, builder.addLine)
+	if err != nil {
+		return err
+	}
+	builder.finish(end)
+
+	// Write to a temporary file first so that an interrupted build doesn't leave a truncated index
+	indexFilename := IndexFilename(filename)
+	indexFile, err := os.Create(indexFilename + ".tmp")
+	if err != nil {
+		return err
+	}
+
+	writer := bgzf.NewWriter(indexFile, 1)
+	err = builder.write(writer)
+	if err == nil {
+		err = writer.Close()
+	}
+	if closeErr := indexFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(indexFile.Name())
+		return err
+	}
+
+	err = os.Rename(indexFile.Name(), indexFilename)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Finished building index of %d lines (%d chromosome pairs) in %s\n", builder.lineCount, len(builder.sequences), time.Since(start))
+
+	return nil
+}
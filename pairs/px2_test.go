@@ -0,0 +1,111 @@
+package pairs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBuildIndex(t *testing.T) {
+	entries := generateEntries(50000)
+	filename := filepath.Join(t.TempDir(), "test.pairs.gz")
+	writePairs(t, filename, entries)
+
+	// Index doesn't exist, so should be created when parsing
+	pairsFile, err := Parse(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pairsFile.Close()
+
+	if _, err := os.Stat(IndexFilename(filename)); err != nil {
+		t.Fatalf("Index was not created: %v", err)
+	}
+
+	index, err := ParseIndex(IndexFilename(filename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index.Magic != px2Magic {
+		t.Errorf("Unexpected magic %q", index.Magic)
+	}
+	if index.LineCount != uint64(len(entries)) {
+		t.Errorf("Expected line count %d, got %d", len(entries), index.LineCount)
+	}
+	if len(pairsFile.ChromPairList()) != 3 {
+		t.Errorf("Expected 3 chromosome pairs, got %v", pairsFile.ChromPairList())
+	}
+
+	for _, query := range testQueries {
+		found, err := pairsFile.Search(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if expected := countInRange(entries, query); len(found) != expected {
+			t.Errorf("Query %v: expected %d entries, found %d", query, expected, len(found))
+		}
+	}
+}
+
+func TestIndexFilename(t *testing.T) {
+	// The index is always named after the whole data filename, as pairix does, even when .gz appears earlier in the
+	// path or the file has another extension
+	for filename, expected := range map[string]string{
+		"data/test.pairs.gz":        "data/test.pairs.gz.px2",
+		"runs.gz/sample.pairs.gz":   "runs.gz/sample.pairs.gz.px2",
+		"data/test.pairs.bgz":       "data/test.pairs.bgz.px2",
+		"data/test.gz.sorted.pairs": "data/test.gz.sorted.pairs.px2",
+	} {
+		if indexFilename := IndexFilename(filename); indexFilename != expected {
+			t.Errorf("%s: expected index %s, got %s", filename, expected, indexFilename)
+		}
+	}
+}
+
+func TestParseInvalidIndex(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "test.pairs.gz")
+	writePairs(t, filename, generateEntries(1000))
+	if err := ioutil.WriteFile(IndexFilename(filename), []byte("not an index"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	openFiles := func() int {
+		fds, err := ioutil.ReadDir("/proc/self/fd")
+		if err != nil {
+			t.Skip("Can't count open files:", err)
+		}
+		return len(fds)
+	}
+
+	before := openFiles()
+	if _, err := ParseWithOptions(filename, Options{Readers: 2}); err == nil {
+		t.Fatal("Expected error parsing an invalid index")
+	}
+	if after := openFiles(); after != before {
+		t.Errorf("Expected the file to be closed after failing, %d files open before and %d after", before, after)
+	}
+}
+
+func TestReg2Bins(t *testing.T) {
+	regions := [][2]uint64{{0, 1}, {32767, 32769}, {100000, 2000000}, {1 << 27, 1<<27 + 1}, {5000000, 250000000}}
+
+	for _, region := range regions {
+		bins := reg2bins(region[0], region[1], px2BinLevels)
+
+		found := false
+		for _, bin := range bins {
+			if bin > px2MaxBin {
+				t.Errorf("Region %v: bin %d is outside of the binning scheme", region, bin)
+			}
+			if bin == reg2bin(region[0], region[1]) {
+				found = true
+			}
+		}
+
+		if !found {
+			t.Errorf("Region %v: bins %v do not include bin %d", region, bins, reg2bin(region[0], region[1]))
+		}
+	}
+}
@@ -0,0 +1,316 @@
+package pairs
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// StatsOptions control how the summary statistics of a file are counted
+type StatsOptions struct {
+	// Count every entry, rather than estimating the counts of each chromosome pair from the index when the file
+	// has one
+	Exact bool
+	// Distances separating short-range from long-range intrachromosomal entries, which need every entry to be
+	// read
+	DistanceCutoffs []uint64
+}
+
+// DefaultStatsOptions are the options used when none are given
+var DefaultStatsOptions = StatsOptions{DistanceCutoffs: []uint64{1000, 10000, 20000}}
+
+// ChromPairCount is the number of entries between two chromosomes
+type ChromPairCount struct {
+	SourceChrom string
+	TargetChrom string
+	Count       uint64
+}
+
+// DistanceCount is the number of intrachromosomal entries with ends closer than the cutoff (short-range) and
+// at least the cutoff apart (long-range), also as fractions of all entries
+type DistanceCount struct {
+	Cutoff             uint64
+	ShortRange         uint64
+	LongRange          uint64
+	ShortRangeFraction float64
+	LongRangeFraction  float64
+}
+
+// Stats summarises the entries of a file
+type Stats struct {
+	// Whether every entry was counted, rather than the counts being estimated from the index
+	Exact bool
+	Total uint64
+	Cis   uint64
+	Trans uint64
+	// Ratio of cis to trans entries, which is infinite when there are no trans entries
+	CisTransRatio float64
+	// Count of each chromosome pair, from the most to the least entries
+	ChromPairs []ChromPairCount
+	// Short and long-range counts at each cutoff, only when every entry of a .pairs file was read
+	Distances []DistanceCount
+}
+
+// ComputeStats counts the entries of the file by chromosome pair and by distance. The counts of indexed .pairs
+// files are estimated from the share of the compressed file each chromosome pair takes up, scaled to the number
+// of lines in the index, unless exact counts are requested. The counts of .hic files are the sums of the contacts
+// at their lowest resolution, without any distance counts.
+func ComputeStats(ctx context.Context, pairsFile File, options StatsOptions) (*Stats, error) {
+	var counts []ChromPairCount
+	var distances []DistanceCount
+	exact := true
+
+	if estimator, ok := pairsFile.(countEstimator); ok && !options.Exact {
+		counts, ok = estimator.estimateChromPairCounts()
+		exact = !ok
+	}
+	if exact {
+		var err error
+		counts, distances, err = countChromPairs(ctx, pairsFile, options.DistanceCutoffs)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	stats := &Stats{Exact: exact, Distances: distances}
+	for _, count := range counts {
+		if count.Count == 0 {
+			continue
+		}
+
+		stats.ChromPairs = append(stats.ChromPairs, count)
+		stats.Total += count.Count
+		if count.SourceChrom == count.TargetChrom {
+			stats.Cis += count.Count
+		} else {
+			stats.Trans += count.Count
+		}
+	}
+
+	sort.SliceStable(stats.ChromPairs, func(i, j int) bool { return stats.ChromPairs[i].Count > stats.ChromPairs[j].Count })
+	stats.CisTransRatio = float64(stats.Cis) / float64(stats.Trans)
+
+	if stats.Total > 0 {
+		for index := range stats.Distances {
+			stats.Distances[index].ShortRangeFraction = float64(stats.Distances[index].ShortRange) / float64(stats.Total)
+			stats.Distances[index].LongRangeFraction = float64(stats.Distances[index].LongRange) / float64(stats.Total)
+		}
+	}
+
+	return stats, nil
+}
+
+// chromPairs returns each pair of chromosomes with entries in the file once, regardless of their order. The names
+// of chromosome pairs are two chromosomes separated by a single character. When the file only lists the first
+// chromosome of each pair (1D indexes), it is paired with every chromosome.
+func chromPairs(pairsFile File) [][2]string {
+	var chromPairs [][2]string
+	seen := make(map[[2]string]bool)
+	add := func(chrom1, chrom2 string) {
+		if _, ok := pairsFile.Chromsizes()[chrom1]; !ok {
+			return
+		}
+		if _, ok := pairsFile.Chromsizes()[chrom2]; !ok {
+			return
+		}
+		if seen[[2]string{chrom1, chrom2}] || seen[[2]string{chrom2, chrom1}] {
+			return
+		}
+
+		seen[[2]string{chrom1, chrom2}] = true
+		chromPairs = append(chromPairs, [2]string{chrom1, chrom2})
+	}
+
+	for _, name := range pairsFile.ChromPairList() {
+		if _, ok := pairsFile.Chromsizes()[name]; ok {
+			for _, chrom := range pairsFile.Chromosomes() {
+				add(name, chrom)
+			}
+			continue
+		}
+
+		for _, chrom := range pairsFile.Chromosomes() {
+			if len(name) > len(chrom)+1 && strings.HasPrefix(name, chrom) {
+				add(chrom, name[len(chrom)+1:])
+			}
+		}
+	}
+
+	sort.Slice(chromPairs, func(i, j int) bool {
+		return chromPairs[i][0] < chromPairs[j][0] || (chromPairs[i][0] == chromPairs[j][0] && chromPairs[i][1] < chromPairs[j][1])
+	})
+
+	return chromPairs
+}
+
+// countChromPairs counts the entries of each chromosome pair, and the short and long-range intrachromosomal
+// entries at each cutoff, by reading every entry
+func countChromPairs(ctx context.Context, pairsFile File, cutoffs []uint64) ([]ChromPairCount, []DistanceCount, error) {
+	chromsizes := pairsFile.Chromsizes()
+
+	// Files without individual entries are counted from their largest bins, which don't give any distances
+	binned, countBins := pairsFile.(binnedFile)
+	countBins = countBins && !hasEntries(pairsFile)
+
+	var distances []DistanceCount
+	if !countBins {
+		for _, cutoff := range cutoffs {
+			distances = append(distances, DistanceCount{Cutoff: cutoff})
+		}
+	}
+
+	var counts []ChromPairCount
+	for _, chroms := range chromPairs(pairsFile) {
+		count := ChromPairCount{SourceChrom: chroms[0], TargetChrom: chroms[1]}
+		source, target := chromsizes[chroms[0]], chromsizes[chroms[1]]
+
+		if countBins {
+			resolutions := binned.binResolutions()
+			if len(resolutions) == 0 {
+				continue
+			}
+
+			pixels, err := chromPairPixels(ctx, pairsFile, source, target, resolutions[len(resolutions)-1])
+			if err != nil {
+				return nil, nil, err
+			}
+			for _, pixel := range pixels {
+				count.Count += uint64(pixel.count)
+			}
+
+			counts = append(counts, count)
+			continue
+		}
+
+		// The iterator returns the entries of the pair in either order
+		query := Query{SourceChrom: source.Name, SourceStart: 0, SourceEnd: source.Length,
+			TargetChrom: target.Name, TargetStart: 0, TargetEnd: target.Length}
+		iterator, err := pairsFile.Iterate(ctx, query)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		err = forEachEntry(iterator, func(entry *Entry) {
+			count.Count++
+
+			if entry.SourceChrom != entry.TargetChrom {
+				return
+			}
+
+			distance := entry.TargetPosition - entry.SourcePosition
+			if entry.SourcePosition > entry.TargetPosition {
+				distance = entry.SourcePosition - entry.TargetPosition
+			}
+			for index := range distances {
+				if distance < distances[index].Cutoff {
+					distances[index].ShortRange++
+				} else {
+					distances[index].LongRange++
+				}
+			}
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+
+		counts = append(counts, count)
+	}
+
+	return counts, distances, nil
+}
+
+// estimateChromPairCounts estimates the counts from the index. The chromosome pairs of 1D indexes aren't stored
+// contiguously, so can't be estimated.
+func (file *bgzfFile) estimateChromPairCounts() ([]ChromPairCount, bool) {
+	if file.index.LineCount == 0 || file.index.is1D() {
+		return nil, false
+	}
+
+	return file.index.estimateChromPairCounts(file.Chromsizes()), true
+}
+
+// estimateChromPairCounts shares the lines of the file between the chromosome pairs by the span of the file
+// covered by the chunks of each pair. Within a compressed block, the span is taken as a quarter of the
+// uncompressed bytes, as .pairs files typically compress about four-fold.
+func (index indexHeader) estimateChromPairCounts(chromsizes map[string]Chromsize) []ChromPairCount {
+	separator := string(index.Conf.RegionSplitCharacter)
+	position := func(offset uint64) float64 {
+		return float64(offset>>16) + float64(offset&0xFFFF)/4
+	}
+
+	var names []string
+	spans := make(map[string]float64)
+	var totalSpan float64
+	for _, name := range index.TargetNames {
+		first, last := ^uint64(0), uint64(0)
+		for _, bin := range index.BinIndex[name] {
+			for _, chunk := range bin.Chunks {
+				first = min(first, chunk.ChunkBegin)
+				last = max(last, chunk.ChunkEnd)
+			}
+		}
+		if last <= first {
+			continue
+		}
+
+		names = append(names, name)
+		spans[name] = position(last) - position(first)
+		if spans[name] < 0 {
+			spans[name] = 0
+		}
+		totalSpan += spans[name]
+	}
+
+	// The pairs of the same chromosomes in either order are combined
+	combined := make(map[[2]string]int)
+	var counts []ChromPairCount
+	sort.Strings(names)
+	for _, name := range names {
+		chroms := strings.SplitN(name, separator, 2)
+		if len(chroms) != 2 || totalSpan == 0 {
+			continue
+		}
+		if _, ok := chromsizes[chroms[0]]; !ok {
+			continue
+		}
+		if _, ok := chromsizes[chroms[1]]; !ok {
+			continue
+		}
+
+		count := uint64(float64(index.LineCount)*spans[name]/totalSpan + 0.5)
+		if existing, ok := combined[[2]string{chroms[1], chroms[0]}]; ok {
+			counts[existing].Count += count
+			continue
+		}
+
+		combined[[2]string{chroms[0], chroms[1]}] = len(counts)
+		counts = append(counts, ChromPairCount{SourceChrom: chroms[0], TargetChrom: chroms[1], Count: count})
+	}
+
+	return counts
+}
+
+// WriteStatsTSV writes the statistics as name and value columns, in the style of pairtools stats
+func WriteStatsTSV(writer io.Writer, stats *Stats) error {
+	bufWriter := bufio.NewWriter(writer)
+
+	fmt.Fprintf(bufWriter, "exact\t%t\n", stats.Exact)
+	fmt.Fprintf(bufWriter, "total\t%d\n", stats.Total)
+	fmt.Fprintf(bufWriter, "cis\t%d\n", stats.Cis)
+	fmt.Fprintf(bufWriter, "trans\t%d\n", stats.Trans)
+	fmt.Fprintf(bufWriter, "cis_trans_ratio\t%g\n", stats.CisTransRatio)
+	for _, distance := range stats.Distances {
+		fmt.Fprintf(bufWriter, "cis_below_%d\t%d\n", distance.Cutoff, distance.ShortRange)
+		fmt.Fprintf(bufWriter, "cis_%d+\t%d\n", distance.Cutoff, distance.LongRange)
+		fmt.Fprintf(bufWriter, "frac_cis_below_%d\t%g\n", distance.Cutoff, distance.ShortRangeFraction)
+		fmt.Fprintf(bufWriter, "frac_cis_%d+\t%g\n", distance.Cutoff, distance.LongRangeFraction)
+	}
+	for _, count := range stats.ChromPairs {
+		fmt.Fprintf(bufWriter, "chrom_freq/%s/%s\t%d\n", count.SourceChrom, count.TargetChrom, count.Count)
+	}
+
+	return bufWriter.Flush()
+}
@@ -0,0 +1,116 @@
+package pairs
+
+import (
+	"context"
+	"math"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	entries := generateEntries(50000)
+	filename := filepath.Join(t.TempDir(), "test.pairs.gz")
+	writePairs(t, filename, entries)
+
+	pairsFile, err := Parse(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pairsFile.Close()
+
+	cutoffs := []uint64{100000, 500000}
+	expectedCounts := make(map[string]uint64)
+	var cis uint64
+	shortRange := make([]uint64, len(cutoffs))
+	for _, entry := range entries {
+		expectedCounts[entry.SourceChrom+"/"+entry.TargetChrom]++
+		if entry.SourceChrom == entry.TargetChrom {
+			cis++
+			for index, cutoff := range cutoffs {
+				if entry.TargetPosition-entry.SourcePosition < cutoff {
+					shortRange[index]++
+				}
+			}
+		}
+	}
+
+	stats, err := ComputeStats(context.Background(), pairsFile, StatsOptions{Exact: true, DistanceCutoffs: cutoffs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stats.Exact || stats.Total != uint64(len(entries)) || stats.Cis != cis || stats.Trans != uint64(len(entries))-cis {
+		t.Errorf("Expected exact total %d and cis %d, got %+v", len(entries), cis, stats)
+	}
+	if math.Abs(stats.CisTransRatio-float64(cis)/float64(stats.Trans)) > 1e-9 {
+		t.Errorf("Unexpected cis/trans ratio %f", stats.CisTransRatio)
+	}
+	if len(stats.ChromPairs) != 3 {
+		t.Fatalf("Expected 3 chromosome pairs, got %v", stats.ChromPairs)
+	}
+	for index, count := range stats.ChromPairs {
+		if count.Count != expectedCounts[count.SourceChrom+"/"+count.TargetChrom] {
+			t.Errorf("%s/%s: expected %d entries, got %d", count.SourceChrom, count.TargetChrom, expectedCounts[count.SourceChrom+"/"+count.TargetChrom], count.Count)
+		}
+		if index > 0 && count.Count > stats.ChromPairs[index-1].Count {
+			t.Errorf("Chromosome pairs aren't sorted by count: %v", stats.ChromPairs)
+		}
+	}
+	if len(stats.Distances) != len(cutoffs) {
+		t.Fatalf("Expected %d distance cutoffs, got %v", len(cutoffs), stats.Distances)
+	}
+	for index, distance := range stats.Distances {
+		if distance.ShortRange != shortRange[index] || distance.LongRange != cis-shortRange[index] {
+			t.Errorf("Cutoff %d: expected %d short-range entries of %d, got %+v", distance.Cutoff, shortRange[index], cis, distance)
+		}
+		if math.Abs(distance.ShortRangeFraction-float64(shortRange[index])/float64(len(entries))) > 1e-9 {
+			t.Errorf("Cutoff %d: unexpected short-range fraction %f", distance.Cutoff, distance.ShortRangeFraction)
+		}
+	}
+
+	// The estimate from the index shares out the line count, so should be close for each chromosome pair
+	estimate, err := ComputeStats(context.Background(), pairsFile, DefaultStatsOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if estimate.Exact || estimate.Distances != nil || len(estimate.ChromPairs) != 3 {
+		t.Fatalf("Expected an estimate without distances, got %+v", estimate)
+	}
+	if math.Abs(float64(estimate.Total)-float64(len(entries))) > 3 {
+		t.Errorf("Expected an estimated total of %d, got %d", len(entries), estimate.Total)
+	}
+	for _, count := range estimate.ChromPairs {
+		expected := float64(expectedCounts[count.SourceChrom+"/"+count.TargetChrom])
+		if math.Abs(float64(count.Count)-expected) > 0.1*expected {
+			t.Errorf("%s/%s: expected about %f entries, estimated %d", count.SourceChrom, count.TargetChrom, expected, count.Count)
+		}
+	}
+}
+
+func TestChromPairs(t *testing.T) {
+	plain := "## pairs format v1.0\n" +
+		"#chromsize: chr1 2000000\n" +
+		"#chromsize: chr10 2000000\n" +
+		"#chromsize: chr2 2000000\n" +
+		"#columns: readID chrom1 pos1 chrom2 pos2 strand1 strand2\n" +
+		"read1\tchr1\t100\tchr1\t200\t+\t-\n" +
+		"read2\tchr1\t100\tchr10\t200\t+\t-\n" +
+		"read3\tchr10\t100\tchr2\t200\t+\t-\n" +
+		"read4\tchr2\t100\tchr10\t200\t+\t-\n"
+
+	pairsFile, err := ParsePlain(strings.NewReader(plain))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := [][2]string{{"chr1", "chr1"}, {"chr1", "chr10"}, {"chr10", "chr2"}}
+	pairs := chromPairs(pairsFile)
+	if len(pairs) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, pairs)
+	}
+	for index := range expected {
+		if pairs[index] != expected[index] {
+			t.Errorf("Expected %v, got %v", expected, pairs)
+		}
+	}
+}
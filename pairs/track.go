@@ -0,0 +1,161 @@
+package pairs
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// TrackBin is the value of a region in a one-dimensional track, such as a bedGraph record
+type TrackBin struct {
+	Chrom string
+	Start uint64
+	End   uint64
+	Value float64
+}
+
+// FiniteTrackBins returns the bins with a value, dropping NaN and infinite values (which can't be written as JSON)
+func FiniteTrackBins(bins []TrackBin) []TrackBin {
+	finite := make([]TrackBin, 0, len(bins))
+	for _, bin := range bins {
+		if !math.IsNaN(bin.Value) && !math.IsInf(bin.Value, 0) {
+			finite = append(finite, bin)
+		}
+	}
+
+	return finite
+}
+
+// WriteBedGraph writes the bins with a value in bedGraph format
+func WriteBedGraph(writer io.Writer, bins []TrackBin) error {
+	bufWriter := bufio.NewWriter(writer)
+
+	for _, bin := range FiniteTrackBins(bins) {
+		fmt.Fprintf(bufWriter, "%s\t%d\t%d\t%g\n", bin.Chrom, bin.Start, bin.End, bin.Value)
+	}
+
+	return bufWriter.Flush()
+}
+
+// ReadBedGraph reads the records of a bedGraph file, skipping track, browser and comment lines. Errors give the
+// line number rather than the line, as the file may come from a client.
+func ReadBedGraph(reader io.Reader) ([]TrackBin, error) {
+	var bins []TrackBin
+
+	scanner := bufio.NewScanner(reader)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "track") || strings.HasPrefix(line, "browser") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			return nil, fmt.Errorf("Invalid bedGraph line %d (expected 4 columns)", lineNumber)
+		}
+
+		bin := TrackBin{Chrom: fields[0]}
+
+		var err error
+		bin.Start, err = strconv.ParseUint(fields[1], 10, 64)
+		if err == nil {
+			bin.End, err = strconv.ParseUint(fields[2], 10, 64)
+		}
+		if err == nil {
+			bin.Value, err = strconv.ParseFloat(fields[3], 64)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid bedGraph line %d", lineNumber)
+		}
+
+		bins = append(bins, bin)
+	}
+
+	return bins, scanner.Err()
+}
+
+// binTrack averages the values of the track over each bin of the chromosome, weighted by their overlap. Bins
+// without any overlapping values are NaN.
+func binTrack(track []TrackBin, chrom string, resolution uint64, numBins int) []float64 {
+	sums := make([]float64, numBins)
+	lengths := make([]float64, numBins)
+
+	for _, record := range track {
+		if record.Chrom != chrom || record.End <= record.Start || math.IsNaN(record.Value) {
+			continue
+		}
+
+		for bin := record.Start / resolution; bin < uint64(numBins) && bin*resolution < record.End; bin++ {
+			overlap := float64(min(record.End, (bin+1)*resolution) - max(record.Start, bin*resolution))
+			sums[bin] += record.Value * overlap
+			lengths[bin] += overlap
+		}
+	}
+
+	for bin := range sums {
+		if lengths[bin] == 0 {
+			sums[bin] = math.NaN()
+		} else {
+			sums[bin] /= lengths[bin]
+		}
+	}
+
+	return sums
+}
+
+// Feature is a record of a BED file, such as a binding site or a gene
+type Feature struct {
+	Chrom string
+	Start uint64
+	End   uint64
+	Name  string
+	// + or -, or . when the feature has no strand
+	Strand string
+}
+
+// ReadBed reads the records of a BED file, of which only the first three columns are required. Track, browser and
+// comment lines are skipped. As with ReadBedGraph, errors give the line number rather than the line.
+func ReadBed(reader io.Reader) ([]Feature, error) {
+	var features []Feature
+
+	scanner := bufio.NewScanner(reader)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "track") || strings.HasPrefix(line, "browser") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("Invalid BED line %d (expected at least 3 columns)", lineNumber)
+		}
+
+		feature := Feature{Chrom: fields[0], Name: ".", Strand: "."}
+
+		var err error
+		feature.Start, err = strconv.ParseUint(fields[1], 10, 64)
+		if err == nil {
+			feature.End, err = strconv.ParseUint(fields[2], 10, 64)
+		}
+		if err != nil || feature.End < feature.Start {
+			return nil, fmt.Errorf("Invalid BED line %d (expected the start and end positions in columns 2 and 3)", lineNumber)
+		}
+
+		if len(fields) > 3 {
+			feature.Name = fields[3]
+		}
+		if len(fields) > 5 {
+			feature.Strand = fields[5]
+			if feature.Strand != "+" && feature.Strand != "-" && feature.Strand != "." {
+				return nil, fmt.Errorf("Invalid strand in BED line %d (expected +, - or .)", lineNumber)
+			}
+		}
+
+		features = append(features, feature)
+	}
+
+	return features, scanner.Err()
+}
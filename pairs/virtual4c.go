@@ -0,0 +1,154 @@
+package pairs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ViewpointOptions control the profile of a virtual 4C viewpoint
+type ViewpointOptions struct {
+	// Bin size of the profile
+	Resolution uint64
+	// Distance either side of the viewpoint covered by the intrachromosomal profile
+	Flank uint64
+	// Ignore intrachromosomal entries with ends closer than this, such as undigested or self-ligated fragments
+	MinDistance uint64
+	// Number of bins in the moving average used to smooth the profile (0 or 1 for no smoothing)
+	Smooth int
+	// Include a profile of each other chromosome from entries with one end in the viewpoint
+	Trans bool
+	// Only count entries that match the filter
+	Filter *Filter
+}
+
+// ViewpointProfile is the number of entries with one end in the viewpoint by where the other end lands
+type ViewpointProfile struct {
+	Viewpoint  Region
+	Resolution uint64
+	// Number of entries within the flank on the chromosome of the viewpoint, and on other chromosomes
+	Cis   uint64
+	Trans uint64
+	// Bins of the flanking region, followed by the bins of each other chromosome when trans is included
+	Bins []TrackBin
+}
+
+// VirtualFourC counts the entries with one end in the viewpoint (including both ends) into bins by the position of
+// the other end, like a 4C experiment from the viewpoint
+func VirtualFourC(ctx context.Context, pairsFile File, viewpoint Region, options ViewpointOptions) (*ViewpointProfile, error) {
+	if options.Resolution == 0 {
+		return nil, errors.New("Resolution must be greater than 0")
+	}
+	if !hasEntries(pairsFile) {
+		return nil, errors.New("Virtual 4C needs the individual pairs, which .hic files don't contain")
+	}
+
+	chromsizes := pairsFile.Chromsizes()
+	chromsize, ok := chromsizes[viewpoint.Chrom]
+	if !ok {
+		return nil, fmt.Errorf("Unknown chromosome %s", viewpoint.Chrom)
+	}
+	if viewpoint.End <= viewpoint.Start || viewpoint.End > chromsize.Length {
+		return nil, fmt.Errorf("Invalid viewpoint %s, the end must be after the start and within the chromosome", viewpoint)
+	}
+
+	profile := &ViewpointProfile{Viewpoint: viewpoint, Resolution: options.Resolution}
+
+	chromosomes := []string{viewpoint.Chrom}
+	if options.Trans {
+		for _, chrom := range pairsFile.Chromosomes() {
+			if chrom != viewpoint.Chrom {
+				chromosomes = append(chromosomes, chrom)
+			}
+		}
+	}
+
+	for _, chrom := range chromosomes {
+		// The intrachromosomal profile only covers the flanks of the viewpoint, including both ends of the flanks
+		// (and the ends of the chromosome, as positions are 1-based)
+		start, end := uint64(0), chromsizes[chrom].Length
+		if chrom == viewpoint.Chrom {
+			if viewpoint.Start > options.Flank {
+				start = viewpoint.Start - options.Flank
+			}
+			if options.Flank < end-viewpoint.End {
+				end = viewpoint.End + options.Flank
+			}
+		}
+
+		counts := make([]uint64, end/options.Resolution-start/options.Resolution+1)
+
+		// The iterator returns entries in either orientation, so this covers the viewpoint as the first or
+		// second end
+		query := Query{SourceChrom: viewpoint.Chrom, SourceStart: viewpoint.Start, SourceEnd: viewpoint.End,
+			TargetChrom: chrom, TargetStart: start, TargetEnd: end, FilterDistance: options.MinDistance, Filter: options.Filter}
+
+		iterator, err := pairsFile.Iterate(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+
+		for iterator.Next() {
+			entry := iterator.Entry()
+
+			other := entry.TargetPosition
+			if entry.SourceChrom != viewpoint.Chrom || entry.SourcePosition < viewpoint.Start || entry.SourcePosition > viewpoint.End {
+				other = entry.SourcePosition
+			}
+
+			counts[other/options.Resolution-start/options.Resolution]++
+			if chrom == viewpoint.Chrom {
+				profile.Cis++
+			} else {
+				profile.Trans++
+			}
+		}
+
+		err = iterator.Err()
+		iterator.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		values := smoothCounts(counts, options.Smooth)
+		for index, value := range values {
+			binStart := (start/options.Resolution + uint64(index)) * options.Resolution
+			profile.Bins = append(profile.Bins, TrackBin{Chrom: chrom, Start: binStart,
+				End: min(binStart+options.Resolution, chromsizes[chrom].Length), Value: value})
+		}
+	}
+
+	return profile, nil
+}
+
+// smoothCounts returns the moving average of the counts over a window of bins centred on each bin, truncated at
+// the ends
+func smoothCounts(counts []uint64, window int) []float64 {
+	values := make([]float64, len(counts))
+	if window <= 1 {
+		for index, count := range counts {
+			values[index] = float64(count)
+		}
+		return values
+	}
+
+	before := (window - 1) / 2
+	after := window - 1 - before
+	for index := range counts {
+		first, last := index-before, index+after
+		if first < 0 {
+			first = 0
+		}
+		if last >= len(counts) {
+			last = len(counts) - 1
+		}
+
+		var sum uint64
+		for _, count := range counts[first : last+1] {
+			sum += count
+		}
+		values[index] = float64(sum) / float64(last-first+1)
+	}
+
+	return values
+}
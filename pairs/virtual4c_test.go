@@ -0,0 +1,110 @@
+package pairs
+
+import (
+	"context"
+	"math"
+	"path/filepath"
+	"testing"
+)
+
+func TestVirtualFourC(t *testing.T) {
+	entries := generateEntries(20000)
+
+	filename := filepath.Join(t.TempDir(), "test.pairs")
+	writePairs(t, filename, entries)
+
+	pairsFile, err := Parse(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pairsFile.Close()
+
+	viewpoint := Region{Chrom: "chr1", Start: 1000000, End: 1020000}
+	options := ViewpointOptions{Resolution: 50000, Flank: 300000, MinDistance: 10000, Trans: true}
+
+	profile, err := VirtualFourC(context.Background(), pairsFile, viewpoint, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Count the other end of each entry with an end in the viewpoint directly
+	inViewpoint := func(chrom string, position uint64) bool {
+		return chrom == viewpoint.Chrom && position >= viewpoint.Start && position <= viewpoint.End
+	}
+	expected := make(map[string]map[uint64]float64)
+	var cis, trans uint64
+	for _, entry := range entries {
+		chrom, other := entry.TargetChrom, entry.TargetPosition
+		if !inViewpoint(entry.SourceChrom, entry.SourcePosition) {
+			chrom, other = entry.SourceChrom, entry.SourcePosition
+			if !inViewpoint(entry.TargetChrom, entry.TargetPosition) {
+				continue
+			}
+		}
+
+		if entry.SourceChrom == entry.TargetChrom {
+			if entry.TargetPosition-entry.SourcePosition < options.MinDistance || other+options.Flank < viewpoint.Start || other > viewpoint.End+options.Flank {
+				continue
+			}
+			cis++
+		} else {
+			trans++
+		}
+
+		if expected[chrom] == nil {
+			expected[chrom] = make(map[uint64]float64)
+		}
+		expected[chrom][other/options.Resolution*options.Resolution]++
+	}
+
+	if profile.Cis != cis || profile.Trans != trans {
+		t.Errorf("Expected %d cis and %d trans entries, got %d and %d", cis, trans, profile.Cis, profile.Trans)
+	}
+	if cis == 0 || trans == 0 {
+		t.Fatal("Expected entries in the viewpoint")
+	}
+
+	binsPerChrom := make(map[string]int)
+	for _, bin := range profile.Bins {
+		binsPerChrom[bin.Chrom]++
+		if bin.Value != expected[bin.Chrom][bin.Start] {
+			t.Errorf("%s:%d-%d: expected %f, got %f", bin.Chrom, bin.Start, bin.End, expected[bin.Chrom][bin.Start], bin.Value)
+		}
+	}
+	if binsPerChrom["chr1"] != 13 || binsPerChrom["chr2"] != int(testChromsizes[1].Length/options.Resolution+1) {
+		t.Errorf("Unexpected number of bins %v", binsPerChrom)
+	}
+
+	// Each smoothed bin is the mean of the bin and its neighbours
+	options.Smooth = 3
+	options.Trans = false
+	smoothed, err := VirtualFourC(context.Background(), pairsFile, viewpoint, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(smoothed.Bins) != 13 {
+		t.Fatalf("Expected 13 bins, got %d", len(smoothed.Bins))
+	}
+	for index := 1; index+1 < len(smoothed.Bins); index++ {
+		mean := (profile.Bins[index-1].Value + profile.Bins[index].Value + profile.Bins[index+1].Value) / 3
+		if math.Abs(smoothed.Bins[index].Value-mean) > 1e-9 {
+			t.Errorf("Bin %d: expected %f, got %f", index, mean, smoothed.Bins[index].Value)
+		}
+	}
+
+	// Empty viewpoints, or those beyond the end of the chromosome, are rejected
+	for _, invalid := range []Region{{Chrom: "chr1", Start: 0, End: 0}, {Chrom: "chr1", Start: 1000, End: 1000}, {Chrom: "chr1", Start: 1990000, End: 2010000}} {
+		if _, err := VirtualFourC(context.Background(), pairsFile, invalid, ViewpointOptions{Resolution: 50000}); err == nil {
+			t.Errorf("Expected error for viewpoint %s", invalid)
+		}
+	}
+
+	// Flanks are clipped to the chromosome
+	edge, err := VirtualFourC(context.Background(), pairsFile, Region{Chrom: "chr1", Start: 1950000, End: 2000000}, ViewpointOptions{Resolution: 50000, Flank: 300000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(edge.Bins) != 8 || edge.Bins[0].Start != 1650000 || edge.Bins[len(edge.Bins)-1].End != 2000000 {
+		t.Errorf("Expected 8 bins from 1650000 to 2000000, got %+v", edge.Bins)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"math/rand"
 
 	//"crypto/rand"
@@ -13,12 +14,14 @@ import (
 	"math"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"path"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/jessevdk/go-flags"
@@ -33,16 +36,29 @@ import (
 )
 
 var interactFiles map[string]*interact.InteractFile = make(map[string]*interact.InteractFile)
-var pairsFile pairs.File
+
+// interactMutex guards interactFiles, which can be set by requests
+var interactMutex sync.RWMutex
+
+// setInteractFile registers the interactions under the name, replacing any with the same name
+func setInteractFile(name string, interactFile *interact.InteractFile) {
+	interactMutex.Lock()
+	defer interactMutex.Unlock()
+
+	interactFiles[name] = interactFile
+}
 
 var opts struct {
 	// Example of a required flag
-	DataFile             string `short:"d" long:"data" description:"Data to load (.pairs)" required:"true"`
-	Genome               string `short:"g" long:"genome" description:"Genome to load" required:"false"`
-	InteractFile         string `short:"i" long:"interact" description:"Interact file to visualize" required:"false"`
-	MaximumVoronoiPoints int    `long:"maxpoints" description:"Maximum points to calculate voronoi" default:"100000"`
-	Port                 string `short:"p" long:"port" description:"Port used for the server" default:"5002"`
-	Server               bool   `long:"server" description:"Start just the server and don't automatically open the browser"`
+	DataFiles            []string `short:"d" long:"data" description:"Data to load (.pairs or .hic), optionally named as name=path (can be repeated)"`
+	Genome               string   `short:"g" long:"genome" description:"Genome to load" required:"false"`
+	InteractFile         string   `short:"i" long:"interact" description:"Interact file to visualize" required:"false"`
+	MaximumVoronoiPoints int      `long:"maxpoints" description:"Maximum points to calculate voronoi" default:"100000"`
+	Port                 string   `short:"p" long:"port" description:"Port used for the server" default:"5002"`
+	Server               bool     `long:"server" description:"Start just the server and don't automatically open the browser"`
+	Readers              int      `long:"readers" description:"Number of queries that can be processed concurrently on a bgzip compressed .pairs file" default:"4"`
+	CacheBlocks          int      `long:"cacheblocks" description:"Number of decompressed blocks cached per reader (0 to disable)" default:"0"`
+	BuildMatrix          bool     `long:"buildmatrix" description:"Build the binned matrix used for zoomed out images in the background if it doesn't exist"`
 }
 
 // open opens the specified URL in the default browser of the user.
@@ -65,32 +81,68 @@ func open(url string) error {
 }
 
 func main() {
-	_, err := flags.Parse(&opts)
+	parser := flags.NewParser(&opts, flags.Default)
+	parser.SubcommandsOptional = true
+	parser.AddCommand("index", "Create .px2 index", "Create a pairix compatible (.px2) index for each of the supplied bgzip compressed .pairs files", &indexCommand{})
+	parser.AddCommand("bin", "Create binned matrix", "Create the multi-resolution binned matrix (.v3cm) used for zoomed out images of each of the supplied .pairs files", &binCommand{})
+	parser.AddCommand("pscurve", "Compute P(s) curve", "Compute the contact probability as a function of distance (P(s)) for the genome, chromosomes or regions of a .pairs file", &psCurveCommand{})
+	parser.AddCommand("compartments", "Compute compartment eigenvector", "Compute the A/B compartment eigenvector of each chromosome of a .pairs file as bedGraph", &compartmentsCommand{})
+	parser.AddCommand("loops", "Call loops", "Call loops (dots) enriched over their local background in each chromosome of a .pairs file, written as interact or BEDPE", &loopsCommand{})
+	parser.AddCommand("apa", "Aggregate peak analysis", "Average the sub-matrices of a .pairs or .hic file centred on each interaction of an interact file, with the P2LL and Z-score of the centre", &apaCommand{})
+	parser.AddCommand("pileup", "Pile-up around features", "Average the on-diagonal windows of a .pairs or .hic file around each feature of a BED file, oriented by strand", &pileupCommand{})
+	parser.AddCommand("stats", "Summary statistics", "Count the entries of a .pairs or .hic file by chromosome pair, with the cis/trans ratio and the short and long-range fractions", &statsCommand{})
+
+	_, err := parser.Parse()
 
 	if err != nil {
 		log.Fatal(err)
 		return
 	}
 
-	start := time.Now()
-	pairsFile, err = pairs.Parse(opts.DataFile)
-	if err != nil {
-		log.Fatal(err)
+	// Subcommand has already been executed
+	if parser.Active != nil {
 		return
 	}
-	defer pairsFile.Close()
-	elapsed := time.Since(start)
-	fmt.Printf("Processing index took %s\n", elapsed)
 
-	if (pairsFile.Genome() == "" || pairsFile.Genome() == "unknown") && opts.Genome == "" {
-		fmt.Println("No genome specified in pairs file or as command line argument. Please specify the genome using the -g option.")
-		return
+	if err := serve(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// serve loads the datasets and interact file and serves the viewer until the server fails. Errors are returned
+// rather than exiting, so that the datasets are closed.
+func serve() error {
+	if len(opts.DataFiles) == 0 {
+		return errors.New("the required flag `-d, --data' was not specified")
+	}
+
+	defer datasets.Close()
+
+	for _, argument := range opts.DataFiles {
+		name, filename := parseDatasetArgument(argument)
+
+		start := time.Now()
+		pairsFile, err := pairs.ParseWithOptions(filename, pairs.Options{Readers: opts.Readers, CacheBlocks: opts.CacheBlocks, BuildMatrix: opts.BuildMatrix})
+		if err != nil {
+			return err
+		}
+		elapsed := time.Since(start)
+		log.Printf("Processing index of dataset %s took %s\n", name, elapsed)
+
+		if err := datasets.Add(name, filename, pairsFile); err != nil {
+			pairsFile.Close()
+			return err
+		}
+
+		if (pairsFile.Genome() == "" || pairsFile.Genome() == "unknown") && opts.Genome == "" {
+			return fmt.Errorf("No genome specified in pairs file %s or as command line argument. Please specify the genome using the -g option.", filename)
+		}
 	}
 
 	// Process interact file
 	interactFile, err := interact.Parse(opts.InteractFile)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
 	interactFiles["default"] = interactFile
@@ -99,18 +151,25 @@ func main() {
 
 	listener, err := net.Listen("tcp", location)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
 	if !opts.Server {
 		open("http://localhost" + location)
 	}
 
-	startServer(listener)
+	return startServer(listener)
 }
 
 // GetDetails provides information on the loaded file
 func GetDetails(w http.ResponseWriter, r *http.Request) {
+	dataset, err := datasets.Lookup(r.URL.Query().Get("dataset"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	pairsFile := dataset.file
+
 	chromosomes := pairsFile.Chromosomes()
 	chromsizes := pairsFile.Chromsizes()
 
@@ -131,13 +190,76 @@ func GetDetails(w http.ResponseWriter, r *http.Request) {
 		genome = opts.Genome
 	}
 
-	dets, _ := json.Marshal(&details{Genome: genome, Chromosomes: orderedChromosomes, HasInteract: len(interactFiles)})
+	interactMutex.RLock()
+	hasInteract := len(interactFiles)
+	interactMutex.RUnlock()
+
+	dets, _ := json.Marshal(&details{Genome: genome, Chromosomes: orderedChromosomes, HasInteract: hasInteract})
 	w.Write(dets)
 }
 
+// GetHeader returns the records of the header of the dataset as JSON, in the order they appear in the file
+func GetHeader(w http.ResponseWriter, r *http.Request) {
+	dataset, err := datasets.Lookup(r.URL.Query().Get("dataset"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	pairsFile := dataset.file
+
+	header := pairsFile.Header()
+	if header == nil {
+		header = []pairs.HeaderRecord{}
+	}
+
+	bytes, err := json.Marshal(header)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bytes)
+}
+
+// GetDatasets lists the loaded datasets. The first dataset is used when no dataset is specified.
+func GetDatasets(w http.ResponseWriter, r *http.Request) {
+	type datasetDetails struct {
+		Name     string
+		Filename string
+		Genome   string
+	}
+
+	list := datasets.List()
+
+	// The genome given on the command line takes precedence over the genome of each file
+	details := make([]datasetDetails, len(list))
+	for index, dataset := range list {
+		details[index] = datasetDetails{Name: dataset.Name, Filename: dataset.Filename, Genome: dataset.Genome}
+		if opts.Genome != "" {
+			details[index].Genome = opts.Genome
+		}
+	}
+
+	bytes, err := json.Marshal(details)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(bytes)
+}
+
 func GetPoints(w http.ResponseWriter, r *http.Request) {
 	query := r.URL.Query()
 
+	dataset, err := datasets.Lookup(query.Get("dataset"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	pairsFile := dataset.file
+
 	sourceChrom := query.Get("sourceChrom")
 	targetChrom := query.Get("targetChrom")
 
@@ -165,21 +287,35 @@ func GetPoints(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	pairsQuery := pairs.Query{SourceChrom: sourceChrom, SourceStart: uint64(minX), SourceEnd: uint64(maxX), TargetChrom: targetChrom, TargetStart: uint64(minY), TargetEnd: uint64(maxY)}
+	filter, err := filterFromQuery(query, pairsFile)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	pairsQuery := pairs.Query{SourceChrom: sourceChrom, SourceStart: uint64(minX), SourceEnd: uint64(maxX), TargetChrom: targetChrom, TargetStart: uint64(minY), TargetEnd: uint64(maxY), Filter: filter}
 
-	fmt.Printf("Processing Search query %v\n", pairsQuery)
+	log.Printf("Processing Search query %v\n", pairsQuery)
 
-	points, err := pairsFile.Search(pairsQuery)
+	// Stream the entries rather than searching, so only the positions are held in memory
+	iterator, err := pairsFile.Iterate(r.Context(), pairsQuery)
 	if err != nil {
-		fmt.Println(err)
+		log.Println(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	defer iterator.Close()
 
 	var pointData []uint32
-	for _, point := range points {
+	for iterator.Next() {
+		point := iterator.Entry()
 		pointData = append(pointData, uint32(point.SourcePosition), uint32(point.TargetPosition))
 	}
+	if err := iterator.Err(); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/octet-stream")
 	w.Write(uint32ToByte(pointData))
@@ -188,6 +324,13 @@ func GetPoints(w http.ResponseWriter, r *http.Request) {
 func GetVoronoi(w http.ResponseWriter, r *http.Request) {
 	query := r.URL.Query()
 
+	dataset, err := datasets.Lookup(query.Get("dataset"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	pairsFile := dataset.file
+
 	sourceChrom := query.Get("sourceChrom")
 	targetChrom := query.Get("targetChrom")
 
@@ -233,15 +376,21 @@ func GetVoronoi(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	pairsQuery := pairs.Query{SourceChrom: sourceChrom, SourceStart: uint64(minX), SourceEnd: uint64(maxX), TargetChrom: targetChrom, TargetStart: uint64(minY), TargetEnd: uint64(maxY)}
+	filter, err := filterFromQuery(query, pairsFile)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	pairsQuery := pairs.Query{SourceChrom: sourceChrom, SourceStart: uint64(minX), SourceEnd: uint64(maxX), TargetChrom: targetChrom, TargetStart: uint64(minY), TargetEnd: uint64(maxY), Filter: filter}
 
-	points, err := pairsFile.Search(pairsQuery)
+	points, err := pairsFile.SearchContext(r.Context(), pairsQuery)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	result, err := performVoronoi(points, pairsQuery, smoothingIterations) //, numPixelsX, numPixelsY
+	result, err := performVoronoi(pairsFile, points, pairsQuery, smoothingIterations) //, numPixelsX, numPixelsY
 
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -257,7 +406,113 @@ func GetVoronoi(w http.ResponseWriter, r *http.Request) {
 	w.Write(bytes)
 }
 
-func boundingPolygonFromQuery(query pairs.Query) voronoi.Polygon {
+// filterFromQuery creates a filter from the optional orientation, pairType, minMapQ, readIDPrefix and
+// column (name:value) URL parameters. When none are supplied, no filter is returned. The filter is checked
+// against each of the files, so that a filter on a missing column, or on a .hic file, is an error rather than
+// excluding every entry or being ignored.
+func filterFromQuery(query url.Values, pairsFiles ...pairs.File) (*pairs.Filter, error) {
+	var filter pairs.Filter
+	var err error
+
+	hasFilter := false
+
+	if orientation := query.Get("orientation"); orientation != "" {
+		for _, value := range strings.Split(orientation, ",") {
+			filter.Orientations = append(filter.Orientations, pairs.ParseOrientation(strings.TrimSpace(value))...)
+		}
+		hasFilter = true
+	}
+
+	if pairType := query.Get("pairType"); pairType != "" {
+		for _, value := range strings.Split(pairType, ",") {
+			filter.PairTypes = append(filter.PairTypes, strings.TrimSpace(value))
+		}
+		hasFilter = true
+	}
+
+	if minMapQ := query.Get("minMapQ"); minMapQ != "" {
+		filter.MinMapQ, err = strconv.Atoi(minMapQ)
+		if err != nil {
+			return nil, err
+		}
+		hasFilter = true
+	}
+
+	if readIDPrefix := query.Get("readIDPrefix"); readIDPrefix != "" {
+		filter.ReadIDPrefix = readIDPrefix
+		hasFilter = true
+	}
+
+	for _, column := range query["column"] {
+		splitColumn := strings.SplitN(column, ":", 2)
+		if len(splitColumn) != 2 {
+			return nil, fmt.Errorf("invalid column filter %s, expected name:value", column)
+		}
+
+		if filter.Columns == nil {
+			filter.Columns = make(map[string]string)
+		}
+		filter.Columns[splitColumn[0]] = splitColumn[1]
+		hasFilter = true
+	}
+
+	if !hasFilter {
+		return nil, nil
+	}
+
+	for _, pairsFile := range pairsFiles {
+		if err := filter.CheckFile(pairsFile); err != nil {
+			return nil, err
+		}
+	}
+
+	return &filter, nil
+}
+
+// imageQueryFromURL creates the query and view of an image from the sourceChrom, targetChrom, xStart, xEnd,
+// yStart, yEnd, binSizeX, binSizeY, optional filterDistance and filter URL parameters, shared by the image
+// endpoints. Any filter is checked against each of the files.
+func imageQueryFromURL(query url.Values, pairsFiles ...pairs.File) (pairsQuery pairs.Query, viewQuery pairs.Query, binSizeX uint64, binSizeY uint64, err error) {
+	values := make(map[string]uint64)
+	for _, name := range []string{"xStart", "xEnd", "yStart", "yEnd", "binSizeX", "binSizeY", "filterDistance"} {
+		value := query.Get(name)
+		if value == "" && name == "filterDistance" {
+			continue
+		}
+
+		values[name], err = strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return pairsQuery, viewQuery, 0, 0, fmt.Errorf("invalid %s: %w", name, err)
+		}
+	}
+
+	if values["binSizeX"] == 0 || values["binSizeY"] == 0 {
+		return pairsQuery, viewQuery, 0, 0, errors.New("binSizeX and binSizeY must be greater than 0")
+	}
+
+	filter, err := filterFromQuery(query, pairsFiles...)
+	if err != nil {
+		return pairsQuery, viewQuery, 0, 0, err
+	}
+
+	viewQuery = pairs.Query{SourceChrom: query.Get("sourceChrom"), SourceStart: values["xStart"], SourceEnd: values["xEnd"], TargetChrom: query.Get("targetChrom"),
+		TargetStart: values["yStart"], TargetEnd: values["yEnd"], FilterDistance: values["filterDistance"], Filter: filter}
+	pairsQuery = viewQuery
+
+	// If looking at intrachromosomal interactions then data is stored in upper triangle form, so modify query to cover full area
+	if pairsQuery.SourceChrom == pairsQuery.TargetChrom {
+		if pairsQuery.TargetStart < pairsQuery.SourceStart {
+			pairsQuery.SourceStart, pairsQuery.TargetStart = pairsQuery.TargetStart, pairsQuery.SourceStart
+		}
+		if pairsQuery.TargetEnd < pairsQuery.SourceEnd {
+			pairsQuery.SourceEnd, pairsQuery.TargetEnd = pairsQuery.TargetEnd, pairsQuery.SourceEnd
+		}
+	}
+
+	return pairsQuery, viewQuery, values["binSizeX"], values["binSizeY"], nil
+}
+
+func boundingPolygonFromQuery(pairsFile pairs.File, query pairs.Query) voronoi.Polygon {
 	sourceLength := float64(pairsFile.Chromsizes()[query.SourceChrom].Length)
 	targetLength := float64(pairsFile.Chromsizes()[query.TargetChrom].Length)
 
@@ -276,7 +531,7 @@ func boundingPolygonFromQuery(query pairs.Query) voronoi.Polygon {
 	return boundingPolygon
 }
 
-func performVoronoi(points []*pairs.Entry, query pairs.Query, smoothingIterations int) (*voronoi.Voronoi, error) { //, numPixelsX, numPixelsY int
+func performVoronoi(pairsFile pairs.File, points []*pairs.Entry, query pairs.Query, smoothingIterations int) (*voronoi.Voronoi, error) { //, numPixelsX, numPixelsY int
 	// Normalisation options for voronoi calculation:
 	// 1) No normalisation
 	// 2) Normalise to chromosomes
@@ -301,7 +556,7 @@ func performVoronoi(points []*pairs.Entry, query pairs.Query, smoothingIteration
 	// TODO: Apply normalisation in for loop above rather than in voronoi.FromPoints function
 
 	start := time.Now()
-	fmt.Printf("Starting vornoi calculation with %d points\n", len(dPoints))
+	log.Printf("Starting vornoi calculation with %d points\n", len(dPoints))
 
 	// Apply normalisation?
 	/*	for index := range dPoints {
@@ -319,12 +574,12 @@ func performVoronoi(points []*pairs.Entry, query pairs.Query, smoothingIteration
 	//bounds := voronoi.Rect(float64(query.SourceStart)/sourceLength, float64(query.TargetStart)/targetLength, float64(query.SourceEnd)/sourceLength, float64(query.TargetEnd)/targetLength)
 	normalisation := voronoi.Rect(0, 0, sourceLength, targetLength)
 
-	boundingPolygon := boundingPolygonFromQuery(query)
+	boundingPolygon := boundingPolygonFromQuery(pairsFile, query)
 
 	vor, err := voronoi.FromPoints(dPoints, boundingPolygon, normalisation, smoothingIterations)
 	elapsed := time.Since(start)
 	//fmt.Println(triangulation)
-	fmt.Printf("Finishing voronoi calculation: %s [%d polygons] (%d iterations)\n", elapsed, len(vor.Polygons), smoothingIterations)
+	log.Printf("Finishing voronoi calculation: %s [%d polygons] (%d iterations)\n", elapsed, len(vor.Polygons), smoothingIterations)
 
 	//elapsed = time.Since(start)
 	//fmt.Printf("[%s] Originally had %d polygons, but now have %d\n", elapsed, len(vor.Polygons), len(result.Polygons))
@@ -340,7 +595,7 @@ func uint32ToByte(data []uint32) []byte {
 		err := binary.Write(&buf, binary.LittleEndian, d)
 
 		if err != nil {
-			fmt.Printf("binary.Write failed: (%d) %s", d, err)
+			log.Printf("binary.Write failed: (%d) %s", d, err)
 			break
 		}
 	}
@@ -356,7 +611,7 @@ func float64ToByte(floats []float64) []byte {
 		err := binary.Write(&buf, binary.LittleEndian, f)
 
 		if err != nil {
-			fmt.Printf("binary.Write failed: (%f) %s", f, err)
+			log.Printf("binary.Write failed: (%f) %s", f, err)
 			break
 		}
 	}
@@ -365,7 +620,9 @@ func float64ToByte(floats []float64) []byte {
 }
 
 func GetInteract(w http.ResponseWriter, r *http.Request) {
+	interactMutex.RLock()
 	bytes, err := json.Marshal(interactFiles)
+	interactMutex.RUnlock()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -421,9 +678,9 @@ func SetInteract(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if interactions.Name == "" {
-		interactFiles["default"] = interactFile
+		setInteractFile("default", interactFile)
 	} else {
-		interactFiles[interactions.Name] = interactFile
+		setInteractFile(interactions.Name, interactFile)
 	}
 
 	//fmt.Println(interactFile.Interactions)
@@ -433,24 +690,12 @@ func SetInteract(w http.ResponseWriter, r *http.Request) {
 func GetVoronoiAndImage(w http.ResponseWriter, r *http.Request) {
 	query := r.URL.Query()
 
-	sourceChrom := query.Get("sourceChrom")
-	targetChrom := query.Get("targetChrom")
-
-	/*numBins, err := strconv.Atoi(query.Get("numBins"))
+	dataset, err := datasets.Lookup(query.Get("dataset"))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}*/
-	binSizeX, err := strconv.Atoi(query.Get("binSizeX"))
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	binSizeY, err := strconv.Atoi(query.Get("binSizeY"))
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
+	pairsFile := dataset.file
 
 	/*numPixelsX, err := strconv.Atoi(query.Get("pixelsX"))
 	if err != nil {
@@ -470,63 +715,13 @@ func GetVoronoiAndImage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	filterDistance, err := strconv.Atoi(query.Get("filterDistance"))
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	minX, err := strconv.Atoi(query.Get("xStart"))
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	minY, err := strconv.Atoi(query.Get("yStart"))
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	maxX, err := strconv.Atoi(query.Get("xEnd"))
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	maxY, err := strconv.Atoi(query.Get("yEnd"))
+	pairsQuery, viewQuery, binSizeX, binSizeY, err := imageQueryFromURL(query, pairsFile)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	pairsQuery := pairs.Query{SourceChrom: sourceChrom, SourceStart: uint64(minX), SourceEnd: uint64(maxX), TargetChrom: targetChrom, TargetStart: uint64(minY), TargetEnd: uint64(maxY), FilterDistance: uint64(filterDistance)}
-	viewQuery := pairs.Query{SourceChrom: sourceChrom, SourceStart: uint64(minX), SourceEnd: uint64(maxX), TargetChrom: targetChrom, TargetStart: uint64(minY), TargetEnd: uint64(maxY), FilterDistance: uint64(filterDistance)}
-
-	fmt.Println(pairsQuery)
-
-	// If looking at intrachromosomal interactions then data is stored in upper triangle form, so modify query to cover full area
-	if sourceChrom == targetChrom {
-		if pairsQuery.TargetStart < pairsQuery.SourceStart {
-			temp := pairsQuery.TargetStart
-			pairsQuery.TargetStart = pairsQuery.SourceStart
-			pairsQuery.SourceStart = temp
-
-			//temp = pairsQuery.TargetEnd
-			//pairsQuery.TargetEnd = pairsQuery.SourceEnd
-			//pairsQuery.SourceEnd = temp
-		}
-
-		if pairsQuery.TargetEnd < pairsQuery.SourceEnd {
-			temp := pairsQuery.TargetEnd
-			pairsQuery.TargetEnd = pairsQuery.SourceEnd
-			pairsQuery.SourceEnd = temp
-		}
-	}
-
-	fmt.Println(pairsQuery)
-
-	overviewImage, err := pairsFile.Image(pairsQuery, viewQuery, uint64(binSizeX), uint64(binSizeY))
+	overviewImage, err := pairsFile.ImageContext(r.Context(), pairsQuery, viewQuery, binSizeX, binSizeY)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -545,19 +740,19 @@ func GetVoronoiAndImage(w http.ResponseWriter, r *http.Request) {
 		sumPoints += int(count)
 	}
 
-	fmt.Printf("Max # points is %d and have %d\n", opts.MaximumVoronoiPoints, sumPoints)
+	log.Printf("Max # points is %d and have %d\n", opts.MaximumVoronoiPoints, sumPoints)
 
 	//var result *voronoi.Int16VoronoiResult
 	var result *voronoi.Voronoi
 	if sumPoints < opts.MaximumVoronoiPoints {
-		points, err := pairsFile.Search(pairsQuery)
+		points, err := pairsFile.SearchContext(r.Context(), pairsQuery)
 
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		result, err = performVoronoi(points, pairsQuery, smoothingIterations) //, numPixelsX, numPixelsY
+		result, err = performVoronoi(pairsFile, points, pairsQuery, smoothingIterations) //, numPixelsX, numPixelsY
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -582,24 +777,24 @@ func GetVoronoiAndImage(w http.ResponseWriter, r *http.Request) {
 				}
 
 				for i := 0; i < numPointsToSample; i++ {
-					sourcePos := uint64(math.Floor(((float64(x)+rand.Float64())/float64(overviewImage.Width))*float64(maxX-minX))) + uint64(minX)
-					targetPos := uint64(math.Floor(((float64(y)+rand.Float64())/float64(overviewImage.Height))*float64(maxY-minY))) + uint64(minY)
+					sourcePos := uint64(math.Floor(((float64(x)+rand.Float64())/float64(overviewImage.Width))*float64(viewQuery.SourceEnd-viewQuery.SourceStart))) + viewQuery.SourceStart
+					targetPos := uint64(math.Floor(((float64(y)+rand.Float64())/float64(overviewImage.Height))*float64(viewQuery.TargetEnd-viewQuery.TargetStart))) + viewQuery.TargetStart
 
-					if sourceChrom == targetChrom && sourcePos > targetPos {
+					if viewQuery.SourceChrom == viewQuery.TargetChrom && sourcePos > targetPos {
 						temp := targetPos
 						targetPos = sourcePos
 						sourcePos = temp
 					}
 
-					points = append(points, &pairs.Entry{SourceChrom: sourceChrom,
+					points = append(points, &pairs.Entry{SourceChrom: viewQuery.SourceChrom,
 						SourcePosition: sourcePos,
-						TargetChrom:    targetChrom,
+						TargetChrom:    viewQuery.TargetChrom,
 						TargetPosition: targetPos})
 				}
 			}
 		}
 
-		result, err = performVoronoi(points, pairsQuery, smoothingIterations) //, numPixelsX, numPixelsY
+		result, err = performVoronoi(pairsFile, points, pairsQuery, smoothingIterations) //, numPixelsX, numPixelsY
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -698,6 +893,879 @@ func GetVoronoiAndImage(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// GetImage creates the contact matrix of the view, in the same layout as the image of GetVoronoiAndImage. With
+// normalisation=ice (genome-wide) or normalisation=icecis (per chromosome), the matrix is balanced with the ICE
+// weights at the resolution (defaulting to the bin size) and returned as float32, with masked bins as NaN.
+// With normalisation=obsexp, each bin of an intrachromosomal view is divided by the expected contacts at its
+// distance from the diagonal. As the weights and expected contacts include every entry, normalised images can't
+// be filtered.
+func GetImage(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	dataset, err := datasets.Lookup(query.Get("dataset"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	pairsQuery, viewQuery, binSizeX, binSizeY, err := imageQueryFromURL(query, dataset.file)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resolution := min(binSizeX, binSizeY)
+	if value := query.Get("resolution"); value != "" {
+		resolution, err = strconv.ParseUint(value, 10, 64)
+		if err != nil || resolution == 0 {
+			http.Error(w, "invalid resolution "+value, http.StatusBadRequest)
+			return
+		}
+	}
+
+	normalisation := query.Get("normalisation")
+	if normalisation != "" && normalisation != "none" && (pairsQuery.Filter != nil || pairsQuery.FilterDistance > 0) {
+		http.Error(w, "normalisation="+normalisation+" can't be combined with filterDistance or filters, as the normalisation includes every entry", http.StatusBadRequest)
+		return
+	}
+
+	buf := new(bytes.Buffer)
+
+	switch normalisation {
+	case "", "none":
+		var image pairs.Image
+		image, err = dataset.file.ImageContext(r.Context(), pairsQuery, viewQuery, binSizeX, binSizeY)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		binary.Write(buf, binary.BigEndian, image.Width)
+		binary.Write(buf, binary.BigEndian, image.Height)
+		err = binary.Write(buf, binary.BigEndian, image.Data)
+	case "ice", "icecis":
+		var weights *pairs.BalanceWeights
+		weights, err = dataset.BalanceWeights(r.Context(), resolution, normalisation == "icecis")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		var image pairs.FloatImage
+		image, err = pairs.BalancedImage(r.Context(), dataset.file, weights, pairsQuery, viewQuery, binSizeX, binSizeY)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		binary.Write(buf, binary.BigEndian, image.Width)
+		binary.Write(buf, binary.BigEndian, image.Height)
+		err = binary.Write(buf, binary.BigEndian, image.Data)
+	case "obsexp":
+		if viewQuery.SourceChrom != viewQuery.TargetChrom {
+			http.Error(w, "Observed/expected is only available for intrachromosomal views", http.StatusBadRequest)
+			return
+		}
+
+		var expected *pairs.Expected
+		expected, err = dataset.Expected(r.Context(), viewQuery.SourceChrom, resolution)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		var image pairs.FloatImage
+		image, err = pairs.ObsExpImage(r.Context(), dataset.file, expected, pairsQuery, viewQuery, binSizeX, binSizeY)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		binary.Write(buf, binary.BigEndian, image.Width)
+		binary.Write(buf, binary.BigEndian, image.Height)
+		err = binary.Write(buf, binary.BigEndian, image.Data)
+	default:
+		http.Error(w, "Unknown normalisation "+normalisation+", expected none, ice, icecis or obsexp", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(buf.Bytes())
+}
+
+// GetExpected returns the expected contacts of the chromosome (chrom) at each distance as JSON, binned at the
+// resolution
+func GetExpected(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	dataset, err := datasets.Lookup(query.Get("dataset"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	resolution, err := strconv.ParseUint(query.Get("resolution"), 10, 64)
+	if err != nil || resolution == 0 {
+		http.Error(w, "invalid resolution "+query.Get("resolution"), http.StatusBadRequest)
+		return
+	}
+
+	chrom := query.Get("chrom")
+	if _, ok := dataset.file.Chromsizes()[chrom]; !ok {
+		http.Error(w, "Unknown chromosome "+chrom, http.StatusNotFound)
+		return
+	}
+
+	expected, err := dataset.Expected(r.Context(), chrom, resolution)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	bytes, err := json.Marshal(expected)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(bytes)
+}
+
+// GetPsCurve computes the P(s) curve of each region (chromosome, chrom:start-end or genome, defaulting to genome)
+// with log-spaced distance bins (binsPerDecade), optionally split by strand orientation (byOrientation=true).
+// The curves are returned as JSON, or as tab separated values with format=tsv.
+func GetPsCurve(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	dataset, err := datasets.Lookup(query.Get("dataset"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	pairsFile := dataset.file
+
+	options := pairs.DefaultPsOptions
+	if binsPerDecade := query.Get("binsPerDecade"); binsPerDecade != "" {
+		options.BinsPerDecade, err = strconv.Atoi(binsPerDecade)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if byOrientation := query.Get("byOrientation"); byOrientation != "" {
+		options.ByOrientation, err = strconv.ParseBool(byOrientation)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	options.Filter, err = filterFromQuery(query, pairsFile)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	format := query.Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "tsv" {
+		http.Error(w, "Unknown format "+format+", expected json or tsv", http.StatusBadRequest)
+		return
+	}
+
+	curves, err := psCurves(r.Context(), pairsFile, query["region"], options)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if format == "tsv" {
+		w.Header().Set("Content-Type", "text/tab-separated-values")
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	writePsCurves(w, curves, format)
+}
+
+// insulationFromQuery computes the insulation score of the chromosome (chrom) from the resolution and window
+// (in base pairs) URL parameters, optionally with balanced counts (balance=true)
+func insulationFromQuery(r *http.Request) ([]pairs.TrackBin, uint64, error) {
+	query := r.URL.Query()
+
+	dataset, err := datasets.Lookup(query.Get("dataset"))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	resolution, err := strconv.ParseUint(query.Get("resolution"), 10, 64)
+	if err != nil || resolution == 0 {
+		return nil, 0, fmt.Errorf("invalid resolution %s", query.Get("resolution"))
+	}
+
+	options := pairs.InsulationOptions{IgnoreDiagonals: 2}
+	options.Window, err = strconv.ParseUint(query.Get("window"), 10, 64)
+	if err != nil || options.Window < resolution {
+		return nil, 0, fmt.Errorf("invalid window %s, which must be at least the resolution", query.Get("window"))
+	}
+
+	if balance := query.Get("balance"); balance != "" {
+		shouldBalance, err := strconv.ParseBool(balance)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if shouldBalance {
+			options.Weights, err = dataset.BalanceWeights(r.Context(), resolution, true)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+	}
+
+	scores, err := pairs.InsulationScore(r.Context(), dataset.file, query.Get("chrom"), resolution, options)
+
+	return scores, options.Window / resolution, err
+}
+
+// GetInsulation returns the insulation score of each bin of the chromosome as JSON, in the form of bedGraph records
+func GetInsulation(w http.ResponseWriter, r *http.Request) {
+	scores, _, err := insulationFromQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	bytes, err := json.Marshal(pairs.FiniteTrackBins(scores))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bytes)
+}
+
+// GetBoundaries returns the local minima of the insulation score of the chromosome with at least the (optional)
+// threshold strength as BED
+func GetBoundaries(w http.ResponseWriter, r *http.Request) {
+	threshold := 0.0
+	if value := r.URL.Query().Get("threshold"); value != "" {
+		var err error
+		threshold, err = strconv.ParseFloat(value, 64)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	scores, window, err := insulationFromQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	pairs.WriteBoundariesBED(w, pairs.CallBoundaries(scores, int(window), threshold))
+}
+
+// GetCompartments returns the compartment eigenvector of each bin of the chromosome (chrom) at the resolution, as
+// JSON in the form of bedGraph records, or as bedGraph (format=bedgraph). The counts are balanced per chromosome
+// when balance=true. A bedGraph track (e.g. GC content or gene density) posted as the body orients the
+// eigenvector to correlate positively with it.
+func GetCompartments(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	dataset, err := datasets.Lookup(query.Get("dataset"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	resolution, err := strconv.ParseUint(query.Get("resolution"), 10, 64)
+	if err != nil || resolution == 0 {
+		http.Error(w, "invalid resolution "+query.Get("resolution"), http.StatusBadRequest)
+		return
+	}
+
+	format := query.Get("format")
+	if format != "" && format != "json" && format != "bedgraph" {
+		http.Error(w, "invalid format "+format+", expected json or bedgraph", http.StatusBadRequest)
+		return
+	}
+
+	options := pairs.DefaultCompartmentOptions
+
+	if r.Method == http.MethodPost {
+		options.Orientation, err = pairs.ReadBedGraph(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if balance := query.Get("balance"); balance != "" {
+		shouldBalance, err := strconv.ParseBool(balance)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if shouldBalance {
+			options.Weights, err = dataset.BalanceWeights(r.Context(), resolution, true)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+
+	eigenvector, err := pairs.CompartmentEigenvector(r.Context(), dataset.file, query.Get("chrom"), resolution, options)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if format == "bedgraph" {
+		w.Header().Set("Content-Type", "text/plain")
+		pairs.WriteBedGraph(w, eigenvector)
+		return
+	}
+
+	bytes, err := json.Marshal(pairs.FiniteTrackBins(eigenvector))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bytes)
+}
+
+// GetVirtualFourC returns the profile of where the other end of the entries with one end in the viewpoint
+// (chrom:start-end) lands, binned at the resolution within the flank either side of the viewpoint. Optionally,
+// entries closer than minDistance are ignored, the profile is smoothed by a moving average of smooth bins and
+// trans=true adds the profile of every other chromosome. The profile is returned as JSON, or as bedGraph
+// (format=bedgraph).
+func GetVirtualFourC(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	dataset, err := datasets.Lookup(query.Get("dataset"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	pairsFile := dataset.file
+
+	viewpoint, err := pairs.ParseRegion(query.Get("viewpoint"), pairsFile.Chromsizes())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if viewpoint.End <= viewpoint.Start || viewpoint.End > pairsFile.Chromsizes()[viewpoint.Chrom].Length {
+		http.Error(w, "invalid viewpoint "+query.Get("viewpoint")+", the end must be after the start and within the chromosome", http.StatusBadRequest)
+		return
+	}
+
+	var options pairs.ViewpointOptions
+	options.Resolution, err = strconv.ParseUint(query.Get("resolution"), 10, 64)
+	if err != nil || options.Resolution == 0 {
+		http.Error(w, "invalid resolution "+query.Get("resolution"), http.StatusBadRequest)
+		return
+	}
+	options.Flank, err = strconv.ParseUint(query.Get("flank"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid flank "+query.Get("flank"), http.StatusBadRequest)
+		return
+	}
+	if minDistance := query.Get("minDistance"); minDistance != "" {
+		options.MinDistance, err = strconv.ParseUint(minDistance, 10, 64)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if smooth := query.Get("smooth"); smooth != "" {
+		options.Smooth, err = strconv.Atoi(smooth)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if trans := query.Get("trans"); trans != "" {
+		options.Trans, err = strconv.ParseBool(trans)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	options.Filter, err = filterFromQuery(query, pairsFile)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	format := query.Get("format")
+	if format != "" && format != "json" && format != "bedgraph" {
+		http.Error(w, "invalid format "+format+", expected json or bedgraph", http.StatusBadRequest)
+		return
+	}
+
+	profile, err := pairs.VirtualFourC(r.Context(), pairsFile, viewpoint, options)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if format == "bedgraph" {
+		w.Header().Set("Content-Type", "text/plain")
+		pairs.WriteBedGraph(w, profile.Bins)
+		return
+	}
+
+	bytes, err := json.Marshal(profile)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bytes)
+}
+
+// CallLoops calls the loops of the chromosomes (chrom, repeatable, defaulting to all chromosomes) at the resolution
+// and registers them as the interactions with the name (defaulting to loops), so that they are shown alongside any
+// interact file. The loops are returned in the same JSON form as GetInteract, or as interact or BEDPE
+// (format=interact or format=bedpe). The parameters of the caller default to those of pairs.DefaultLoopOptions.
+// As it replaces the registered interactions, it is only available as a POST request.
+func CallLoops(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	dataset, err := datasets.Lookup(query.Get("dataset"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	resolution, err := strconv.ParseUint(query.Get("resolution"), 10, 64)
+	if err != nil || resolution == 0 {
+		http.Error(w, "invalid resolution "+query.Get("resolution"), http.StatusBadRequest)
+		return
+	}
+
+	format := query.Get("format")
+	if format != "" && format != "json" && format != "interact" && format != "bedpe" {
+		http.Error(w, "invalid format "+format+", expected json, interact or bedpe", http.StatusBadRequest)
+		return
+	}
+
+	options := pairs.DefaultLoopOptions
+	for name, target := range map[string]*uint64{"minDistance": &options.MinDistance, "maxDistance": &options.MaxDistance, "minCount": &options.MinCount} {
+		if value := query.Get(name); value != "" {
+			*target, err = strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				http.Error(w, "invalid "+name+" "+value, http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	for name, target := range map[string]*int{"peakWidth": &options.PeakWidth, "windowWidth": &options.WindowWidth} {
+		if value := query.Get(name); value != "" {
+			*target, err = strconv.Atoi(value)
+			if err != nil {
+				http.Error(w, "invalid "+name+" "+value, http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	for name, target := range map[string]*float64{"fdr": &options.FDR, "minEnrichment": &options.MinEnrichment} {
+		if value := query.Get(name); value != "" {
+			*target, err = strconv.ParseFloat(value, 64)
+			if err != nil {
+				http.Error(w, "invalid "+name+" "+value, http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	if balance := query.Get("balance"); balance != "" {
+		shouldBalance, err := strconv.ParseBool(balance)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if shouldBalance {
+			options.Weights, err = dataset.BalanceWeights(r.Context(), resolution, true)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+
+	interactFile, err := callLoops(r.Context(), dataset.file, query["chrom"], resolution, options)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	name := query.Get("name")
+	if name == "" {
+		name = "loops"
+	}
+	setInteractFile(name, interactFile)
+
+	switch format {
+	case "interact":
+		w.Header().Set("Content-Type", "text/plain")
+		interactFile.Write(w)
+	case "bedpe":
+		w.Header().Set("Content-Type", "text/plain")
+		interactFile.WriteBEDPE(w)
+	default:
+		bytes, err := json.Marshal(interactFile)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(bytes)
+	}
+}
+
+// GetAPA averages the sub-matrices at the resolution centred on each interaction of the named set of interactions
+// (name, defaulting to default), returning the matrix with its P2LL and Z-score as JSON. The sub-matrices have
+// flank bins (default 10) either side of the centre, and the scores compare the centre to the lower-left corner
+// of cornerWidth bins (default 6). Intrachromosomal interactions closer than minDistance (default 30 bins) or
+// further than maxDistance are skipped. Counts are balanced (genome wide) when balance=true.
+func GetAPA(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	dataset, err := datasets.Lookup(query.Get("dataset"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	name := query.Get("name")
+	if name == "" {
+		name = "default"
+	}
+	interactMutex.RLock()
+	interactFile := interactFiles[name]
+	interactMutex.RUnlock()
+	if interactFile == nil {
+		http.Error(w, "No interactions named "+name, http.StatusNotFound)
+		return
+	}
+
+	options := pairs.DefaultAPAOptions
+	if resolution := query.Get("resolution"); resolution != "" {
+		options.Resolution, err = strconv.ParseUint(resolution, 10, 64)
+		if err != nil || options.Resolution == 0 {
+			http.Error(w, "invalid resolution "+resolution, http.StatusBadRequest)
+			return
+		}
+	}
+	options.MinDistance = 30 * options.Resolution
+
+	for name, target := range map[string]*uint64{"minDistance": &options.MinDistance, "maxDistance": &options.MaxDistance} {
+		if value := query.Get(name); value != "" {
+			*target, err = strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				http.Error(w, "invalid "+name+" "+value, http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	for name, target := range map[string]*int{"flank": &options.Flank, "cornerWidth": &options.CornerWidth} {
+		if value := query.Get(name); value != "" {
+			*target, err = strconv.Atoi(value)
+			if err != nil {
+				http.Error(w, "invalid "+name+" "+value, http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	if balance := query.Get("balance"); balance != "" {
+		shouldBalance, err := strconv.ParseBool(balance)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if shouldBalance {
+			options.Weights, err = dataset.BalanceWeights(r.Context(), options.Resolution, false)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+
+	apa, err := pairs.AggregatePeakAnalysis(r.Context(), dataset.file, interactionCentres(interactFile), options)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	bytes, err := json.Marshal(newAPAResponse(apa))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bytes)
+}
+
+// PostPileup averages the on-diagonal windows around the features of a BED file, posted as the body, returning the
+// matrix as JSON. The windows have flank bins (default 10) either side
+// of the centre of each feature, or with rescale=true cover each feature padded by padding times its length (default
+// 1) either side, resampled to size bins (default 99). Features on the - strand are reversed. Counts are balanced
+// (per chromosome) when balance=true, and divided by the expected contacts at their distance when obsExp=true.
+func PostPileup(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	dataset, err := datasets.Lookup(query.Get("dataset"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	features, err := pairs.ReadBed(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(features) == 0 {
+		http.Error(w, "No features, post a BED file as the body", http.StatusBadRequest)
+		return
+	}
+
+	options := pairs.DefaultPileupOptions
+	if resolution := query.Get("resolution"); resolution != "" {
+		options.Resolution, err = strconv.ParseUint(resolution, 10, 64)
+		if err != nil || options.Resolution == 0 {
+			http.Error(w, "invalid resolution "+resolution, http.StatusBadRequest)
+			return
+		}
+	}
+	for name, target := range map[string]*int{"flank": &options.Flank, "size": &options.Size} {
+		if value := query.Get(name); value != "" {
+			*target, err = strconv.Atoi(value)
+			if err != nil {
+				http.Error(w, "invalid "+name+" "+value, http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	if padding := query.Get("padding"); padding != "" {
+		options.Padding, err = strconv.ParseFloat(padding, 64)
+		if err != nil {
+			http.Error(w, "invalid padding "+padding, http.StatusBadRequest)
+			return
+		}
+	}
+	for name, target := range map[string]*bool{"rescale": &options.Rescale, "obsExp": &options.ObsExp} {
+		if value := query.Get(name); value != "" {
+			*target, err = strconv.ParseBool(value)
+			if err != nil {
+				http.Error(w, "invalid "+name+" "+value, http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	if balance := query.Get("balance"); balance != "" {
+		shouldBalance, err := strconv.ParseBool(balance)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if shouldBalance {
+			options.Weights, err = dataset.BalanceWeights(r.Context(), options.Resolution, true)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+
+	pileup, err := pairs.FeaturePileup(r.Context(), dataset.file, features, options)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	bytes, err := json.Marshal(pileup)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bytes)
+}
+
+// GetStats returns the summary statistics of the dataset as JSON: the total entries, the count of each
+// chromosome pair, the cis/trans ratio and, with exact=true, the short and long-range fractions at each distance
+// cutoff (cutoff, repeatable, defaulting to 1 kb, 10 kb and 20 kb). Without exact=true, the counts of indexed
+// .pairs files are estimated from the index rather than reading every entry.
+func GetStats(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	dataset, err := datasets.Lookup(query.Get("dataset"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	pairsFile := dataset.file
+
+	options := pairs.DefaultStatsOptions
+	if exact := query.Get("exact"); exact != "" {
+		options.Exact, err = strconv.ParseBool(exact)
+		if err != nil {
+			http.Error(w, "invalid exact "+exact, http.StatusBadRequest)
+			return
+		}
+	}
+	if len(query["cutoff"]) > 0 {
+		options.DistanceCutoffs = nil
+		for _, value := range query["cutoff"] {
+			cutoff, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				http.Error(w, "invalid cutoff "+value, http.StatusBadRequest)
+				return
+			}
+			options.DistanceCutoffs = append(options.DistanceCutoffs, cutoff)
+		}
+	}
+
+	stats, err := pairs.ComputeStats(r.Context(), pairsFile, options)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	bytes, err := json.Marshal(newStatsResponse(stats))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bytes)
+}
+
+// GetDiffImage compares the images of two datasets (datasetA and datasetB) over the same view. The counts of B
+// are scaled to the depth of A, either by the total cis counts (normalisation=cis, the default), by a
+// factor (normalisation=factor&factor=...) or not at all (normalisation=none). The comparison is the
+// log2 ratio of B to A (mode=log2ratio, the default) with a pseudocount (default 1), or the difference
+// B - A (mode=difference). The result has the same layout as the image of GetVoronoiAndImage, but with
+// float32 values.
+func GetDiffImage(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	datasetA, err := datasets.Lookup(query.Get("datasetA"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	datasetB, err := datasets.Lookup(query.Get("datasetB"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	pairsQuery, viewQuery, binSizeX, binSizeY, err := imageQueryFromURL(query, datasetA.file, datasetB.file)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	options := pairs.DiffOptions{Pseudocount: 1, Factor: 1}
+
+	options.Mode, err = pairs.ParseDiffMode(query.Get("mode"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if pseudocount := query.Get("pseudocount"); pseudocount != "" {
+		options.Pseudocount, err = strconv.ParseFloat(pseudocount, 64)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	switch query.Get("normalisation") {
+	case "", "cis":
+		cisCountA, err := datasetA.CisCount(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		cisCountB, err := datasetB.CisCount(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if cisCountA == 0 || cisCountB == 0 {
+			http.Error(w, "Unable to normalise by cis counts, as a dataset has no cis entries", http.StatusBadRequest)
+			return
+		}
+		options.Factor = float64(cisCountA) / float64(cisCountB)
+	case "factor":
+		options.Factor, err = strconv.ParseFloat(query.Get("factor"), 64)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	case "none":
+	default:
+		http.Error(w, "Unknown normalisation "+query.Get("normalisation")+", expected cis, factor or none", http.StatusBadRequest)
+		return
+	}
+
+	if options.Factor <= 0 || options.Pseudocount < 0 {
+		http.Error(w, "factor must be greater than 0 and pseudocount must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("Processing diff image query %v (factor %f)\n", pairsQuery, options.Factor)
+
+	diffImage, err := pairs.DiffImage(r.Context(), datasetA.file, datasetB.file, pairsQuery, viewQuery, binSizeX, binSizeY, options)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, diffImage.Width)
+	binary.Write(buf, binary.BigEndian, diffImage.Height)
+	err = binary.Write(buf, binary.BigEndian, diffImage.Data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(buf.Bytes())
+}
+
 func min(a, b uint64) uint64 {
 	if a < b {
 		return a
@@ -851,14 +1919,14 @@ func max(a, b uint64) uint64 {
 // }
 
 func uploadFile(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("Uploading file of size: ", r.ContentLength)
+	log.Println("Uploading file of size: ", r.ContentLength)
 
 	// Parse our multipart form, 10 << 20 specifies a maximum
 	// upload of 10 MB files.
 	err := r.ParseMultipartForm(10 << 20)
 	if err != nil {
-		fmt.Print("Error Retrieving the File: ")
-		fmt.Println(err)
+		log.Print("Error Retrieving the File: ")
+		log.Println(err)
 		return
 	}
 
@@ -867,19 +1935,19 @@ func uploadFile(w http.ResponseWriter, r *http.Request) {
 	// the Header and the size of the file
 	file, handler, err := r.FormFile("myFile")
 	if err != nil {
-		fmt.Println("Error Retrieving the File")
-		fmt.Println(err)
+		log.Println("Error Retrieving the File")
+		log.Println(err)
 		return
 	}
 	defer file.Close()
-	fmt.Printf("Uploaded File: %+v\n", handler.Filename)
-	fmt.Printf("File Size: %+v\n", handler.Size)
-	fmt.Printf("MIME Header: %+v\n", handler.Header)
+	log.Printf("Uploaded File: %+v\n", handler.Filename)
+	log.Printf("File Size: %+v\n", handler.Size)
+	log.Printf("MIME Header: %+v\n", handler.Header)
 
 	tempFolder := path.Join("static", "temp")
 	err = os.MkdirAll(tempFolder, os.ModePerm)
 	if err != nil {
-		fmt.Println(err)
+		log.Println(err)
 	}
 
 	// Create a temporary file within our temp-images directory that follows
@@ -887,7 +1955,7 @@ func uploadFile(w http.ResponseWriter, r *http.Request) {
 	//tempFile, err := os.Open(tempFolder, "*"+handler.Filename)
 	tempFile, err := os.OpenFile(path.Join(tempFolder, handler.Filename), os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
-		fmt.Println(err)
+		log.Println(err)
 	}
 	defer tempFile.Close()
 
@@ -895,7 +1963,7 @@ func uploadFile(w http.ResponseWriter, r *http.Request) {
 	// byte array
 	fileBytes, err := ioutil.ReadAll(file)
 	if err != nil {
-		fmt.Println(err)
+		log.Println(err)
 	}
 	// write this byte array to our temporary file
 	tempFile.Write(fileBytes)
@@ -903,19 +1971,33 @@ func uploadFile(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "temp/"+handler.Filename)
 }
 
-func startServer(listener net.Listener) {
+func startServer(listener net.Listener) error {
 	router := mux.NewRouter().StrictSlash(true)
 
 	router.HandleFunc("/upload", uploadFile)
 	router.HandleFunc("/details", GetDetails)
+	router.HandleFunc("/header", GetHeader)
+	router.HandleFunc("/datasets", GetDatasets)
 	router.HandleFunc("/points", GetPoints)
 	router.HandleFunc("/voronoi", GetVoronoi)
 	router.HandleFunc("/voronoiandimage", GetVoronoiAndImage)
+	router.HandleFunc("/image", GetImage)
+	router.HandleFunc("/expected", GetExpected)
+	router.HandleFunc("/pscurve", GetPsCurve)
+	router.HandleFunc("/insulation", GetInsulation)
+	router.HandleFunc("/boundaries", GetBoundaries)
+	router.HandleFunc("/compartments", GetCompartments)
+	router.HandleFunc("/virtual4c", GetVirtualFourC)
+	router.HandleFunc("/loops", CallLoops).Methods("POST")
+	router.HandleFunc("/apa", GetAPA)
+	router.HandleFunc("/pileup", PostPileup).Methods("POST")
+	router.HandleFunc("/stats", GetStats)
+	router.HandleFunc("/diffimage", GetDiffImage)
 	router.HandleFunc("/interact", GetInteract).Methods("GET")
 	router.HandleFunc("/interact", SetInteract).Methods("POST")
 	//	router.HandleFunc("/densityImage", GetDensityImage)
 	//router.HandleFunc("/", ListProjects).Methods("GET")
 	router.PathPrefix("/").Handler(http.FileServer(http.Dir("./static/")))
 
-	log.Fatal(http.Serve(listener, router))
+	return http.Serve(listener, router)
 }